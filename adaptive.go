@@ -0,0 +1,141 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SetAdaptiveThreads makes the number of concurrent segment downloads
+// adapt between min and max instead of using the fixed thread count.
+// It starts at min and grows while the throughput improves, and backs
+// off when the server responds with 429 or 503 or latency rises
+func (d *Downloader) SetAdaptiveThreads(min, max int) {
+	if min < 1 {
+		min = 1
+	}
+
+	if max < min {
+		max = min
+	}
+	d.adaptiveMin, d.adaptiveMax = min, max
+}
+
+// limiter controls the number of segments downloaded at once
+type limiter struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	active   int
+	limit    int
+	min, max int
+
+	// Measurements of the current sample
+	start    time.Time
+	attempts int
+	bytes    int64
+	latency  time.Duration
+
+	lastRate    float64
+	baseLatency time.Duration
+
+	log func(level Level, msg string, fields ...Field)
+}
+
+func newLimiter(min, max int, log func(Level, string, ...Field)) *limiter {
+	l := &limiter{limit: min, min: min, max: max, start: time.Now(), log: log}
+	l.cond = sync.NewCond(&l.lock)
+	return l
+}
+
+// acquire blocks until a download can be started, returning
+// false if the context was cancelled while waiting
+func (l *limiter) acquire(ctx context.Context) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for ctx.Err() == nil && l.active >= l.limit {
+		l.cond.Wait()
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+	l.active++
+	return true
+}
+
+// release records the result of a download and frees its place
+func (l *limiter) release(n int, latency time.Duration, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	defer l.cond.Broadcast()
+
+	l.active--
+	var status *StatusError
+	if errors.As(err, &status) && (status.Code == http.StatusTooManyRequests || status.Code == http.StatusServiceUnavailable) {
+		l.throttle(status.Code)
+		return
+	}
+
+	l.attempts++
+	l.bytes += int64(n)
+	l.latency += latency
+
+	// Wait for enough downloads at the current limit to get a fair measurement
+	if l.attempts >= 2*l.limit+2 {
+		elapsed := time.Since(l.start).Seconds()
+		if elapsed <= 0 {
+			elapsed = 1e-9
+		}
+		l.update(float64(l.bytes)/elapsed, l.latency/time.Duration(l.attempts))
+	}
+}
+
+// throttle halves the limit when the server asks the client to slow down
+func (l *limiter) throttle(code int) {
+	limit := l.limit / 2
+	if limit < l.min {
+		limit = l.min
+	}
+
+	if limit != l.limit {
+		l.log(LevelInfo, "reducing threads after throttled response", Field{"threads", limit}, Field{"status", code})
+	}
+	l.limit = limit
+	l.reset()
+}
+
+// update adjusts the limit from the throughput and
+// average latency measured over the last sample
+func (l *limiter) update(rate float64, latency time.Duration) {
+	if l.baseLatency == 0 || latency < l.baseLatency {
+		l.baseLatency = latency
+	}
+
+	switch {
+	case latency > 2*l.baseLatency && l.limit > l.min:
+		l.limit--
+		l.log(LevelInfo, "reducing threads after latency increase", Field{"threads", l.limit}, Field{"latency", latency})
+	case rate > l.lastRate*1.05 && l.limit < l.max:
+		l.limit++
+		l.log(LevelDebug, "increasing threads", Field{"threads", l.limit}, Field{"rate", int64(rate)})
+	}
+
+	l.lastRate = rate
+	l.reset()
+}
+
+func (l *limiter) reset() {
+	l.start = time.Now()
+	l.attempts = 0
+	l.bytes = 0
+	l.latency = 0
+}
+
+func (l *limiter) wake() {
+	l.lock.Lock()
+	l.cond.Broadcast()
+	l.lock.Unlock()
+}
@@ -0,0 +1,374 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+	"github.com/turtletowerz/go-hls/scte35"
+)
+
+// Ways an ad break can be detected
+const (
+	AdDateRange = "daterange" // EXT-X-DATERANGE with SCTE-35 splice information
+	AdCue       = "cue"       // EXT-X-CUE-OUT and EXT-X-CUE-IN, or EXT-OATCLS-SCTE35
+	AdPattern   = "pattern"   // a discontinuity run with segment URIs matching an ad pattern
+)
+
+const (
+	// adBreakTolerance is how close to the end of a break of known duration a
+	// segment can start and still be part of the content after it, and how
+	// close to the START-DATE of a date range one can start to be the first of it
+	adBreakTolerance = 100 * time.Millisecond
+
+	// adBreakLimit is how long a break without a duration can last before
+	// it is assumed that its in marker was lost, and the content continues
+	adBreakLimit = 5 * time.Minute
+)
+
+// AdBreak is an interval of a stream that was removed as an ad
+type AdBreak struct {
+	Start         time.Duration `json:"start"` // from the start of the stream, including earlier breaks
+	Duration      time.Duration `json:"duration"`
+	Segments      int           `json:"segments"`
+	FirstSequence int64         `json:"first_sequence"`
+	Date          time.Time     `json:"date,omitempty"` // from EXT-X-PROGRAM-DATE-TIME, if the playlist has it
+	Reason        string        `json:"reason"`
+}
+
+// String describes the break for the report
+func (b AdBreak) String() string {
+	return fmt.Sprintf("%v to %v (%d segments from %d, %s)", b.Start, b.Start+b.Duration, b.Segments, b.FirstSequence, b.Reason)
+}
+
+// AdRemover finds the segments of ad breaks so the Downloader skips them.
+// Breaks start at the segment their marker appears before, or the START-DATE
+// of EXT-X-DATERANGE, and end at the matching in marker or once their
+// duration has passed. Breaks without a duration end after 5 minutes if
+// their in marker never appears. Segments after a
+// discontinuity are also skipped until the next one if the URI of the first
+// matches any of the patterns, which finds ads inserted by the server
+type AdRemover struct {
+	patterns []*regexp.Regexp
+	lock     sync.Mutex
+	breaks   []AdBreak
+}
+
+// NewAdRemover creates an AdRemover that also treats discontinuity runs
+// starting with a segment URI matching any of patterns as ads
+func NewAdRemover(patterns ...*regexp.Regexp) *AdRemover {
+	return &AdRemover{patterns: patterns}
+}
+
+// Breaks returns the ad breaks that have been removed so far. With
+// DownloadAll, the breaks of every playlist are included
+func (r *AdRemover) Breaks() []AdBreak {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]AdBreak(nil), r.breaks...)
+}
+
+func (r *AdRemover) add(b AdBreak) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.breaks = append(r.breaks, b)
+}
+
+// SetAdRemover sets the AdRemover used to skip the ad breaks of every
+// playlist that is downloaded. nil, the default, downloads every segment
+func (d *Downloader) SetAdRemover(r *AdRemover) {
+	d.ads = r
+}
+
+// adState follows the ad breaks of a single playlist as its segments are queued
+type adState struct {
+	d       *Downloader
+	remover *AdRemover
+
+	cue       string        // the way the current marked break was found, if there is one
+	remaining time.Duration // of the current marked break, or 0 if it lasts until an in marker
+	pattern   bool          // the current discontinuity run matches an ad pattern
+	started   bool
+
+	offset    time.Duration
+	date      time.Time
+	current   *AdBreak
+	scheduled []scheduledSplice // from date ranges whose START-DATE has not been reached
+
+	writtenMap *m3u8.Map // the media initialization section written before the last segment that was kept
+	kept       int
+	skipped    int
+}
+
+// skipAds wraps a producer so the segments of ad breaks are not queued
+func (d *Downloader) skipAds(produce producer) producer {
+	if d.ads == nil {
+		return produce
+	}
+
+	return func(ctx context.Context, queue func(job) bool) error {
+		s := &adState{d: d, remover: d.ads}
+		err := produce(ctx, func(j job) bool {
+			if s.isAd(j) {
+				s.skipped++
+				return true
+			}
+
+			// The media initialization section of the content has to be written
+			// again if the ad was the last to have one, or if the skipped
+			// segment was the only one with it
+			segment := j.segment
+			if segment.Map == nil && j.init != nil && !sameMap(j.init, s.writtenMap) {
+				copied := *segment
+				copied.Map = j.init
+				segment = &copied
+			}
+
+			if segment.Map != nil {
+				s.writtenMap = segment.Map
+			}
+
+			j.segment, j.index, j.total = segment, s.kept, j.total-s.skipped
+			s.kept++
+			return queue(j)
+		})
+		if s.cue != "" {
+			s.d.log(LevelWarn, "ad break did not end before the end of the playlist", Field{"reason", s.cue})
+		}
+		s.finish()
+		return err
+	}
+}
+
+// scheduledSplice starts or ends a break at the START-DATE of a date range
+type scheduledSplice struct {
+	start    time.Time
+	out      bool
+	duration time.Duration
+}
+
+// isAd returns whether the segment of j is part of an ad break, recording it in the report if it is
+func (s *adState) isAd(j job) bool {
+	segment := j.segment
+	if !segment.DateTime.IsZero() {
+		s.date = segment.DateTime
+	}
+
+	for i := range segment.DateRanges {
+		s.dateRange(&segment.DateRanges[i])
+	}
+	s.startScheduled()
+
+	for _, tag := range segment.Tags {
+		s.tag(tag)
+	}
+
+	if s.cue != "" && s.remaining == 0 && s.current != nil && s.current.Duration >= adBreakLimit {
+		s.d.log(LevelWarn, "ad break without a duration did not end, continuing with the content", Field{"start", s.current.Start}, Field{"reason", s.cue})
+		s.breakIn()
+	}
+
+	// A discontinuity starts a new run, which is checked against the patterns from its first segment
+	if segment.Discontinuity || !s.started {
+		s.started = true
+		s.pattern = false
+		uri := s.d.resolve(j.playlistURL, segment.URI)
+		for _, pattern := range s.remover.patterns {
+			if pattern.MatchString(uri) {
+				s.pattern = true
+				break
+			}
+		}
+	}
+
+	reason := s.cue
+	if reason == "" && s.pattern {
+		reason = AdPattern
+	}
+
+	duration := m3u8.Seconds(segment.Duration)
+	if reason != "" {
+		if s.current == nil {
+			s.current = &AdBreak{Start: s.offset, FirstSequence: j.sequence, Reason: reason}
+			if !s.date.IsZero() {
+				s.current.Date = s.date
+			}
+		}
+		s.current.Duration += duration
+		s.current.Segments++
+	} else {
+		s.finish()
+	}
+
+	if s.cue != "" && s.remaining > 0 {
+		if s.remaining -= duration; s.remaining < adBreakTolerance {
+			s.cue = ""
+		}
+	}
+
+	s.offset += duration
+	if !s.date.IsZero() {
+		s.date = s.date.Add(duration)
+	}
+	return reason != ""
+}
+
+// finish adds the current break to the report
+func (s *adState) finish() {
+	if s.current != nil {
+		s.d.log(LevelInfo, "skipped ad break", Field{"start", s.current.Start}, Field{"duration", s.current.Duration}, Field{"reason", s.current.Reason})
+		s.remover.add(*s.current)
+		s.current = nil
+	}
+}
+
+func (s *adState) breakOut(reason string, duration time.Duration) {
+	s.cue, s.remaining = reason, duration
+}
+
+func (s *adState) breakIn() {
+	s.cue, s.remaining = "", 0
+}
+
+// splice starts or ends a break from decoded SCTE-35 splice information
+func (s *adState) splice(reason string, info *scte35.SpliceInfo) {
+	if info.Out() {
+		duration, _ := info.BreakDuration()
+		s.breakOut(reason, duration)
+	} else if info.In() {
+		s.breakIn()
+	}
+}
+
+// dateRange schedules the start or end of a break at the START-DATE of
+// dateRange, which can be after the segment the tag appears before
+func (s *adState) dateRange(dateRange *m3u8.DateRange) {
+	splice := scheduledSplice{start: dateRange.StartDate}
+	switch {
+	case dateRange.SCTE35Out != "":
+		splice.out = true
+		splice.duration = m3u8.Seconds(dateRange.Duration)
+		if splice.duration == 0 {
+			splice.duration = m3u8.Seconds(dateRange.PlannedDuration)
+		}
+
+		if splice.duration == 0 && !dateRange.EndDate.IsZero() {
+			splice.duration = dateRange.EndDate.Sub(dateRange.StartDate)
+		}
+	case dateRange.SCTE35In != "":
+	case dateRange.SCTE35Cmd != "":
+		info, err := scte35.DecodeHex(dateRange.SCTE35Cmd)
+		if err != nil {
+			s.d.log(LevelWarn, "invalid SCTE35-CMD", Field{"id", dateRange.ID}, Field{"error", err})
+			return
+		}
+
+		if !info.Out() && !info.In() {
+			return
+		}
+		splice.out = info.Out()
+		splice.duration, _ = info.BreakDuration()
+	default:
+		return
+	}
+	s.scheduled = append(s.scheduled, splice)
+}
+
+// startScheduled starts or ends the breaks of date ranges whose START-DATE the
+// current segment has reached. Without EXT-X-PROGRAM-DATE-TIME, they start
+// at the segment they appear before
+func (s *adState) startScheduled() {
+	waiting := s.scheduled[:0]
+	for _, splice := range s.scheduled {
+		if !s.date.IsZero() && splice.start.Sub(s.date) > adBreakTolerance {
+			waiting = append(waiting, splice)
+			continue
+		}
+
+		if !splice.out {
+			s.breakIn()
+			continue
+		}
+
+		// A break that started before the segment has already lasted part of its duration
+		duration := splice.duration
+		if late := s.date.Sub(splice.start); !s.date.IsZero() && duration > 0 && late > adBreakTolerance {
+			if duration -= late; duration < adBreakTolerance {
+				continue
+			}
+		}
+		s.breakOut(AdDateRange, duration)
+	}
+	s.scheduled = waiting
+}
+
+func (s *adState) tag(tag m3u8.Tag) {
+	switch tag.Name {
+	case "EXT-X-CUE-OUT":
+		s.breakOut(AdCue, cueDuration(tag.Value))
+	case "EXT-X-CUE-OUT-CONT":
+		// Joining a live stream during a break only shows the tags that continue it
+		if s.cue == "" {
+			elapsed, duration := cueProgress(tag.Value)
+			if duration > elapsed {
+				s.breakOut(AdCue, duration-elapsed)
+			} else {
+				s.breakOut(AdCue, 0)
+			}
+		}
+	case "EXT-X-CUE-IN":
+		s.breakIn()
+	case "EXT-OATCLS-SCTE35":
+		info, ok := tag.Data.(*scte35.SpliceInfo)
+		if !ok {
+			var err error
+			if info, err = scte35.DecodeBase64(tag.Value); err != nil {
+				s.d.log(LevelWarn, "invalid EXT-OATCLS-SCTE35", Field{"error", err})
+				return
+			}
+		}
+		s.splice(AdCue, info)
+	}
+}
+
+// cueDuration parses the value of EXT-X-CUE-OUT, which is written as either
+// a number of seconds or as DURATION=seconds, or 0 if it has no duration
+func cueDuration(value string) time.Duration {
+	for _, attr := range strings.Split(value, ",") {
+		attr = strings.TrimPrefix(attr, "DURATION=")
+		if duration, err := strconv.ParseFloat(attr, 64); err == nil {
+			return time.Duration(duration * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// cueProgress parses the value of EXT-X-CUE-OUT-CONT, written either as
+// elapsed/duration or as ElapsedTime=elapsed,Duration=duration
+func cueProgress(value string) (elapsed, duration time.Duration) {
+	parse := func(s string) time.Duration {
+		f, _ := strconv.ParseFloat(s, 64)
+		return time.Duration(f * float64(time.Second))
+	}
+
+	if split := strings.SplitN(value, "/", 2); len(split) == 2 {
+		return parse(split[0]), parse(split[1])
+	}
+
+	for _, attr := range strings.Split(value, ",") {
+		if split := strings.SplitN(attr, "=", 2); len(split) == 2 {
+			switch strings.ToLower(split[0]) {
+			case "elapsedtime":
+				elapsed = parse(split[1])
+			case "duration":
+				duration = parse(split[1])
+			}
+		}
+	}
+	return elapsed, duration
+}
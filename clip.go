@@ -0,0 +1,162 @@
+package hls
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// clipRange holds the time range set with SetClip or SetClipTime
+type clipRange struct {
+	start, end time.Duration // offsets from the start of the playlist
+	from, to   time.Time     // wall-clock times from EXT-X-PROGRAM-DATE-TIME
+	wallClock  bool
+	trim       bool
+}
+
+// SetClip limits the download to the segments covering the range between
+// start and end, which are offsets from the start of the media playlist.
+// An end of 0 means the range continues to the end of the playlist.
+// Clipping only applies to playlists that have ended, and downloading a
+// live playlist with a clip is an error. Use SetLiveDuration to limit live
+// recordings
+func (d *Downloader) SetClip(start, end time.Duration) {
+	d.clip = &clipRange{start: start, end: end, trim: d.clip != nil && d.clip.trim}
+}
+
+// SetClipTime limits the download to the segments covering the wall-clock range
+// between from and to, using the EXT-X-PROGRAM-DATE-TIME tags of the playlist.
+// A zero to means the range continues to the end of the playlist. As with
+// SetClip, downloading a live playlist with a clip is an error
+func (d *Downloader) SetClipTime(from, to time.Time) {
+	d.clip = &clipRange{from: from, to: to, wallClock: true, trim: d.clip != nil && d.clip.trim}
+}
+
+// SetPreciseClip sets whether Download trims the output to the exact clip
+// range when remuxing. Without it the output starts and ends on segment
+// boundaries. It has no effect on DownloadTo, which does not remux
+func (d *Downloader) SetPreciseClip(precise bool) {
+	if d.clip == nil {
+		if !precise {
+			return
+		}
+		d.clip = new(clipRange)
+	}
+	d.clip.trim = precise
+}
+
+// offsets converts the wall-clock range of the clip into offsets
+// from the start of the playlist using its timeline
+func (c *clipRange) offsets(playlist *m3u8.MediaPlaylist) (start, end time.Duration, err error) {
+	timeline := playlist.Timeline()
+	if len(timeline.Segments) == 0 || timeline.Segments[0].Start.IsZero() {
+		return 0, 0, fmt.Errorf("playlist has no EXT-X-PROGRAM-DATE-TIME to clip by wall-clock time")
+	}
+
+	if start = offsetAt(timeline, c.from); start < 0 {
+		start = 0
+	}
+
+	if !c.to.IsZero() {
+		if end = offsetAt(timeline, c.to); end <= 0 {
+			return 0, 0, fmt.Errorf("clip ends before the start of the playlist")
+		}
+	}
+	return start, end, nil
+}
+
+// offsetAt converts a wall-clock time into an offset from the start of the
+// playlist. Times before the playlist are negative, and times in a gap
+// between segments are moved to the start of the segment after it
+func offsetAt(timeline *m3u8.Timeline, date time.Time) time.Duration {
+	if segment, ok := timeline.SegmentAt(date); ok {
+		return segment.Offset + date.Sub(segment.Start)
+	}
+
+	for i, segment := range timeline.Segments {
+		if date.Before(segment.Start) {
+			if i == 0 {
+				return date.Sub(segment.Start)
+			}
+			return segment.Offset
+		}
+	}
+
+	last := timeline.Segments[len(timeline.Segments)-1]
+	return last.Offset + date.Sub(last.Start)
+}
+
+// apply returns a copy of the playlist containing only the segments covering
+// the clip range, along with the ffmpeg arguments to trim it precisely
+func (c *clipRange) apply(playlist *m3u8.MediaPlaylist) (*m3u8.MediaPlaylist, []string, error) {
+	// SetPreciseClip alone does not set a range
+	if !c.wallClock && c.start == 0 && c.end == 0 {
+		return playlist, nil, nil
+	}
+
+	if !playlist.EndList {
+		return nil, nil, fmt.Errorf("live playlists can not be clipped, use SetLiveDuration to limit live recordings")
+	}
+
+	start, end := c.start, c.end
+	if c.wallClock {
+		var err error
+		if start, end, err = c.offsets(playlist); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if end != 0 && end <= start {
+		return nil, nil, fmt.Errorf("clip end %v is not after clip start %v", end, start)
+	}
+
+	first, last := -1, -1
+	var offset, firstStart time.Duration
+	for i, segment := range playlist.Segments {
+		segmentEnd := offset + m3u8.Seconds(segment.Duration)
+		if first == -1 && segmentEnd > start {
+			first = i
+			firstStart = offset
+		}
+
+		if first != -1 && (end == 0 || offset < end) {
+			last = i
+		}
+		offset = segmentEnd
+	}
+
+	if first == -1 {
+		return nil, nil, fmt.Errorf("clip start %v is past the end of the playlist (%v)", start, offset)
+	}
+
+	clipped := *playlist
+	clipped.MediaSequence += int64(first)
+
+	// The media initialization section only appears on the first segment it
+	// applies to, and a byte range can start where the one before it ended,
+	// so both have to be carried over to the first segment if it was clipped
+	segment := *playlist.Segments[first]
+	if segment.Map == nil {
+		segment.Map = playlist.MapAt(first)
+	}
+
+	if segment.ByteRange != 0 {
+		segment.Offset = playlist.ByteOffsets()[first]
+	}
+	clipped.Segments = append([]*m3u8.Segment{&segment}, playlist.Segments[first+1:last+1]...)
+
+	var args []string
+	if c.trim {
+		args = append(args, "-ss", formatSeconds(start-firstStart))
+		if end != 0 {
+			args = append(args, "-t", formatSeconds(end-start))
+		}
+	}
+	return &clipped, args, nil
+}
+
+func formatSeconds(duration time.Duration) string {
+	return strconv.FormatFloat(duration.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/turtletowerz/go-hls/packager"
+)
+
+func encrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	var (
+		output     = fs.String("o", "encrypted", "directory to write the segments, keys and index.m3u8 to")
+		rotate     = fs.Int("rotate", 0, "number of segments to encrypt with each key, 0 uses a single key")
+		explicitIV = fs.Bool("explicit-iv", false, "write a random IV for every segment instead of using the media sequence number, which fMP4 maps need")
+		keyURI     = fs.String("key-uri", "", "URI that key files are served from, which their names are added to")
+	)
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go-hls encrypt [flags] PLAYLIST.m3u8")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := os.MkdirAll(*output, os.ModePerm); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+
+	e := packager.NewEncrypter(packager.KeyFiles(*output, *keyURI))
+	e.SetKeyRotation(*rotate)
+	e.SetExplicitIV(*explicitIV)
+
+	playlist, err := e.EncryptDir(fs.Arg(0), *output)
+	if err != nil {
+		return err
+	}
+
+	// With explicit IVs the same key is listed once for every segment
+	keys := make(map[string]bool)
+	for _, key := range playlist.Keys {
+		keys[key.URI] = true
+	}
+
+	fmt.Printf("encrypted %d segments with %d keys to %s\n", len(playlist.Segments), len(keys), *output)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	hls "github.com/turtletowerz/go-hls"
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+func info(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the decoded playlist as JSON")
+	request := addRequestFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go-hls info [flags] URL")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	d := hls.New(http.DefaultClient, "", 1)
+	if err := request.apply(d); err != nil {
+		return err
+	}
+
+	playlist, err := d.Playlist(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(playlist)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	switch p := playlist.(type) {
+	case *m3u8.MasterPlaylist:
+		printMaster(w, p)
+	case *m3u8.MediaPlaylist:
+		printMedia(w, p)
+	}
+	return w.Flush()
+}
+
+func printMaster(w io.Writer, p *m3u8.MasterPlaylist) {
+	fmt.Fprintln(w, "VARIANTS")
+	fmt.Fprintln(w, "BANDWIDTH\tAVERAGE\tRESOLUTION\tFRAME RATE\tCODECS\tAUDIO\tSUBTITLES\tURI")
+	for _, v := range p.Variants {
+		fmt.Fprintf(w, "%d\t%d\t%dx%d\t%.3f\t%s\t%s\t%s\t%s\n", v.Bandwidth, v.BandwidthAvg, v.Resolution.Width, v.Resolution.Height, v.FrameRate, v.Codecs, v.Audio, v.Subtitles, v.URI)
+	}
+
+	if len(p.IVariants) > 0 {
+		fmt.Fprintln(w, "\nI-FRAME VARIANTS")
+		fmt.Fprintln(w, "BANDWIDTH\tAVERAGE\tRESOLUTION\tCODECS\tURI")
+		for _, v := range p.IVariants {
+			fmt.Fprintf(w, "%d\t%d\t%dx%d\t%s\t%s\n", v.Bandwidth, v.BandwidthAvg, v.Resolution.Width, v.Resolution.Height, v.Codecs, v.URI)
+		}
+	}
+
+	if len(p.Renditions) > 0 {
+		fmt.Fprintln(w, "\nRENDITIONS")
+		fmt.Fprintln(w, "TYPE\tGROUP\tNAME\tLANGUAGE\tDEFAULT\tAUTOSELECT\tURI")
+		for _, r := range p.Renditions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Type, r.GroupID, r.Name, r.Language, r.Default, r.AutoSelect, r.URI)
+		}
+	}
+}
+
+func printMedia(w io.Writer, p *m3u8.MediaPlaylist) {
+	summary := p.Summary()
+	fmt.Fprintf(w, "Target duration:\t%ds\n", p.TargetDuration)
+	fmt.Fprintf(w, "Media sequence:\t%d\n", p.MediaSequence)
+	fmt.Fprintf(w, "Segments:\t%d\n", summary.Segments)
+	fmt.Fprintf(w, "Duration:\t%v\n", time.Duration(summary.Duration*float64(time.Second)).Round(time.Millisecond))
+	fmt.Fprintf(w, "Keys:\t%d\n", len(p.Keys))
+	fmt.Fprintf(w, "Ended:\t%t\n", summary.Ended)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	hls "github.com/turtletowerz/go-hls"
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// inspection is the JSON output of the inspect command
+type inspection struct {
+	Type     string        `json:"type"`
+	Summary  interface{}   `json:"summary"`
+	Playlist m3u8.Playlist `json:"playlist,omitempty"`
+}
+
+// loadPlaylist decodes a playlist from a URL, a local file, or stdin if source is "-"
+func loadPlaylist(d *hls.Downloader, source string) (m3u8.Playlist, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return d.Playlist(source)
+	}
+
+	var r io.Reader = os.Stdin
+	if source != "-" {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("opening playlist: %w", err)
+		}
+
+		defer file.Close()
+		r = file
+	}
+	return m3u8.DecodeReader(r)
+}
+
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the summary as JSON")
+	full := fs.Bool("full", false, "include the decoded playlist in the JSON output")
+	request := addRequestFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `Usage: go-hls inspect [flags] URL|FILE|-`)
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	d := hls.New(http.DefaultClient, "", 1)
+	if err := request.apply(d); err != nil {
+		return err
+	}
+
+	playlist, err := loadPlaylist(d, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var out inspection
+	switch p := playlist.(type) {
+	case *m3u8.MasterPlaylist:
+		out.Type, out.Summary = "master", p.Summary()
+	case *m3u8.MediaPlaylist:
+		out.Type, out.Summary = "media", p.Summary()
+	}
+
+	if *asJSON {
+		if *full {
+			out.Playlist = playlist
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	switch s := out.Summary.(type) {
+	case m3u8.MasterSummary:
+		fmt.Fprintf(w, "Variants:\t%d\n", len(s.Variants))
+		fmt.Fprintf(w, "Bandwidth:\t%d - %d\n", s.MinBandwidth, s.MaxBandwidth)
+		for _, typ := range []string{m3u8.MediaAudio, m3u8.MediaVideo, m3u8.MediaSubtitles, m3u8.MediaCaptions} {
+			fmt.Fprintf(w, "%s renditions:\t%d\n", typ, s.Renditions[typ])
+		}
+
+		fmt.Fprintln(w, "\nBANDWIDTH\tAVERAGE\tRESOLUTION\tI-FRAME\tURI")
+		for _, v := range s.Variants {
+			fmt.Fprintf(w, "%d\t%d\t%dx%d\t%t\t%s\n", v.Bandwidth, v.AverageBandwidth, v.Resolution.Width, v.Resolution.Height, v.IFrame, v.URI)
+		}
+	case m3u8.MediaSummary:
+		fmt.Fprintf(w, "Segments:\t%d\n", s.Segments)
+		fmt.Fprintf(w, "Duration:\t%v\n", time.Duration(s.Duration*float64(time.Second)).Round(time.Millisecond))
+		fmt.Fprintf(w, "Longest segment:\t%.3fs\n", s.MaxDuration)
+		fmt.Fprintf(w, "Encrypted segments:\t%d\n", s.EncryptedSegments)
+		fmt.Fprintf(w, "Key rotations:\t%d\n", s.KeyRotations)
+		fmt.Fprintf(w, "Discontinuities:\t%d\n", s.Discontinuities)
+		fmt.Fprintf(w, "Ended:\t%t\n", s.Ended)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,315 @@
+// Command go-hls downloads, serves, packages and inspects HLS streams.
+//
+// Usage:
+//
+//	go-hls [download] [flags] URL
+//	go-hls mirror [flags] URL
+//	go-hls proxy [flags] URL
+//	go-hls serve [flags] DIR
+//	go-hls segment [flags] FILE
+//	go-hls encrypt [flags] FILE
+//	go-hls info [flags] URL
+//	go-hls inspect [flags] URL|FILE|-
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	hls "github.com/turtletowerz/go-hls"
+)
+
+const usage = `Usage:
+  go-hls [download] [flags] URL   download a stream
+  go-hls mirror [flags] URL       copy a stream to a directory that can be played locally
+  go-hls proxy [flags] URL        serve a stream to local players through a proxy
+  go-hls serve [flags] DIR        serve a directory of playlists and segments
+  go-hls segment [flags] FILE     cut a transport stream into segments and a playlist
+  go-hls encrypt [flags] FILE     encrypt the segments of a playlist with AES-128
+  go-hls info [flags] URL         print the variants and renditions of a playlist
+  go-hls inspect [flags] SOURCE   summarize a playlist from a URL, file or stdin
+
+Run "go-hls <command> -h" for the flags of a command.
+`
+
+// headerFlag collects repeated "Name: value" flags
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return ""
+}
+
+func (h headerFlag) Set(value string) error {
+	split := strings.SplitN(value, ":", 2)
+	if len(split) != 2 {
+		return fmt.Errorf("header %q is not in the form \"Name: value\"", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(split[0]), strings.TrimSpace(split[1]))
+	return nil
+}
+
+// cookieFlag collects repeated "name=value" flags
+type cookieFlag []*http.Cookie
+
+func (c *cookieFlag) String() string {
+	return ""
+}
+
+func (c *cookieFlag) Set(value string) error {
+	split := strings.SplitN(value, "=", 2)
+	if len(split) != 2 {
+		return fmt.Errorf("cookie %q is not in the form name=value", value)
+	}
+	*c = append(*c, &http.Cookie{Name: strings.TrimSpace(split[0]), Value: strings.TrimSpace(split[1])})
+	return nil
+}
+
+// patternFlag collects repeated regular expression flags
+type patternFlag []*regexp.Regexp
+
+func (p *patternFlag) String() string {
+	return ""
+}
+
+func (p *patternFlag) Set(value string) error {
+	pattern, err := regexp.Compile(value)
+	if err != nil {
+		return fmt.Errorf("parsing pattern %q: %w", value, err)
+	}
+	*p = append(*p, pattern)
+	return nil
+}
+
+// requestFlags are the flags shared by every command that makes requests
+type requestFlags struct {
+	headers headerFlag
+	cookies cookieFlag
+	base    string
+	rate    string
+	verbose bool
+}
+
+func addRequestFlags(fs *flag.FlagSet) *requestFlags {
+	r := &requestFlags{headers: make(headerFlag)}
+	fs.Var(r.headers, "H", "add a request header in the form \"Name: value\" (repeatable)")
+	fs.Var(&r.cookies, "cookie", "add a request cookie in the form name=value (repeatable)")
+	fs.StringVar(&r.base, "base", "", "base URL for segments with relative paths")
+	fs.StringVar(&r.rate, "rate", "", "limit bandwidth in bytes per second, with an optional K, M or G suffix")
+	fs.BoolVar(&r.verbose, "v", false, "log diagnostic output to stderr")
+	return r
+}
+
+// apply configures d with the request flags
+func (r *requestFlags) apply(d *hls.Downloader) error {
+	if len(r.headers) > 0 {
+		d.AddRequestHook(hls.StaticHeaders(http.Header(r.headers)))
+	}
+
+	if len(r.cookies) > 0 {
+		d.AddRequestHook(hls.Cookies(r.cookies...))
+	}
+
+	if r.base != "" {
+		d.SetBaseURL(r.base)
+	}
+
+	if r.rate != "" {
+		rate, err := parseSize(r.rate)
+		if err != nil {
+			return fmt.Errorf("parsing rate: %w", err)
+		}
+		d.SetRateLimiter(hls.NewRateLimiter(rate))
+	}
+
+	if r.verbose {
+		d.SetLogger(hls.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), hls.LevelDebug))
+	}
+	return nil
+}
+
+// parseSize parses a number of bytes with an optional K, M or G suffix
+func parseSize(value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// progressBar returns a ProgressFunc drawing a progress bar to stderr
+func progressBar() hls.ProgressFunc {
+	const width = 40
+	start := time.Now()
+	return func(done, total int) error {
+		filled := width
+		if total > 0 {
+			filled = done * width / total
+		}
+
+		fmt.Fprintf(os.Stderr, "\r[%s%s] %d/%d segments %s", strings.Repeat("#", filled), strings.Repeat(".", width-filled), done, total, time.Since(start).Round(time.Second))
+		if done == total {
+			fmt.Fprintln(os.Stderr)
+		}
+		return nil
+	}
+}
+
+func download(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	var (
+		output     = fs.String("o", "output.mp4", `output path, or "-" to write the stream to stdout`)
+		format     = fs.String("format", "", `output format passed to ffmpeg, or "ts" to write the stream without remuxing`)
+		all        = fs.Bool("all", false, "download every variant and rendition into the directory given by -o")
+		quality    = fs.String("quality", "best", `variant to download: "best", "worst" or a resolution such as 1280x720`)
+		threads    = fs.Int("threads", 4, "number of segments to download at once")
+		adaptive   = fs.String("adaptive", "", `adapt the number of threads between "min:max" instead of using -threads`)
+		duration   = fs.Duration("duration", 0, "maximum duration to record of a live stream")
+		start      = fs.Duration("start", 0, "offset to start the download from")
+		end        = fs.Duration("end", 0, "offset to end the download at")
+		precise    = fs.Bool("precise", false, "trim the output exactly to -start and -end instead of segment boundaries")
+		retries    = fs.Int("retries", 3, "number of times a segment is attempted")
+		retryDelay = fs.Duration("retry-delay", 500*time.Millisecond, "delay before retrying a segment, growing with every attempt")
+		quiet      = fs.Bool("q", false, "do not show a progress bar")
+		skipAds    = fs.Bool("skip-ads", false, "skip ad breaks marked by SCTE-35 date ranges or cue tags, and print the intervals removed")
+		adPatterns patternFlag
+	)
+	fs.Var(&adPatterns, "ad-pattern", "skip discontinuity runs whose segment URIs match this regular expression, which implies -skip-ads (repeatable)")
+
+	request := addRequestFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go-hls download [flags] URL")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	d := hls.New(http.DefaultClient, *quality, *threads)
+	if err := request.apply(d); err != nil {
+		return err
+	}
+
+	if *adaptive != "" {
+		var min, max int
+		if _, err := fmt.Sscanf(*adaptive, "%d:%d", &min, &max); err != nil {
+			return fmt.Errorf("parsing adaptive threads %q: %w", *adaptive, err)
+		}
+		d.SetAdaptiveThreads(min, max)
+	}
+
+	d.SetRetries(*retries, *retryDelay)
+	d.SetLiveDuration(*duration)
+	if *start != 0 || *end != 0 {
+		d.SetClip(*start, *end)
+	}
+	d.SetPreciseClip(*precise)
+
+	if !*quiet && *output != "-" {
+		d.SetProgressFunc(progressBar())
+	}
+
+	var ads *hls.AdRemover
+	if *skipAds || len(adPatterns) != 0 {
+		ads = hls.NewAdRemover(adPatterns...)
+		d.SetAdRemover(ads)
+		defer func() {
+			for _, b := range ads.Breaks() {
+				fmt.Fprintf(os.Stderr, "removed ad break %v\n", b)
+			}
+		}()
+	}
+
+	stream := fs.Arg(0)
+	if *all {
+		paths, err := d.DownloadAll(*output, stream)
+		for _, path := range paths {
+			fmt.Println(path)
+		}
+		return err
+	}
+
+	if *output == "-" {
+		return d.DownloadTo(os.Stdout, stream)
+	}
+
+	if *format == "ts" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("creating output file: %w", err)
+		}
+
+		if err := d.DownloadTo(file, stream); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+	return d.Download(*output, stream, "", *format)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("go-hls: ")
+
+	args := os.Args[1:]
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "download":
+		err = download(args[1:])
+	case "mirror":
+		err = mirror(args[1:])
+	case "proxy":
+		err = serveProxy(args[1:])
+	case "serve":
+		err = serve(args[1:])
+	case "segment":
+		err = segment(args[1:])
+	case "encrypt":
+		err = encrypt(args[1:])
+	case "info":
+		err = info(args[1:])
+	case "inspect":
+		err = inspect(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stderr, usage)
+	default:
+		err = download(args)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
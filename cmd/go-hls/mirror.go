@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	hls "github.com/turtletowerz/go-hls"
+)
+
+func mirror(args []string) error {
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	var (
+		output     = fs.String("o", "mirror", "directory to write the mirror to")
+		all        = fs.Bool("all", false, "mirror every variant and rendition instead of the one chosen by -quality")
+		quality    = fs.String("quality", "best", `variant to mirror: "best", "worst" or a resolution such as 1280x720`)
+		threads    = fs.Int("threads", 4, "number of segments to download at once")
+		retries    = fs.Int("retries", 3, "number of times a segment is attempted")
+		retryDelay = fs.Duration("retry-delay", 500*time.Millisecond, "delay before retrying a segment, growing with every attempt")
+		quiet      = fs.Bool("q", false, "do not show a progress bar")
+	)
+
+	request := addRequestFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go-hls mirror [flags] URL")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	d := hls.New(http.DefaultClient, *quality, *threads)
+	if err := request.apply(d); err != nil {
+		return err
+	}
+
+	d.SetRetries(*retries, *retryDelay)
+	if !*quiet {
+		d.SetProgressFunc(progressBar())
+	}
+	return d.Mirror(*output, fs.Arg(0), *all)
+}
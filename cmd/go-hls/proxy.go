@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	hls "github.com/turtletowerz/go-hls"
+	"github.com/turtletowerz/go-hls/proxy"
+)
+
+func serveProxy(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	var (
+		listen    = fs.String("listen", "localhost:8080", "address to listen on")
+		decrypt   = fs.Bool("decrypt", false, "decrypt AES-128 segments so players do not need the keys")
+		cacheSize = fs.String("cache", "256M", "memory to use for caching segments, such as 512K, 64M or 1G")
+	)
+
+	request := addRequestFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go-hls proxy [flags] URL")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	d := hls.New(http.DefaultClient, "", 1)
+	if err := request.apply(d); err != nil {
+		return err
+	}
+
+	size, err := parseSize(*cacheSize)
+	if err != nil {
+		return err
+	}
+
+	p := proxy.New(d)
+	p.SetDecrypt(*decrypt)
+	p.SetCacheSize(size)
+
+	log.Printf("serving %s on http://%s%s", fs.Arg(0), *listen, p.URL(fs.Arg(0)))
+	return http.ListenAndServe(*listen, p)
+}
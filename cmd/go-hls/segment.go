@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/turtletowerz/go-hls/mpegts"
+)
+
+func segment(args []string) error {
+	fs := flag.NewFlagSet("segment", flag.ExitOnError)
+	var (
+		output = fs.String("o", "segments", "directory to write the segments and index.m3u8 to")
+		target = fs.Duration("target", 6*time.Second, "duration to cut segments at, on the next keyframe")
+	)
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go-hls segment [flags] FILE.ts")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	playlist, err := mpegts.SegmentFile(fs.Arg(0), *output, *target)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %d segments to %s\n", len(playlist.Segments), *output)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/turtletowerz/go-hls/origin"
+)
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		listen      = fs.String("listen", "localhost:8080", "address to listen on")
+		allowOrigin = fs.String("allow-origin", "*", `Access-Control-Allow-Origin of responses, or "" to disable CORS`)
+		static      = fs.Duration("static-max-age", 365*24*time.Hour, "how long segments and ended playlists can be cached")
+		live        = fs.Duration("live-max-age", 0, "how long live playlists can be cached, 0 uses half of the target duration")
+	)
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go-hls serve [flags] DIR")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s := origin.New(fs.Arg(0))
+	s.SetAllowOrigin(*allowOrigin)
+	s.SetCacheControl(*static, *live)
+
+	log.Printf("serving %s on http://%s/", fs.Arg(0), *listen)
+	return http.ListenAndServe(*listen, s)
+}
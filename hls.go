@@ -2,11 +2,14 @@ package hls
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,14 +17,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/turtletowerz/go-hls/m3u8"
 )
 
-var (
-	tempStorage string = filepath.Join(os.TempDir(), "hls-go")
-	emptyKey           = []byte{0}
-)
+var tempStorage string = filepath.Join(os.TempDir(), "hls-go")
 
 // ProgressFunc represents the function type
 // required to be passed to the SetProgressFunc method
@@ -30,17 +31,34 @@ type ProgressFunc func(int, int) error
 // Downloader is the struct which contains
 // all of the information and methods to download
 type Downloader struct {
-	sync.Mutex
-	client   *http.Client
-	quality  string
-	threads  int
-	baseURL  string
-	keyCache []*m3u8.Key
-	progress ProgressFunc
+	client       *http.Client
+	quality      string
+	threads      int
+	adaptiveMin  int
+	adaptiveMax  int
+	buffer       int
+	bufferBytes  int64
+	retries      int
+	retryDelay   time.Duration
+	clip         *clipRange
+	liveDuration time.Duration
+	baseURL      string
+	keys         KeyProvider
+	keyLock      sync.Mutex
+	keyCache     map[keyID]*keyEntry
+	hooks        []RequestHook
+	refresh      func() error
+	refreshLock  sync.Mutex // held while refresh runs
+	refreshes    int        // refreshes done, so forbidden requests can tell if they are stale
+	limiter      *RateLimiter
+	ads          *AdRemover
+	progress     ProgressFunc
+	logger       Logger
 }
 
-// SetProgressFunc assigns a function that gets
-// called after every new segment that is downloaded
+// SetProgressFunc assigns a function that gets called after every
+// new segment that is downloaded, with the number of segments
+// completed so far and the total number of segments
 func (d *Downloader) SetProgressFunc(f ProgressFunc) {
 	d.progress = f
 }
@@ -51,157 +69,233 @@ func (d *Downloader) SetBaseURL(base string) {
 	d.baseURL = base
 }
 
-func (d *Downloader) downloadSegment(segment *m3u8.Segment, index int, mediaSequence int64) error {
-	if !strings.HasPrefix(segment.URI, "http") {
-		segment.URI = d.baseURL + segment.URI
+// SetKeyProvider sets the KeyProvider used to get the value of segment
+// keys. By default keys are requested from their URI with the HTTP client
+func (d *Downloader) SetKeyProvider(provider KeyProvider) {
+	d.keys = provider
+}
+
+// resolve returns uri as an absolute URL, using the base URL if one
+// was set or otherwise resolving it against the playlist it came from
+func (d *Downloader) resolve(playlistURL, uri string) string {
+	if strings.HasPrefix(uri, "http") {
+		return uri
+	}
+
+	if d.baseURL != "" {
+		return d.baseURL + uri
+	}
+
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return uri
+	}
+
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return uri
 	}
+	return base.ResolveReference(ref).String()
+}
 
-	resp, err := d.client.Get(segment.URI)
+// resource is a URI, or the byte range of it if length is not 0
+type resource struct {
+	uri    string
+	length int
+	offset int
+}
+
+// fetchRaw returns the body of uri as it was received
+func (d *Downloader) fetchRaw(ctx context.Context, uri string) ([]byte, error) {
+	return d.fetchResource(ctx, resource{uri: uri})
+}
+
+// fetchResource returns the body of a resource, only requesting its byte range if it has one
+func (d *Downloader) fetchResource(ctx context.Context, r resource) ([]byte, error) {
+	resp, err := d.GetRange(ctx, r.uri, r.length, r.offset)
 	if err != nil {
-		return fmt.Errorf("getting segment uri: %w", err)
+		return nil, err
 	}
 
 	defer resp.Body.Close()
-	file, err := os.Create(filepath.Join(tempStorage, strconv.Itoa(index)+".ts"))
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil && len(data) < r.length {
+		err = fmt.Errorf("byte range %d@%d is outside of the resource, only %d bytes were received", r.length, r.offset, len(data))
+	}
+	return data, err
+}
+
+// segmentResource returns the resource of the segment of a job
+func (d *Downloader) segmentResource(j job) resource {
+	return resource{uri: d.resolve(j.playlistURL, j.segment.URI), length: j.segment.ByteRange, offset: j.offset}
+}
+
+// mapResource returns the resource of the media initialization section of a job
+func (d *Downloader) mapResource(playlistURL string, init *m3u8.Map) (resource, error) {
+	length, offset, err := init.Range()
+	return resource{uri: d.resolve(playlistURL, init.URI), length: length, offset: offset}, err
+}
+
+// loadMap returns the decrypted contents of the media initialization section of a job
+func (d *Downloader) loadMap(ctx context.Context, j job) ([]byte, error) {
+	init := j.init
+	res, err := d.mapResource(j.playlistURL, init)
 	if err != nil {
-		return fmt.Errorf("creating ts file: %w", err)
+		return nil, err
 	}
 
-	defer file.Close()
-	respBytes, err := ioutil.ReadAll(resp.Body)
+	data, err := j.output.fetch(ctx, d, res)
 	if err != nil {
-		return fmt.Errorf("reading segment response: %w", err)
+		return nil, fmt.Errorf("getting map uri: %w", err)
 	}
 
-	noKey := segment.KeyIndex == -1
-	var key *m3u8.Key
-	if !noKey {
-		key = d.keyCache[segment.KeyIndex]
-		noKey = bytes.Equal(key.Value, m3u8.EmptyKey)
+	// 4.3.2.5 - The section is encrypted with the key that applies to the
+	// EXT-X-MAP tag, which has to have an IV since it has no sequence number
+	if key := j.initKey; key != nil && key.Method != m3u8.CryptNone {
+		if key.IV == "" {
+			return nil, fmt.Errorf("encrypted media initialization section %s has no IV", init.URI)
+		}
+		return Decrypt(data, key, 0)
+	}
+	return data, nil
+}
+
+// fetchSegment downloads the segment of a job and returns its decrypted
+// contents. MPEG-TS segments are trimmed to their first sync byte, and
+// fragmented MP4 segments with a Map have the section prepended
+func (d *Downloader) fetchSegment(ctx context.Context, j job) ([]byte, error) {
+	segment, key := j.segment, j.key
+	respBytes, err := j.output.fetch(ctx, d, d.segmentResource(j))
+	if err != nil {
+		return nil, fmt.Errorf("getting segment uri: %w", err)
 	}
 
-	var out []byte
-	if !noKey {
-		length := len(respBytes)
-		if length%aes.BlockSize != 0 {
-			return fmt.Errorf("data is not a valid multiple of aes block size")
+	out := respBytes
+	if key != nil && key.Method != m3u8.CryptNone {
+		if out, err = Decrypt(respBytes, key, j.sequence); err != nil {
+			return nil, err
 		}
+	}
 
-		block, err := aes.NewCipher(key.Value)
-		if err != nil {
-			return fmt.Errorf("creating aes cipher: %w", err)
+	if j.init == nil {
+		// Credits to github.com/oopsguy/m3u8 for this
+		// Remove all bytes before SyncByte so TS files can be merged
+		syncByte := uint8(71) // 0x47
+		for j := 0; j < len(out); j++ {
+			if out[j] == syncByte {
+				out = out[j:]
+				break
+			}
 		}
+		return out, nil
+	}
 
-		var iv []byte
-		if key.IV != "" {
-			iv = []byte(key.IV)
-		} else {
-			iv = []byte(fmt.Sprintf("%016d", mediaSequence))
+	// The initialization section has to come before the first segment it
+	// applies to for the fragmented MP4 to be playable
+	if segment.Map != nil {
+		init, err := d.loadMap(ctx, j)
+		if err != nil {
+			return nil, fmt.Errorf("loading media initialization section: %w", err)
 		}
+		out = append(init, out...)
+	}
+	return out, nil
+}
 
-		data := make([]byte, length)
-		cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, respBytes)
-		out = data[:(length - int(data[length-1]))]
+// Decrypt decrypts an AES-128 segment with the Value of key, removing its
+// padding. Without an IV the media sequence number of the segment is used
+func Decrypt(data []byte, key *m3u8.Key, sequence int64) ([]byte, error) {
+	length := len(data)
+	if length == 0 || length%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("data is not a valid multiple of aes block size")
 	}
 
-	// Credits to github.com/oopsguy/m3u8 for this
-	// Remove all bytes before SyncByte so TS files can be merged
-	syncByte := uint8(71) // 0x47
-	for j := 0; j < len(out); j++ {
-		if out[j] == syncByte {
-			out = out[j:]
-			break
-		}
+	block, err := aes.NewCipher(key.Value)
+	if err != nil {
+		return nil, fmt.Errorf("creating aes cipher: %w", err)
 	}
 
-	if _, err := file.Write(out); err != nil {
-		return fmt.Errorf("writing segment to file: %w", err)
+	// 5.2 - Without an IV attribute the Media Sequence Number is
+	// used as the IV, as a big-endian binary representation
+	iv := make([]byte, aes.BlockSize)
+	if key.IV != "" {
+		copy(iv, key.IV)
+	} else {
+		binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
 	}
-	/*
-		// TODO
-			d.complete++
-			if d.progress != nil {
-				if err := d.progress(d.complete, d.m3u8.SegmentCount); err != nil {
-					return fmt.Errorf("progress func error: %w", err)
-				}
-			}
-	*/
-	return nil
+
+	out := make([]byte, length)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	if padding := int(out[length-1]); padding > 0 && padding <= aes.BlockSize {
+		out = out[:length-padding]
+	}
+	return out, nil
 }
 
-func (d *Downloader) downloadMediaPlaylist(playlist *m3u8.MediaPlaylist, output, subs, format string) error {
-	// TODO: maybe reimplement actual key caching?
+// loadKeys loads the value of every key in the playlist
+func (d *Downloader) loadKeys(ctx context.Context, playlist *m3u8.MediaPlaylist, playlistURL string) error {
 	for _, key := range playlist.Keys {
-		if err := key.Load(d.client, d.baseURL); err != nil {
+		if key.Method == m3u8.CryptNone {
+			continue
+		}
+
+		value, err := d.loadKey(ctx, key, playlistURL)
+		if err != nil {
 			return fmt.Errorf("loading key value: %w", err)
 		}
+		key.Value = value
 	}
-	d.keyCache = playlist.Keys
+	return nil
+}
 
-	segCount := len(playlist.Segments)
-	indexes := make([]int, segCount, segCount)
-	concatStr := "concat:0.ts"
-	for i := 0; i < segCount; i++ {
-		indexes[i] = i
-		concatStr += "|" + strconv.Itoa(i) + ".ts"
+func (d *Downloader) downloadMediaPlaylist(produce producer, output, subs, format string, trim []string) error {
+	file, err := ioutil.TempFile(tempStorage, "*.ts")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
 	}
 
-	var wg sync.WaitGroup
-	for i := 0; i < d.threads; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				d.Lock()
-				if len(indexes) == 0 {
-					break
-				}
-				idx := indexes[0]
-				indexes = indexes[1:]
-				segment := playlist.Segments[idx]
-				d.Unlock()
-
-				if err := d.downloadSegment(segment, idx, playlist.MediaSequence); err != nil {
-					fmt.Printf("error downloading segment %d (returning to queue): %v\n", idx, err)
-					d.Lock()
-					indexes = append(indexes, idx)
-					d.Unlock()
-				}
-			}
-		}()
+	defer os.Remove(file.Name())
+	err = d.fetchAll(produce, func(index int, data []byte) error {
+		if _, err := file.Write(data); err != nil {
+			return fmt.Errorf("writing segment %d to file: %w", index, err)
+		}
+		return nil
+	})
+
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("closing temporary file: %w", closeErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"-i", file.Name()}, trim...)
+	args = append(args, "-c", "copy")
+	if format != "" {
+		args = append(args, "-f", format)
 	}
 
-	wg.Wait()
-	cmd := exec.Command("ffmpeg", "-i", concatStr, "-c", "copy", "-y", output)
+	cmd := exec.Command("ffmpeg", append(args, "-y", output)...)
 	//"-metadata", `encoding_tool="no_variable_data"`, "-y", d.filename)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
+	d.log(LevelDebug, "running ffmpeg", Field{"args", strings.Join(cmd.Args[1:], " ")})
 	if err := cmd.Run(); err != nil {
+		d.logOutput(LevelError, "ffmpeg", stderr.String())
 		return fmt.Errorf("running command: " + stderr.String())
 	}
+	d.logOutput(LevelDebug, "ffmpeg", stderr.String())
 	return nil
 }
 
-// Download downloads the supplied stream url and subtitles.
-// If the subtitle url is empty, Download will ignore the subtitles
-func (d *Downloader) Download(output, stream, subs, format string) error {
-	os.Mkdir(tempStorage, os.ModePerm)
-	defer d.Close()
-
-	maplaylist, err := m3u8.DecodeURL(stream)
-	if err != nil {
-		return fmt.Errorf("decoding m3u8 playlist to url: %w", err)
-	}
-
-	if typ := maplaylist.Type(); typ == m3u8.TypeMedia {
-		if err := d.downloadMediaPlaylist(maplaylist.(*m3u8.MediaPlaylist), output, subs, format); err != nil {
-			return fmt.Errorf("downloading media segment (1): %w", err)
-		}
-	}
-
-	master := maplaylist.(*m3u8.MasterPlaylist)
+// selectVariant picks the variant of the master playlist matching the quality
+func (d *Downloader) selectVariant(master *m3u8.MasterPlaylist) (*m3u8.Variant, error) {
 	variants := master.Variants
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("master playlist has no variants")
+	}
 	sort.SliceStable(variants, func(i, j int) bool { return variants[i].Resolution.Height < variants[j].Resolution.Height })
 
 	var best *m3u8.Variant
@@ -213,9 +307,9 @@ func (d *Downloader) Download(output, stream, subs, format string) error {
 	default:
 		split := strings.Split(d.quality, "x")
 		if width, err := strconv.ParseInt(split[0], 10, 64); err == nil {
-			for _, vars := range variants {
-				if vars.Resolution.Width == width {
-					best = &vars
+			for i := range variants {
+				if variants[i].Resolution.Width == width {
+					best = &variants[i]
 					break
 				}
 			}
@@ -223,27 +317,68 @@ func (d *Downloader) Download(output, stream, subs, format string) error {
 	}
 
 	if best == nil {
-		return fmt.Errorf("no good string found for quality %q", d.quality)
+		return nil, fmt.Errorf("no good string found for quality %q", d.quality)
+	}
+	return best, nil
+}
+
+// mediaPlaylist decodes the playlist at stream, and if it is a master playlist
+// picks a variant by quality and decodes it. It returns the media playlist
+// along with its URL, which relative URIs in the playlist are resolved against
+func (d *Downloader) mediaPlaylist(stream string) (*m3u8.MediaPlaylist, string, error) {
+	maplaylist, err := d.decodeURL(context.Background(), stream)
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding m3u8 playlist to url: %w", err)
+	}
+
+	if typ := maplaylist.Type(); typ == m3u8.TypeMedia {
+		return maplaylist.(*m3u8.MediaPlaylist), stream, nil
+	}
+
+	best, err := d.selectVariant(maplaylist.(*m3u8.MasterPlaylist))
+	if err != nil {
+		return nil, "", err
 	}
 
-	meplaylist, err := m3u8.DecodeURL(best.URI)
+	mediaURL := d.resolve(stream, best.URI)
+	meplaylist, err := d.decodeURL(context.Background(), mediaURL)
 	if err != nil {
-		return fmt.Errorf("getting media playlist from master: %w", err)
+		return nil, "", fmt.Errorf("getting media playlist from master: %w", err)
 	}
 
 	if typ := meplaylist.Type(); typ != m3u8.TypeMedia {
-		return fmt.Errorf("got master playlist from master playlist url (?)")
+		return nil, "", fmt.Errorf("got master playlist from master playlist url (?)")
+	}
+	return meplaylist.(*m3u8.MediaPlaylist), mediaURL, nil
+}
+
+// Download downloads the supplied stream url and subtitles.
+// If the subtitle url is empty, Download will ignore the subtitles
+func (d *Downloader) Download(output, stream, subs, format string) error {
+	if err := os.MkdirAll(tempStorage, os.ModePerm); err != nil {
+		return fmt.Errorf("creating temporary directory: %w", err)
+	}
+
+	media, mediaURL, err := d.mediaPlaylist(stream)
+	if err != nil {
+		return err
+	}
+
+	var trim []string
+	if d.clip != nil {
+		if media, trim, err = d.clip.apply(media); err != nil {
+			return fmt.Errorf("clipping media playlist: %w", err)
+		}
 	}
 
-	media := meplaylist.(*m3u8.MediaPlaylist)
-	if err := d.downloadMediaPlaylist(media, output, subs, format); err != nil {
-		return fmt.Errorf("downloading media segment (2): %w", err)
+	if err := d.downloadMediaPlaylist(d.jobs(media, mediaURL), output, subs, format, trim); err != nil {
+		return fmt.Errorf("downloading media playlist: %w", err)
 	}
 	return nil
 }
 
-// Close performs any cleanup necessary after the mpd download completes. This
-// is called internally by Download, so it is not typically necessary to call
+// Close removes the directory used for temporary files. Download removes
+// the files it creates when it returns, so it is not typically necessary to call
 func (d *Downloader) Close() {
 	os.RemoveAll(tempStorage)
 }
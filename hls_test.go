@@ -0,0 +1,1359 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// testStream serves a media playlist of numbered segments
+// whose contents are the segment number as text
+type testStream struct {
+	segments int
+	key      []byte // encrypts segments with AES-128 if set
+	iv       []byte // uses the media sequence if not set
+
+	lock     sync.Mutex
+	requests map[string]int
+	inFlight int
+	maxIn    int
+
+	// handle can fail or delay a request, returning true if it wrote a response
+	handle func(w http.ResponseWriter, r *http.Request, attempt int) bool
+}
+
+func segmentData(i int) []byte {
+	return []byte(fmt.Sprintf("<segment %d>", i))
+}
+
+func (s *testStream) expected() []byte {
+	var b bytes.Buffer
+	for i := 0; i < s.segments; i++ {
+		b.Write(segmentData(i))
+	}
+	return b.Bytes()
+}
+
+func (s *testStream) count(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[path]
+}
+
+func (s *testStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	if s.requests == nil {
+		s.requests = make(map[string]int)
+	}
+	s.requests[r.URL.Path]++
+	attempt := s.requests[r.URL.Path]
+	if s.inFlight++; s.inFlight > s.maxIn {
+		s.maxIn = s.inFlight
+	}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.inFlight--
+		s.lock.Unlock()
+	}()
+
+	if s.handle != nil && s.handle(w, r, attempt) {
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/media.m3u8":
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n")
+		if s.key != nil {
+			fmt.Fprint(w, `#EXT-X-KEY:METHOD=AES-128,URI="key.bin"`)
+			if s.iv != nil {
+				fmt.Fprintf(w, ",IV=0x%X", s.iv)
+			}
+			fmt.Fprint(w, "\n")
+		}
+
+		for i := 0; i < s.segments; i++ {
+			fmt.Fprintf(w, "#EXTINF:2,\nseg/%d.ts\n", i)
+		}
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	case r.URL.Path == "/key.bin":
+		w.Write(s.key)
+	case strings.HasPrefix(r.URL.Path, "/seg/"):
+		index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/seg/"), ".ts"))
+		if err != nil || index >= s.segments {
+			http.NotFound(w, r)
+			return
+		}
+
+		data := segmentData(index)
+		if s.key != nil {
+			data = encryptSegment(s.key, s.iv, int64(index), data)
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func encryptSegment(key, iv []byte, sequence int64, data []byte) []byte {
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	block, _ := aes.NewCipher(key)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+	return out
+}
+
+func newTestDownloader(server *httptest.Server, threads int) (*Downloader, string) {
+	d := New(server.Client(), "best", threads)
+	d.SetRetries(3, time.Millisecond)
+	return d, server.URL + "/media.m3u8"
+}
+
+func TestDownloadToOrder(t *testing.T) {
+	stream := &testStream{
+		segments: 100,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			// Make later segments finish before earlier ones
+			if strings.HasPrefix(r.URL.Path, "/seg/") {
+				time.Sleep(time.Duration(len(r.URL.Path)%3) * time.Millisecond)
+			}
+			return false
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 8)
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), stream.expected()) {
+		t.Errorf("segments written out of order:\n%s", out.String())
+	}
+}
+
+func TestDownloadToRetry(t *testing.T) {
+	stream := &testStream{
+		segments: 10,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if r.URL.Path == "/seg/3.ts" && attempt < 3 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return true
+			}
+			return false
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 4)
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), stream.expected()) {
+		t.Errorf("unexpected output after retries:\n%s", out.String())
+	}
+
+	if count := stream.count("/seg/3.ts"); count != 3 {
+		t.Errorf("expected segment 3 to be requested 3 times, got %d", count)
+	}
+}
+
+func TestDownloadToFirstError(t *testing.T) {
+	stream := &testStream{
+		segments: 50,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if r.URL.Path == "/seg/5.ts" {
+				http.NotFound(w, r)
+				return true
+			}
+			return false
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 4)
+	var out bytes.Buffer
+	err := d.DownloadTo(&out, uri)
+	if err == nil {
+		t.Fatal("expected an error for a missing segment")
+	}
+
+	if !strings.Contains(err.Error(), "segment 5") {
+		t.Errorf("expected error for segment 5, got: %v", err)
+	}
+
+	if count := stream.count("/seg/5.ts"); count != 3 {
+		t.Errorf("expected segment 5 to be attempted 3 times, got %d", count)
+	}
+
+	var expected bytes.Buffer
+	for i := 0; i < 5; i++ {
+		expected.Write(segmentData(i))
+	}
+
+	if !bytes.Equal(out.Bytes(), expected.Bytes()) {
+		t.Errorf("expected only the segments before the failure to be written, got:\n%s", out.String())
+	}
+}
+
+func TestDownloadToBufferSize(t *testing.T) {
+	stream := &testStream{
+		segments: 30,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			time.Sleep(time.Millisecond)
+			return false
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 8)
+	d.SetBufferSize(2)
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if stream.maxIn > 2 {
+		t.Errorf("expected at most 2 requests in flight, got %d", stream.maxIn)
+	}
+}
+
+func TestDownloadToDecrypt(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	for _, iv := range [][]byte{nil, []byte("fedcba9876543210")} {
+		stream := &testStream{segments: 20, key: key, iv: iv}
+		server := httptest.NewServer(stream)
+		defer server.Close()
+
+		d, uri := newTestDownloader(server, 4)
+
+		// Download twice to make sure the key is only requested once
+		for i := 0; i < 2; i++ {
+			var out bytes.Buffer
+			if err := d.DownloadTo(&out, uri); err != nil {
+				t.Fatalf("downloading with iv %q: %v", iv, err)
+			}
+
+			if !bytes.Equal(out.Bytes(), stream.expected()) {
+				t.Errorf("unexpected decrypted output with iv %q:\n%q", iv, out.String())
+			}
+		}
+
+		if count := stream.count("/key.bin"); count != 1 {
+			t.Errorf("expected key to be requested once, got %d", count)
+		}
+	}
+}
+
+func TestDownloadToKeyProvider(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	stream := &testStream{segments: 5, key: key}
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 2)
+	d.SetKeyProvider(StaticKeys{"key.bin": key})
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), stream.expected()) {
+		t.Errorf("unexpected decrypted output:\n%q", out.String())
+	}
+
+	if count := stream.count("/key.bin"); count != 0 {
+		t.Errorf("expected key server not to be used, got %d requests", count)
+	}
+}
+
+func TestLoadKeyConcurrent(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		calls   = make(map[string]int)
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	d := New(http.DefaultClient, "best", 1)
+	d.SetKeyProvider(KeyProviderFunc(func(key *m3u8.Key, _ string) ([]byte, error) {
+		lock.Lock()
+		calls[key.URI]++
+		first := calls[key.URI] == 1
+		lock.Unlock()
+
+		if key.URI == "fail.bin" && first {
+			return nil, fmt.Errorf("key server unavailable")
+		}
+
+		// The slow key is only released once the fast one has loaded
+		if key.URI == "slow.bin" {
+			close(started)
+			<-release
+		}
+		return []byte("0123456789abcdef"), nil
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.LoadKey(context.Background(), &m3u8.Key{Method: m3u8.CryptAES, URI: "slow.bin"}, "https://example.com/media.m3u8"); err != nil {
+				t.Errorf("loading slow key: %v", err)
+			}
+		}()
+	}
+
+	<-started
+	done := make(chan error)
+	go func() {
+		_, err := d.LoadKey(context.Background(), &m3u8.Key{Method: m3u8.CryptAES, URI: "fast.bin"}, "https://example.com/media.m3u8")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("loading fast key: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("loading one key waited for another")
+	}
+	close(release)
+	wg.Wait()
+
+	failing := &m3u8.Key{Method: m3u8.CryptAES, URI: "fail.bin"}
+	if _, err := d.LoadKey(context.Background(), failing, "https://example.com/media.m3u8"); err == nil {
+		t.Errorf("expected the first load of the failing key to fail")
+	}
+
+	if _, err := d.LoadKey(context.Background(), failing, "https://example.com/media.m3u8"); err != nil {
+		t.Errorf("failed key was not loaded again: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if calls["slow.bin"] != 1 {
+		t.Errorf("expected the slow key to be provided once, got %v", calls)
+	}
+}
+
+func TestLoadKeyFormat(t *testing.T) {
+	d := New(http.DefaultClient, "best", 1)
+	d.SetKeyProvider(KeyProviderFunc(func(key *m3u8.Key, _ string) ([]byte, error) {
+		return []byte(fmt.Sprintf("%-16s", key.KeyFormat)), nil
+	}))
+
+	// The same URI is cached separately for every KEYFORMAT
+	for _, format := range []string{"", "identity", "com.example"} {
+		value, err := d.LoadKey(context.Background(), &m3u8.Key{Method: m3u8.CryptAES, URI: "key.bin", KeyFormat: format}, "https://example.com/media.m3u8")
+		if err != nil || string(value) != fmt.Sprintf("%-16s", format) {
+			t.Errorf("key with format %q loaded %q: %v", format, value, err)
+		}
+	}
+
+	// The default KeyProvider requests the key with the context given
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789abcdef"))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	d = New(http.DefaultClient, "best", 1)
+	key := &m3u8.Key{Method: m3u8.CryptAES, URI: server.URL + "/key.bin"}
+	if _, err := d.LoadKey(ctx, key, ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("loading a key with a cancelled context returned %v", err)
+	}
+
+	if _, err := d.LoadKey(context.Background(), key, ""); err != nil {
+		t.Errorf("loading key: %v", err)
+	}
+}
+
+func TestDownloadToProgress(t *testing.T) {
+	stream := &testStream{segments: 25}
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 4)
+
+	var calls []int
+	d.SetProgressFunc(func(done, total int) error {
+		if total != 25 {
+			t.Errorf("expected total of 25, got %d", total)
+		}
+		calls = append(calls, done)
+		return nil
+	})
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if len(calls) != 25 {
+		t.Fatalf("expected 25 progress calls, got %d", len(calls))
+	}
+
+	for i, done := range calls {
+		if done != i+1 {
+			t.Errorf("expected progress call %d to be %d, got %d", i, i+1, done)
+		}
+	}
+}
+
+func TestDownloadToRequestHooks(t *testing.T) {
+	stream := &testStream{
+		segments: 5,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if r.Header.Get("Referer") != "https://example.com/" {
+				http.Error(w, "missing referer", http.StatusBadRequest)
+				return true
+			}
+
+			if r.URL.Query().Get("token") != "2" {
+				http.Error(w, "expired token", http.StatusForbidden)
+				return true
+			}
+			return false
+		},
+	}
+
+	var fetches int
+	tokens := NewTokenRefresher(func() (url.Values, error) {
+		fetches++
+		return url.Values{"token": {strconv.Itoa(fetches)}}, nil
+	})
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 1)
+	d.AddRequestHook(StaticHeaders(http.Header{"Referer": {"https://example.com/"}}))
+	d.UseTokenRefresher(tokens)
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), stream.expected()) {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	if fetches != 2 {
+		t.Errorf("expected token to be fetched twice, got %d", fetches)
+	}
+}
+
+func TestDownloadToRefreshOnce(t *testing.T) {
+	stream := &testStream{
+		segments: 8,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			// Segments are forbidden until the token is refreshed once
+			if r.URL.Path != "/media.m3u8" && r.URL.Query().Get("token") != "2" {
+				time.Sleep(20 * time.Millisecond)
+				http.Error(w, "expired token", http.StatusForbidden)
+				return true
+			}
+			return false
+		},
+	}
+
+	var fetches int
+	tokens := NewTokenRefresher(func() (url.Values, error) {
+		fetches++
+		return url.Values{"token": {strconv.Itoa(fetches)}}, nil
+	})
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	// Every thread is forbidden at once, but only one of them refreshes
+	d, uri := newTestDownloader(server, 4)
+	d.UseTokenRefresher(tokens)
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), stream.expected()) {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	if fetches != 2 {
+		t.Errorf("expected token to be fetched twice, got %d", fetches)
+	}
+}
+
+func TestLimiterAdjust(t *testing.T) {
+	l := newLimiter(2, 6, func(Level, string, ...Field) {})
+
+	// Improving throughput grows the limit up to the maximum
+	for rate := 100.0; l.limit < 6; rate *= 2 {
+		before := l.limit
+		l.update(rate, 10*time.Millisecond)
+		if l.limit != before+1 {
+			t.Fatalf("expected limit to grow from %d, got %d", before, l.limit)
+		}
+	}
+
+	l.update(1e9, 10*time.Millisecond)
+	if l.limit != 6 {
+		t.Errorf("expected limit to stay at the maximum, got %d", l.limit)
+	}
+
+	// Flat throughput with rising latency backs off by one
+	l.update(1e9, 50*time.Millisecond)
+	if l.limit != 5 {
+		t.Errorf("expected limit to drop to 5 after latency increase, got %d", l.limit)
+	}
+
+	// Throttled responses halve the limit, but not past the minimum
+	l.active = 1
+	l.release(0, time.Millisecond, &StatusError{Code: http.StatusTooManyRequests})
+	if l.limit != 2 {
+		t.Errorf("expected limit to drop to 2 after throttling, got %d", l.limit)
+	}
+
+	l.active = 1
+	l.release(0, time.Millisecond, &StatusError{Code: http.StatusServiceUnavailable})
+	if l.limit != 2 {
+		t.Errorf("expected limit to stay at the minimum, got %d", l.limit)
+	}
+}
+
+func TestDownloadToAdaptive(t *testing.T) {
+	stream := &testStream{
+		segments: 60,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if strings.HasPrefix(r.URL.Path, "/seg/1") && attempt == 1 {
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return true
+			}
+			return false
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 1)
+	d.SetAdaptiveThreads(1, 4)
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), stream.expected()) {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	if stream.maxIn > 4 {
+		t.Errorf("expected at most 4 requests in flight, got %d", stream.maxIn)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(200000)
+	body := &limitedBody{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, 100000))),
+		ctx:        context.Background(),
+		limiter:    limiter,
+	}
+
+	// The bucket starts with a tenth of a second of data, so the
+	// rest of the half second of data has to wait for tokens
+	start := time.Now()
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		t.Fatalf("reading limited body: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected reading to take about 400ms, took %v", elapsed)
+	}
+
+	// A rate of 0 or less does not limit reads
+	for _, rate := range []int64{0, -1} {
+		body := &limitedBody{
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, 1000000))),
+			ctx:        context.Background(),
+			limiter:    NewRateLimiter(rate),
+		}
+
+		start := time.Now()
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			t.Fatalf("reading unlimited body: %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("reading with a rate of %d took %v", rate, elapsed)
+		}
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	// Reading past the burst at 1000 bytes per second waits for 10 seconds
+	limiter := NewRateLimiter(1000)
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.wait(context.Background(), 512+10000)
+	}()
+
+	// Raising the rate wakes the read, which then only waits a few milliseconds
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetRate(10000000)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("waiting for tokens: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("waiting read did not pick up the new rate")
+	}
+}
+
+func TestDownloadToLive(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		reloads int
+	)
+
+	stream := &testStream{
+		segments: 6,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if r.URL.Path != "/media.m3u8" {
+				return false
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			// The playlist slides forward by 3 segments on every reload and ends after the second
+			first := reloads * 3
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+			for i := first; i < first+3 && i < 6; i++ {
+				fmt.Fprintf(w, "#EXTINF:1,\nseg/%d.ts\n", i)
+			}
+
+			if reloads > 0 {
+				fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			}
+			reloads++
+			return true
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 2)
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), stream.expected()) {
+		t.Errorf("unexpected live output:\n%s", out.String())
+	}
+}
+
+func TestMirror(t *testing.T) {
+	stream := &testStream{
+		segments: 4,
+		key:      []byte("0123456789abcdef"),
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			switch r.URL.Path {
+			case "/master.m3u8":
+				fmt.Fprint(w, "#EXTM3U\n")
+				fmt.Fprint(w, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"English\",URI=\"../media.m3u8?token=1\"\n")
+				fmt.Fprint(w, "#EXT-X-STREAM-INF:BANDWIDTH=1000,RESOLUTION=640x360,AUDIO=\"aud\"\nlow/media.m3u8\n")
+				fmt.Fprint(w, "#EXT-X-STREAM-INF:BANDWIDTH=2000,RESOLUTION=1280x720,AUDIO=\"aud\"\nmedia.m3u8\n")
+				return true
+			}
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, "/low")
+			return false
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, _ := newTestDownloader(server, 4)
+	if err := d.Mirror(dir, server.URL+"/master.m3u8", false); err != nil {
+		t.Fatalf("mirroring: %v", err)
+	}
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("reading mirrored file: %v", err)
+		}
+		return string(data)
+	}
+
+	host := strings.Replace(strings.TrimPrefix(server.URL, "http://"), ":", "_", -1)
+	master := read("index.m3u8")
+	for _, want := range []string{"URI=\"" + host + "/media-1.m3u8\"", "\n" + host + "/media.m3u8\n"} {
+		if !strings.Contains(master, want) {
+			t.Errorf("mirrored master playlist is missing %q:\n%s", want, master)
+		}
+	}
+
+	if strings.Contains(master, "low/media.m3u8") {
+		t.Errorf("mirrored master playlist contains the unselected variant:\n%s", master)
+	}
+
+	media := read(host + "/media.m3u8")
+	if !strings.Contains(media, "URI=\"key.bin\"") || !strings.Contains(media, "\nseg/0.ts\n") {
+		t.Errorf("mirrored media playlist does not use relative paths:\n%s", media)
+	}
+
+	if key := read(host + "/key.bin"); key != string(stream.key) {
+		t.Errorf("mirrored key is %q", key)
+	}
+
+	// Segments are mirrored as they were received, so they are still encrypted
+	for i := 0; i < stream.segments; i++ {
+		if data := read(fmt.Sprintf("%s/seg/%d.ts", host, i)); data != string(encryptSegment(stream.key, nil, int64(i), segmentData(i))) {
+			t.Errorf("mirrored segment %d does not match", i)
+		}
+	}
+
+	// The audio rendition only differs from the variant by query, so it is
+	// mirrored separately but shares the key and segments with it
+	if count := stream.count("/seg/0.ts"); count != 1 {
+		t.Errorf("segment was requested %d times", count)
+	}
+}
+
+func TestSegmentCache(t *testing.T) {
+	stream := &testStream{segments: 2}
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, _ := newTestDownloader(server, 1)
+	cache := newSegmentCache(dir)
+	shared, single := resource{uri: server.URL + "/seg/0.ts"}, resource{uri: server.URL + "/seg/1.ts"}
+	for i := 0; i < 3; i++ {
+		cache.count(shared)
+	}
+	cache.count(single)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := cache.fetch(context.Background(), d, shared); err != nil || !bytes.Equal(data, segmentData(0)) {
+				t.Errorf("fetching shared segment: %q, %v", data, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := cache.fetch(context.Background(), d, single); err != nil {
+		t.Fatalf("fetching segment: %v", err)
+	}
+
+	if count := stream.count("/seg/0.ts"); count != 1 {
+		t.Errorf("shared segment was requested %d times", count)
+	}
+
+	// The shared file is removed once every use has read it
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d shared files were left behind", len(files))
+	}
+}
+
+func TestDownloadGroup(t *testing.T) {
+	stream := &testStream{segments: 2}
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, _ := newTestDownloader(server, 1)
+	var calls [][2]int
+	d.SetProgressFunc(func(done, total int) error {
+		calls = append(calls, [2]int{done, total})
+		return nil
+	})
+
+	group := d.newDownloadGroup(newSegmentCache(dir))
+	first, second := group.add(2), group.add(3)
+	shared := resource{uri: server.URL + "/seg/0.ts"}
+	first.count(shared)
+	second.count(shared)
+
+	if data, err := first.fetch(context.Background(), d, shared); err != nil || !bytes.Equal(data, segmentData(0)) {
+		t.Fatalf("fetching shared segment: %q, %v", data, err)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("expected the shared segment to be kept for the second playlist, got %d files", len(files))
+	}
+
+	// A playlist that stops without using the segment gives it up
+	second.close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d shared files were left behind", len(files))
+	}
+
+	// The threads are shared by every playlist of the group
+	if !first.acquire(context.Background()) {
+		t.Fatal("acquiring a free thread failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if second.acquire(ctx) {
+		t.Error("acquired a thread while the only one was in use")
+	}
+
+	first.release()
+	if !second.acquire(context.Background()) {
+		t.Error("acquiring a released thread failed")
+	}
+	second.release()
+
+	first.report(1, 2)
+	second.report(2, 3)
+	if expected := [][2]int{{1, 5}, {3, 5}}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected combined progress %v, got %v", expected, calls)
+	}
+}
+
+func TestDownloadToByteRange(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		ranges []string
+	)
+
+	stream := &testStream{
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			switch r.URL.Path {
+			case "/media.m3u8":
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n")
+				fmt.Fprint(w, "#EXT-X-BYTERANGE:4@2\n#EXTINF:2,\nall.ts\n")
+				fmt.Fprint(w, "#EXT-X-BYTERANGE:3\n#EXTINF:2,\nall.ts\n")
+				fmt.Fprint(w, "#EXT-X-BYTERANGE:2\n#EXTINF:2,\nother.ts\n")
+				fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			case "/all.ts":
+				lock.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				lock.Unlock()
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader("..abcdefg"))
+			case "/other.ts":
+				// A server that ignores Range sends the whole resource
+				fmt.Fprint(w, "xyz")
+			default:
+				return false
+			}
+			return true
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 2)
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	if out.String() != "abcdefgxy" {
+		t.Errorf("unexpected byte range output %q", out.String())
+	}
+
+	// Only the byte range of each segment is requested
+	sort.Strings(ranges)
+	if expected := []string{"bytes=2-5", "bytes=6-8"}; !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected Range headers %q, got %q", expected, ranges)
+	}
+}
+
+func TestDownloadToSkipAds(t *testing.T) {
+	stream := &testStream{
+		segments: 12,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if r.URL.Path != "/media.m3u8" {
+				return false
+			}
+
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:00:00Z\n")
+			for i := 0; i < 12; i++ {
+				uri := fmt.Sprintf("seg/%d.ts", i)
+				switch i {
+				case 2:
+					fmt.Fprint(w, "#EXT-X-CUE-OUT:4\n")
+				case 4:
+					// The date range is announced a segment before its START-DATE
+					fmt.Fprint(w, `#EXT-X-DATERANGE:ID="ad",START-DATE="2020-01-01T00:00:10Z",DURATION=2,SCTE35-OUT=0xFC`+"\n")
+				case 7:
+					fmt.Fprint(w, "#EXT-X-DISCONTINUITY\n")
+					uri += "?ad=1"
+				case 9:
+					fmt.Fprint(w, "#EXT-X-DISCONTINUITY\n")
+				case 10:
+					fmt.Fprint(w, "#EXT-X-CUE-OUT\n")
+				case 11:
+					fmt.Fprint(w, "#EXT-X-CUE-IN\n")
+				}
+				fmt.Fprintf(w, "#EXTINF:2,\n%s\n", uri)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			return true
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 4)
+	ads := NewAdRemover(regexp.MustCompile(`[?&]ad=1`))
+	d.SetAdRemover(ads)
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	var expected bytes.Buffer
+	for _, i := range []int{0, 1, 4, 6, 9, 11} {
+		expected.Write(segmentData(i))
+	}
+
+	if out.String() != expected.String() {
+		t.Errorf("unexpected output without ads %q", out.String())
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaks := []AdBreak{
+		{Start: 4 * time.Second, Duration: 4 * time.Second, Segments: 2, FirstSequence: 2, Date: start.Add(4 * time.Second), Reason: AdCue},
+		{Start: 10 * time.Second, Duration: 2 * time.Second, Segments: 1, FirstSequence: 5, Date: start.Add(10 * time.Second), Reason: AdDateRange},
+		{Start: 14 * time.Second, Duration: 4 * time.Second, Segments: 2, FirstSequence: 7, Date: start.Add(14 * time.Second), Reason: AdPattern},
+		{Start: 20 * time.Second, Duration: 2 * time.Second, Segments: 1, FirstSequence: 10, Date: start.Add(20 * time.Second), Reason: AdCue},
+	}
+
+	if got := ads.Breaks(); !reflect.DeepEqual(got, breaks) {
+		t.Errorf("unexpected ad breaks\n%v\nexpected\n%v", got, breaks)
+	}
+}
+
+func TestDownloadToSkipAdsOpen(t *testing.T) {
+	stream := &testStream{
+		segments: 8,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if r.URL.Path != "/media.m3u8" {
+				return false
+			}
+
+			// Neither break has an in marker or a duration
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:60\n")
+			for i := 0; i < 8; i++ {
+				if i == 1 || i == 7 {
+					fmt.Fprint(w, "#EXT-X-CUE-OUT\n")
+				}
+				fmt.Fprintf(w, "#EXTINF:60,\nseg/%d.ts\n", i)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			return true
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	var warnings []string
+	d, uri := newTestDownloader(server, 1)
+	d.SetAdRemover(NewAdRemover())
+	d.SetLogger(LoggerFunc(func(level Level, msg string, fields ...Field) {
+		if level == LevelWarn {
+			warnings = append(warnings, msg)
+		}
+	}))
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	// The first break ends once it reaches the limit
+	var expected bytes.Buffer
+	for _, i := range []int{0, 6} {
+		expected.Write(segmentData(i))
+	}
+
+	if out.String() != expected.String() {
+		t.Errorf("unexpected output without ads %q", out.String())
+	}
+
+	expectedWarnings := []string{"ad break without a duration did not end, continuing with the content", "ad break did not end before the end of the playlist"}
+	if !reflect.DeepEqual(warnings, expectedWarnings) {
+		t.Errorf("unexpected warnings %q", warnings)
+	}
+}
+
+func TestDownloadToClipTime(t *testing.T) {
+	stream := &testStream{
+		segments: 5,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if r.URL.Path != "/media.m3u8" {
+				return false
+			}
+
+			// The stream was down for 54 seconds before segment 3
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:00:00Z\n")
+			for i := 0; i < 5; i++ {
+				if i == 3 {
+					fmt.Fprint(w, "#EXT-X-DISCONTINUITY\n#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:01:00Z\n")
+				}
+				fmt.Fprintf(w, "#EXTINF:2,\nseg/%d.ts\n", i)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			return true
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 2)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	d.SetClipTime(start.Add(3*time.Second), start.Add(61*time.Second))
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	expected := string(segmentData(1)) + string(segmentData(2)) + string(segmentData(3))
+	if out.String() != expected {
+		t.Errorf("unexpected clipped output %q", out.String())
+	}
+}
+
+func TestDownloadToMap(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+	fragment := func(i int) []byte {
+		// fMP4 boxes can contain the MPEG-TS sync byte G anywhere
+		return []byte(fmt.Sprintf("moof%dGmdat", i))
+	}
+
+	stream := &testStream{
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			switch {
+			case r.URL.Path == "/media.m3u8":
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-VERSION:6\n")
+				fmt.Fprintf(w, "#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\",IV=0x%X\n#EXT-X-MAP:URI=\"init.mp4\"\n", iv)
+				for i := 0; i < 3; i++ {
+					fmt.Fprintf(w, "#EXTINF:2,\nfrag/%d.m4s\n", i)
+				}
+				fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			case r.URL.Path == "/key.bin":
+				w.Write(key)
+			case r.URL.Path == "/init.mp4":
+				w.Write(encryptSegment(key, iv, 0, []byte("ftypGmoov")))
+			case strings.HasPrefix(r.URL.Path, "/frag/"):
+				index, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/frag/"), ".m4s"))
+				w.Write(encryptSegment(key, iv, int64(index), fragment(index)))
+			default:
+				return false
+			}
+			return true
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	d, uri := newTestDownloader(server, 2)
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	expected := "ftypGmoov" + string(fragment(0)) + string(fragment(1)) + string(fragment(2))
+	if out.String() != expected {
+		t.Errorf("unexpected fMP4 output %q, expected %q", out.String(), expected)
+	}
+
+	if count := stream.count("/init.mp4"); count != 1 {
+		t.Errorf("expected the media initialization section to be requested once, got %d", count)
+	}
+}
+
+func TestClipApply(t *testing.T) {
+	playlist, err := m3u8.NewMediaBuilder().
+		SetMediaSequence(10).
+		SetMap(&m3u8.Map{URI: "init.mp4"}).
+		AppendSegment(m3u8.Segment{URI: "0.m4s", Duration: 4}).
+		AppendSegment(m3u8.Segment{URI: "1.m4s", Duration: 4}).
+		AppendSegment(m3u8.Segment{URI: "2.m4s", Duration: 4}).
+		AppendSegment(m3u8.Segment{URI: "3.m4s", Duration: 4}).
+		AppendSegment(m3u8.Segment{URI: "4.m4s", Duration: 4}).
+		End().
+		Build()
+	if err != nil {
+		t.Fatalf("building playlist: %v", err)
+	}
+
+	tests := []struct {
+		start, end time.Duration
+		precise    bool
+		uris       []string
+		args       []string
+	}{
+		{5 * time.Second, 13 * time.Second, true, []string{"1.m4s", "2.m4s", "3.m4s"}, []string{"-ss", "1.000", "-t", "8.000"}},
+		{5 * time.Second, 13 * time.Second, false, []string{"1.m4s", "2.m4s", "3.m4s"}, nil},
+		{8 * time.Second, 0, true, []string{"2.m4s", "3.m4s", "4.m4s"}, []string{"-ss", "0.000"}},
+		{0, 4 * time.Second, true, []string{"0.m4s"}, []string{"-ss", "0.000", "-t", "4.000"}},
+		{3500 * time.Millisecond, 4500 * time.Millisecond, true, []string{"0.m4s", "1.m4s"}, []string{"-ss", "3.500", "-t", "1.000"}},
+	}
+
+	for _, test := range tests {
+		d := New(http.DefaultClient, "best", 1)
+		d.SetClip(test.start, test.end)
+		d.SetPreciseClip(test.precise)
+
+		clipped, args, err := d.clip.apply(playlist)
+		if err != nil {
+			t.Errorf("clipping %v to %v: %v", test.start, test.end, err)
+			continue
+		}
+
+		var uris []string
+		for _, segment := range clipped.Segments {
+			uris = append(uris, segment.URI)
+		}
+
+		if !reflect.DeepEqual(uris, test.uris) || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("clipping %v to %v selected %v with %v, expected %v with %v", test.start, test.end, uris, args, test.uris, test.args)
+		}
+
+		// The media initialization section is carried over to the first segment that is kept
+		if init := clipped.Segments[0].Map; init == nil || init.URI != "init.mp4" {
+			t.Errorf("clipping %v to %v lost the media initialization section", test.start, test.end)
+		}
+
+		if first, _ := strconv.Atoi(strings.TrimSuffix(test.uris[0], ".m4s")); clipped.MediaSequence != int64(10+first) {
+			t.Errorf("clipping %v to %v has media sequence %d", test.start, test.end, clipped.MediaSequence)
+		}
+	}
+
+	if playlist.Segments[1].Map != nil {
+		t.Errorf("clipping changed the original playlist")
+	}
+
+	for _, r := range [][2]time.Duration{{20 * time.Second, 0}, {8 * time.Second, 8 * time.Second}, {8 * time.Second, 4 * time.Second}} {
+		d := New(http.DefaultClient, "best", 1)
+		d.SetClip(r[0], r[1])
+		if _, _, err := d.clip.apply(playlist); err == nil {
+			t.Errorf("clipping %v to %v did not fail", r[0], r[1])
+		}
+	}
+
+	// A live playlist can not be clipped, since its end is not known
+	live := *playlist
+	live.EndList = false
+	d := New(http.DefaultClient, "best", 1)
+	d.SetClip(4*time.Second, 0)
+	if _, _, err := d.clip.apply(&live); err == nil {
+		t.Error("clipping a live playlist did not fail")
+	}
+}
+
+func TestClipApplyByteRange(t *testing.T) {
+	playlist, err := m3u8.NewMediaBuilder().
+		AppendSegment(m3u8.Segment{URI: "all.ts", Duration: 4, ByteRange: 100}).
+		AppendSegment(m3u8.Segment{URI: "all.ts", Duration: 4, ByteRange: 200}).
+		AppendSegment(m3u8.Segment{URI: "all.ts", Duration: 4, ByteRange: 300}).
+		End().
+		Build()
+	if err != nil {
+		t.Fatalf("building playlist: %v", err)
+	}
+
+	d := New(http.DefaultClient, "best", 1)
+	d.SetClip(5*time.Second, 0)
+	clipped, _, err := d.clip.apply(playlist)
+	if err != nil {
+		t.Fatalf("clipping: %v", err)
+	}
+
+	// The first segment that is kept starts where the clipped one before it ended
+	if offsets := clipped.ByteOffsets(); !reflect.DeepEqual(offsets, []int{100, 300}) {
+		t.Errorf("clipped byte ranges start at %v", offsets)
+	}
+
+	if playlist.Segments[1].Offset != 0 {
+		t.Errorf("clipping changed the original playlist")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var b bytes.Buffer
+	logger := NewStdLogger(log.New(&b, "", 0), LevelInfo)
+	logger.Log(LevelDebug, "hidden")
+	logger.Log(LevelWarn, "error downloading segment", Field{"segment", 3}, Field{"uri", "seg/3.ts"})
+	logger.Log(Level(7), "unknown")
+
+	expected := "WARN error downloading segment segment=3 uri=seg/3.ts\nLEVEL(7) unknown\n"
+	if b.String() != expected {
+		t.Errorf("unexpected log output %q", b.String())
+	}
+
+	// Without a logger nothing is written, and external command output is dropped
+	d := New(http.DefaultClient, "best", 1)
+	d.log(LevelError, "nobody is listening")
+	d.logOutput(LevelWarn, "ffmpeg", "ignored")
+
+	type entry struct {
+		level  Level
+		msg    string
+		fields map[string]interface{}
+	}
+
+	var entries []entry
+	d.SetLogger(LoggerFunc(func(level Level, msg string, fields ...Field) {
+		e := entry{level: level, msg: msg, fields: make(map[string]interface{})}
+		for _, field := range fields {
+			e.fields[field.Key] = field.Value
+		}
+		entries = append(entries, e)
+	}))
+
+	d.logOutput(LevelWarn, "ffmpeg", "first line\n\n  second line  \n")
+	if len(entries) != 2 || entries[0].msg != "ffmpeg output" || entries[1].fields["line"] != "second line" {
+		t.Errorf("unexpected command output entries %+v", entries)
+	}
+}
+
+func TestDownloadToLogger(t *testing.T) {
+	stream := &testStream{
+		segments: 2,
+		handle: func(w http.ResponseWriter, r *http.Request, attempt int) bool {
+			if r.URL.Path == "/seg/1.ts" && attempt == 1 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return true
+			}
+			return false
+		},
+	}
+
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	var (
+		lock     sync.Mutex
+		retries  []map[string]interface{}
+		download int
+	)
+
+	d, uri := newTestDownloader(server, 1)
+	d.SetLogger(LoggerFunc(func(level Level, msg string, fields ...Field) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		values := make(map[string]interface{})
+		for _, field := range fields {
+			values[field.Key] = field.Value
+		}
+
+		switch {
+		case level == LevelWarn && msg == "error downloading segment":
+			retries = append(retries, values)
+		case level == LevelDebug && msg == "downloaded segment":
+			if _, ok := values["bytes"]; !ok {
+				t.Errorf("downloaded segment has no bytes field: %v", values)
+			}
+			if _, ok := values["duration"]; !ok {
+				t.Errorf("downloaded segment has no duration field: %v", values)
+			}
+			download++
+		}
+	}))
+
+	var out bytes.Buffer
+	if err := d.DownloadTo(&out, uri); err != nil {
+		t.Fatalf("downloading: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(retries) != 1 || retries[0]["segment"] != 1 || retries[0]["uri"] != "seg/1.ts" || retries[0]["attempt"] != 1 || retries[0]["error"] == nil {
+		t.Errorf("unexpected retry log entries %v", retries)
+	}
+
+	if download != 2 {
+		t.Errorf("expected 2 downloaded segment entries, got %d", download)
+	}
+}
@@ -0,0 +1,191 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// KeyProvider supplies the value of the keys used to decrypt
+// segments. playlistURL is the URL of the media playlist the key
+// was found in, which can be used to resolve relative key URIs.
+// The KEYFORMAT of the key is available in key.KeyFormat
+type KeyProvider interface {
+	Key(key *m3u8.Key, playlistURL string) ([]byte, error)
+}
+
+// KeyProviderFunc is an adapter to allow the use
+// of ordinary functions as a KeyProvider
+type KeyProviderFunc func(key *m3u8.Key, playlistURL string) ([]byte, error)
+
+// Key calls f(key, playlistURL)
+func (f KeyProviderFunc) Key(key *m3u8.Key, playlistURL string) ([]byte, error) {
+	return f(key, playlistURL)
+}
+
+// StaticKeys is a KeyProvider that returns key
+// values from a map indexed by the key URI
+type StaticKeys map[string][]byte
+
+// Key returns the value stored for the key URI
+func (s StaticKeys) Key(key *m3u8.Key, _ string) ([]byte, error) {
+	value, exists := s[key.URI]
+	if !exists {
+		return nil, fmt.Errorf("no static key for uri %q", key.URI)
+	}
+	return value, nil
+}
+
+// KeyDir is a KeyProvider that reads key values from a local
+// directory, using the last element of the key URI path as
+// the file name. This works for skd:// and other URI schemes
+// that cannot be fetched over HTTP
+type KeyDir string
+
+// Key reads the key file from the directory
+func (k KeyDir) Key(key *m3u8.Key, _ string) ([]byte, error) {
+	name := key.URI
+	if u, err := url.Parse(key.URI); err == nil {
+		if u.Opaque != "" {
+			name = u.Opaque
+		} else if u.Path != "" {
+			name = u.Path
+		} else {
+			name = u.Host
+		}
+	}
+
+	name = path.Base(name)
+	if name == "." || name == "/" || name == ".." {
+		return nil, fmt.Errorf("cannot make key file name from uri %q", key.URI)
+	}
+
+	value, err := ioutil.ReadFile(filepath.Join(string(k), name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no key file for uri %q", key.URI)
+		}
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	return value, nil
+}
+
+// fetchKey is the default KeyProvider, which requests the
+// key URI with the client and request hooks of the downloader
+func (d *Downloader) fetchKey(ctx context.Context, key *m3u8.Key, playlistURL string) ([]byte, error) {
+	resp, err := d.get(ctx, d.resolve(playlistURL, key.URI))
+	if err != nil {
+		return nil, fmt.Errorf("getting key response: %w", err)
+	}
+
+	defer resp.Body.Close()
+	value, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("getting key bytes: %w", err)
+	}
+	return value, nil
+}
+
+// LoadKey returns the value of an AES-128 key using the KeyProvider
+// of the Downloader, resolving its URI against playlistURL. ctx
+// cancels the request made for the key by the default KeyProvider
+func (d *Downloader) LoadKey(ctx context.Context, key *m3u8.Key, playlistURL string) ([]byte, error) {
+	return d.loadKey(ctx, key, playlistURL)
+}
+
+// keyID identifies a key in the cache. The same URI can serve a
+// different value for each KEYFORMAT, so both are part of it
+type keyID struct {
+	uri    string
+	format string
+}
+
+// keyEntry is a key in the cache of the Downloader. done is closed once
+// the key has loaded, so requests for the same key wait for one fetch
+type keyEntry struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// loadKey returns the value for key, consulting the cache before the
+// KeyProvider. The cache is kept for the lifetime of the Downloader so
+// that keys are not fetched again every time a playlist is reloaded.
+// Keys that fail to load are removed so the next request tries again
+func (d *Downloader) loadKey(ctx context.Context, key *m3u8.Key, playlistURL string) ([]byte, error) {
+	if key.Method != m3u8.CryptAES {
+		return nil, fmt.Errorf("unsupported key method %q", key.Method)
+	}
+
+	uri := d.resolve(playlistURL, key.URI)
+	id := keyID{uri: uri, format: key.KeyFormat}
+	for {
+		d.keyLock.Lock()
+		entry, exists := d.keyCache[id]
+		if !exists {
+			break
+		}
+		d.keyLock.Unlock()
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// A fetch cancelled by the context of another download is tried again with this one
+		if entry.err != nil && ctx.Err() == nil && (errors.Is(entry.err, context.Canceled) || errors.Is(entry.err, context.DeadlineExceeded)) {
+			continue
+		}
+
+		if entry.err == nil {
+			d.log(LevelDebug, "using cached key", Field{"uri", uri})
+		}
+		return entry.value, entry.err
+	}
+
+	if d.keyCache == nil {
+		d.keyCache = make(map[keyID]*keyEntry)
+	}
+	entry := &keyEntry{done: make(chan struct{})}
+	d.keyCache[id] = entry
+	d.keyLock.Unlock()
+
+	entry.value, entry.err = d.provideKey(ctx, key, playlistURL, uri)
+	if entry.err != nil {
+		d.keyLock.Lock()
+		delete(d.keyCache, id)
+		d.keyLock.Unlock()
+	}
+	close(entry.done)
+	return entry.value, entry.err
+}
+
+// provideKey gets the value of the key from the KeyProvider
+func (d *Downloader) provideKey(ctx context.Context, key *m3u8.Key, playlistURL, uri string) ([]byte, error) {
+	var provider KeyProvider = KeyProviderFunc(func(key *m3u8.Key, playlistURL string) ([]byte, error) {
+		return d.fetchKey(ctx, key, playlistURL)
+	})
+	if d.keys != nil {
+		provider = d.keys
+	}
+
+	value, err := provider.Key(key, playlistURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(value) != 16 {
+		return nil, fmt.Errorf("key for uri %q is %d bytes, expected 16", uri, len(value))
+	}
+
+	d.log(LevelDebug, "loaded key", Field{"uri", uri}, Field{"format", key.KeyFormat})
+	return value, nil
+}
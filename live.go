@@ -0,0 +1,142 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// SetLiveDuration sets the maximum duration of a live stream to record.
+// Playlists without EXT-X-ENDLIST are reloaded and recorded until they
+// end, or until this much has been queued. 0 records until the stream ends
+func (d *Downloader) SetLiveDuration(max time.Duration) {
+	d.liveDuration = max
+}
+
+// jobs returns the producer for the segments of the playlist,
+// following the playlist as it is reloaded if it is live and
+// skipping ad breaks if an AdRemover is set
+func (d *Downloader) jobs(playlist *m3u8.MediaPlaylist, playlistURL string) producer {
+	if playlist.EndList {
+		return d.skipAds(d.playlistJobs(playlist, playlistURL))
+	}
+	return d.skipAds(d.liveJobs(playlist, playlistURL))
+}
+
+func (d *Downloader) liveJobs(playlist *m3u8.MediaPlaylist, playlistURL string) producer {
+	return func(ctx context.Context, queue func(job) bool) error {
+		var (
+			index    int
+			next     = playlist.MediaSequence
+			recorded time.Duration
+			written  *m3u8.Map // the last media initialization section queued to be written
+			failures int
+		)
+
+		for {
+			if err := d.loadKeys(ctx, playlist, playlistURL); err != nil {
+				return err
+			}
+
+			var (
+				added   int
+				init    *m3u8.Map
+				initKey *m3u8.Key
+			)
+
+			offsets := playlist.ByteOffsets()
+			for i, segment := range playlist.Segments {
+				var key *m3u8.Key
+				if segment.KeyIndex != -1 {
+					key = playlist.Keys[segment.KeyIndex]
+				}
+
+				// The media initialization section can be declared before segments that were already queued
+				if segment.Map != nil {
+					init, initKey = segment.Map, key
+				}
+
+				sequence := playlist.MediaSequence + int64(i)
+				if sequence < next {
+					continue
+				}
+
+				if d.liveDuration > 0 && recorded >= d.liveDuration {
+					d.log(LevelInfo, "finished recording live stream", Field{"duration", recorded})
+					return nil
+				}
+
+				// Every reload starts with the media initialization section, but it
+				// only needs to be written again if it changed since the last one
+				if changed := init != nil && !sameMap(init, written); changed != (segment.Map != nil) {
+					copied := *segment
+					copied.Map = nil
+					if changed {
+						copied.Map = init
+					}
+					segment = &copied
+				}
+
+				if init != nil {
+					written = init
+				}
+
+				j := job{index: index, segment: segment, key: key, playlistURL: playlistURL, sequence: sequence, offset: offsets[i], total: index + len(playlist.Segments) - i, init: init, initKey: initKey}
+
+				if !queue(j) {
+					return nil
+				}
+
+				index++
+				added++
+				next = sequence + 1
+				recorded += m3u8.Seconds(segment.Duration)
+			}
+
+			if playlist.EndList {
+				return nil
+			}
+
+			// 6.3.4 - Wait at least the target duration before reloading, or
+			// half of it if the last reload did not contain any new segments
+			wait := time.Duration(playlist.TargetDuration) * time.Second
+			if added == 0 {
+				wait /= 2
+			}
+
+			if wait < time.Second {
+				wait = time.Second
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil
+			}
+
+			reloaded, err := d.decodeURL(ctx, playlistURL)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+
+				// Reloads are retried like segments, so a single failed
+				// request does not end a recording that may take hours
+				if failures++; failures >= d.attempts() {
+					return fmt.Errorf("reloading live playlist: %w", err)
+				}
+				d.log(LevelWarn, "error reloading live playlist", Field{"uri", playlistURL}, Field{"attempt", failures}, Field{"error", err})
+				continue
+			}
+			failures = 0
+
+			media, ok := reloaded.(*m3u8.MediaPlaylist)
+			if !ok {
+				return fmt.Errorf("live playlist reloaded as a master playlist")
+			}
+			playlist = media
+		}
+	}
+}
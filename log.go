@@ -0,0 +1,104 @@
+package hls
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// Log levels, from least to most severe
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Field is a key-value pair attached to a log message, such
+// as the segment index, URI, attempt, bytes or duration
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the diagnostic output of the Downloader
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// LoggerFunc is an adapter to allow the use
+// of ordinary functions as a Logger
+type LoggerFunc func(level Level, msg string, fields ...Field)
+
+// Log calls f(level, msg, fields...)
+func (f LoggerFunc) Log(level Level, msg string, fields ...Field) {
+	f(level, msg, fields...)
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	min    Level
+}
+
+// NewStdLogger returns a Logger that writes messages of at least
+// the min level to logger, with fields formatted as key=value
+func NewStdLogger(logger *log.Logger, min Level) Logger {
+	return &stdLogger{logger: logger, min: min}
+}
+
+func (s *stdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < s.min {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, field := range fields {
+		fmt.Fprintf(&b, " %s=%v", field.Key, field.Value)
+	}
+	s.logger.Print(b.String())
+}
+
+// SetLogger sets the Logger that receives diagnostic output such as
+// retries, key loads and ffmpeg errors. By default nothing is logged
+func (d *Downloader) SetLogger(logger Logger) {
+	d.logger = logger
+}
+
+func (d *Downloader) log(level Level, msg string, fields ...Field) {
+	if d.logger != nil {
+		d.logger.Log(level, msg, fields...)
+	}
+}
+
+// logOutput logs every non-empty line of the output of an external command
+func (d *Downloader) logOutput(level Level, command, output string) {
+	if d.logger == nil {
+		return
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			d.logger.Log(level, command+" output", Field{"line", line})
+		}
+	}
+}
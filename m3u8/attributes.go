@@ -0,0 +1,264 @@
+package m3u8
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ValueType is the type an attribute value was written as
+type ValueType int
+
+// Attribute value types, defined in 4.2
+const (
+	ValueInteger     ValueType = iota // decimal-integer
+	ValueHex                          // hexadecimal-sequence
+	ValueFloat                        // decimal-floating-point
+	ValueSignedFloat                  // signed-decimal-floating-point
+	ValueString                       // quoted-string
+	ValueEnum                         // enumerated-string
+	ValueResolution                   // decimal-resolution
+)
+
+var valueTypeNames = [...]string{"decimal-integer", "hexadecimal-sequence", "decimal-floating-point", "signed-decimal-floating-point", "quoted-string", "enumerated-string", "decimal-resolution"}
+
+func (t ValueType) String() string {
+	if t < 0 || int(t) >= len(valueTypeNames) {
+		return fmt.Sprintf("ValueType(%d)", int(t))
+	}
+	return valueTypeNames[t]
+}
+
+// Attribute is a single name and value from an attribute list. Value is the
+// text of the value, without the quotes around a quoted-string
+type Attribute struct {
+	Name  string
+	Type  ValueType
+	Value string
+}
+
+func (a Attribute) typeError(expected string) error {
+	return fmt.Errorf("%s is a %s, expected %s", a.Name, a.Type, expected)
+}
+
+// Quoted returns the value of a quoted-string
+func (a Attribute) Quoted() (string, error) {
+	if a.Type != ValueString {
+		return "", a.typeError("a quoted-string")
+	}
+	return a.Value, nil
+}
+
+// Enum returns the value of an enumerated-string
+func (a Attribute) Enum() (string, error) {
+	if a.Type != ValueEnum {
+		return "", a.typeError("an enumerated-string")
+	}
+	return a.Value, nil
+}
+
+// Integer returns the value of a decimal-integer
+func (a Attribute) Integer() (int64, error) {
+	if a.Type != ValueInteger {
+		return 0, a.typeError("a decimal-integer")
+	}
+
+	value, err := strconv.ParseInt(a.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", a.Name, err)
+	}
+	return value, nil
+}
+
+// Float returns the value of a decimal-floating-point or signed-decimal-floating-point.
+// Integers are accepted too, since a float without a fractional part looks the same
+func (a Attribute) Float() (float64, error) {
+	if a.Type != ValueFloat && a.Type != ValueSignedFloat && a.Type != ValueInteger {
+		return 0, a.typeError("a decimal-floating-point")
+	}
+
+	value, err := strconv.ParseFloat(a.Value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", a.Name, err)
+	}
+	return value, nil
+}
+
+func (a Attribute) float32() (float32, error) {
+	value, err := a.Float()
+	return float32(value), err
+}
+
+// Hex returns the bytes of a hexadecimal-sequence. An odd number of digits is
+// treated as if it had a leading zero
+func (a Attribute) Hex() ([]byte, error) {
+	if a.Type != ValueHex {
+		return nil, a.typeError("a hexadecimal-sequence")
+	}
+
+	digits := a.Value[2:]
+	if len(digits)%2 != 0 {
+		digits = "0" + digits
+	}
+
+	value, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", a.Name, err)
+	}
+	return value, nil
+}
+
+// Resolution returns the value of a decimal-resolution
+func (a Attribute) Resolution() (Resolution, error) {
+	if a.Type != ValueResolution {
+		return Resolution{}, a.typeError("a decimal-resolution")
+	}
+
+	x := strings.IndexByte(a.Value, 'x')
+	width, err := strconv.ParseInt(a.Value[:x], 10, 64)
+	if err == nil {
+		var height int64
+		if height, err = strconv.ParseInt(a.Value[x+1:], 10, 64); err == nil {
+			return Resolution{Width: width, Height: height}, nil
+		}
+	}
+	return Resolution{}, fmt.Errorf("parsing %s: %w", a.Name, err)
+}
+
+// ParseAttributes splits an attribute list into its attributes, in the order
+// they appear, as defined in 4.2. Quoted strings can contain commas and equals
+// signs, and everything else is typed by the characters it contains
+func ParseAttributes(line string) ([]Attribute, error) {
+	var attributes []Attribute
+	for i := 0; i < len(line); {
+		// Whitespace is not allowed, but is common after commas
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+
+		start := i
+		for i < len(line) && isNameChar(line[i]) {
+			i++
+		}
+
+		if i == start {
+			return nil, fmt.Errorf("expected attribute name at offset %d of %q", start, line)
+		}
+
+		if i == len(line) || line[i] != '=' {
+			return nil, fmt.Errorf("attribute %s has no value", line[start:i])
+		}
+
+		attr := Attribute{Name: line[start:i]}
+		i++
+
+		if i < len(line) && line[i] == '"' {
+			end := strings.IndexByte(line[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("attribute %s has an unterminated quoted-string", attr.Name)
+			}
+
+			attr.Type, attr.Value = ValueString, line[i+1:i+1+end]
+			if strings.ContainsAny(attr.Value, "\r\n") {
+				return nil, fmt.Errorf("attribute %s contains a line break", attr.Name)
+			}
+			i += end + 2
+		} else {
+			end := strings.IndexByte(line[i:], ',')
+			if end == -1 {
+				end = len(line) - i
+			}
+
+			attr.Value = line[i : i+end]
+			var ok bool
+			if attr.Type, ok = valueType(attr.Value); !ok {
+				return nil, fmt.Errorf("attribute %s has invalid value %q", attr.Name, attr.Value)
+			}
+			i += end
+		}
+
+		if i < len(line) {
+			if line[i] != ',' {
+				return nil, fmt.Errorf("expected comma after attribute %s", attr.Name)
+			}
+
+			if i++; i == len(line) {
+				return nil, fmt.Errorf("attribute list ends with a comma")
+			}
+		}
+		attributes = append(attributes, attr)
+	}
+	return attributes, nil
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// valueType returns the type of an unquoted value
+func valueType(value string) (ValueType, bool) {
+	if len(value) > 2 && value[0] == '0' && (value[1] == 'x' || value[1] == 'X') {
+		isHex := true
+		for i := 2; i < len(value) && isHex; i++ {
+			c := value[i]
+			isHex = c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+		}
+
+		if isHex {
+			return ValueHex, true
+		}
+	}
+
+	if isDigits(value) {
+		return ValueInteger, true
+	}
+
+	if x := strings.IndexByte(value, 'x'); x != -1 && isDigits(value[:x]) && isDigits(value[x+1:]) {
+		return ValueResolution, true
+	}
+
+	unsigned, typ := value, ValueFloat
+	if strings.HasPrefix(value, "-") {
+		unsigned, typ = value[1:], ValueSignedFloat
+	}
+
+	if dot := strings.IndexByte(unsigned, '.'); dot != -1 && isDigits(unsigned[:dot]) && isDigits(unsigned[dot+1:]) {
+		return typ, true
+	} else if typ == ValueSignedFloat && isDigits(unsigned) {
+		return typ, true
+	}
+
+	// An enumerated-string can not contain quotes or whitespace
+	if value == "" || strings.ContainsAny(value, "\" \t\r\n") {
+		return 0, false
+	}
+	return ValueEnum, true
+}
+
+// parseAttributes parses an attribute list into a map by name, since no
+// attribute can appear more than once
+func parseAttributes(line string) (map[string]Attribute, error) { // 4.2
+	list, err := ParseAttributes(line)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := make(map[string]Attribute, len(list))
+	for _, attr := range list {
+		if _, exists := attributes[attr.Name]; exists {
+			return nil, fmt.Errorf("attribute %s appears more than once", attr.Name)
+		}
+		attributes[attr.Name] = attr
+	}
+	return attributes, nil
+}
@@ -0,0 +1,274 @@
+package m3u8
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// MediaBuilder builds a MediaPlaylist one segment at a time. Tags that apply to
+// the next segment, such as SetMap or AddDiscontinuity, are held until it is
+// appended, and KeyIndex is managed from the keys given to SetKey. The first
+// error stops the builder and is returned by Build
+type MediaBuilder struct {
+	playlist MediaPlaylist
+	keyIndex int
+	err      error
+
+	// Pending tags for the next segment
+	discontinuity bool
+	init          *Map
+	dateTime      time.Time
+	dateRanges    []DateRange
+}
+
+// NewMediaBuilder creates a MediaBuilder for an empty playlist
+func NewMediaBuilder() *MediaBuilder {
+	return &MediaBuilder{keyIndex: -1}
+}
+
+func (b *MediaBuilder) fail(format string, args ...interface{}) *MediaBuilder {
+	if b.err == nil {
+		b.err = fmt.Errorf(format, args...)
+	}
+	return b
+}
+
+// SetTargetDuration sets the smallest target duration of the playlist. It is
+// raised in Build if any segment is longer once rounded, as 4.3.3.1 requires
+func (b *MediaBuilder) SetTargetDuration(seconds int64) *MediaBuilder {
+	if seconds < 0 {
+		return b.fail("target duration %d is negative", seconds)
+	}
+	b.playlist.TargetDuration = seconds
+	return b
+}
+
+// SetMediaSequence sets the media sequence number of the first segment
+func (b *MediaBuilder) SetMediaSequence(sequence int64) *MediaBuilder {
+	b.playlist.MediaSequence = sequence
+	return b
+}
+
+// SetDiscontinuitySequence sets the discontinuity sequence number of the first segment
+func (b *MediaBuilder) SetDiscontinuitySequence(sequence int64) *MediaBuilder {
+	b.playlist.DiscontinuitySeq = sequence
+	return b
+}
+
+// SetPlaylistType sets EXT-X-PLAYLIST-TYPE to PlaylistVOD or PlaylistEvent
+func (b *MediaBuilder) SetPlaylistType(typ string) *MediaBuilder {
+	if typ != PlaylistVOD && typ != PlaylistEvent {
+		return b.fail("invalid playlist type %q", typ)
+	}
+	b.playlist.PType = typ
+	return b
+}
+
+// SetIFramesOnly sets whether every segment is a single I-frame
+func (b *MediaBuilder) SetIFramesOnly(iFrames bool) *MediaBuilder {
+	b.playlist.IFramesOnly = iFrames
+	return b
+}
+
+// SetIndependentSegments sets whether every segment can be decoded on its own
+func (b *MediaBuilder) SetIndependentSegments(independent bool) *MediaBuilder {
+	b.playlist.Independent = independent
+	return b
+}
+
+// SetKey sets the key the following segments are encrypted with. A nil key,
+// or one with the method NONE, leaves the following segments unencrypted
+func (b *MediaBuilder) SetKey(key *Key) *MediaBuilder {
+	if key == nil || key.Method == CryptNone {
+		b.keyIndex = -1
+		return b
+	}
+
+	if key.Method != CryptAES && key.Method != CryptSampleAES {
+		return b.fail("invalid key method %q", key.Method)
+	}
+
+	if key.URI == "" {
+		return b.fail("key with method %s requires a URI", key.Method)
+	}
+
+	if key.IV != "" && len(key.IV) != 16 {
+		return b.fail("key IV is %d bytes, expected 16", len(key.IV))
+	}
+
+	// Setting the same key again continues using it
+	for i, existing := range b.playlist.Keys {
+		if existing == key {
+			b.keyIndex = i
+			return b
+		}
+	}
+
+	b.playlist.Keys = append(b.playlist.Keys, key)
+	b.keyIndex = len(b.playlist.Keys) - 1
+	return b
+}
+
+// SetMap sets the media initialization section written before the next segment.
+// It applies to the next segment and every one after it until the next SetMap,
+// but only the next segment has it as its Map, as in a decoded playlist. Use
+// MediaPlaylist.MapAt to get the section that applies to any segment
+func (b *MediaBuilder) SetMap(init *Map) *MediaBuilder {
+	if init == nil || init.URI == "" {
+		return b.fail("media initialization section requires a URI")
+	}
+	b.init = init
+	return b
+}
+
+// AddDiscontinuity adds an EXT-X-DISCONTINUITY before the next segment
+func (b *MediaBuilder) AddDiscontinuity() *MediaBuilder {
+	b.discontinuity = true
+	return b
+}
+
+// SetProgramDateTime sets the date and time of the first sample of the next segment
+func (b *MediaBuilder) SetProgramDateTime(date time.Time) *MediaBuilder {
+	b.dateTime = date
+	return b
+}
+
+// AddDateRange adds an EXT-X-DATERANGE before the next segment
+func (b *MediaBuilder) AddDateRange(dateRange DateRange) *MediaBuilder {
+	// 4.3.2.7 - ID and START-DATE are REQUIRED, and END-DATE can not be before START-DATE
+	if dateRange.ID == "" || dateRange.StartDate.IsZero() {
+		return b.fail("date range requires an ID and START-DATE")
+	}
+
+	if !dateRange.EndDate.IsZero() && dateRange.EndDate.Before(dateRange.StartDate) {
+		return b.fail("date range %q ends before it starts", dateRange.ID)
+	}
+
+	if dateRange.Duration < 0 || dateRange.PlannedDuration < 0 {
+		return b.fail("date range %q has a negative duration", dateRange.ID)
+	}
+
+	if dateRange.EndOnNext && (dateRange.Class == "" || dateRange.Duration != 0 || !dateRange.EndDate.IsZero()) {
+		return b.fail("date range %q with END-ON-NEXT requires a CLASS and no DURATION or END-DATE", dateRange.ID)
+	}
+
+	b.dateRanges = append(b.dateRanges, dateRange)
+	return b
+}
+
+// AppendSegment adds a segment to the end of the playlist with the tags set
+// since the previous one. The URI, Duration, Title, ByteRange, Offset and Tags
+// of the segment are kept, and its KeyIndex is replaced with the current key
+func (b *MediaBuilder) AppendSegment(segment Segment) *MediaBuilder {
+	if b.playlist.EndList {
+		return b.fail("segment %q appended after the end of the playlist", segment.URI)
+	}
+
+	if segment.URI == "" {
+		return b.fail("segment requires a URI")
+	}
+
+	if segment.Duration < 0 {
+		return b.fail("segment %q has a negative duration", segment.URI)
+	}
+
+	segment.KeyIndex = b.keyIndex
+	segment.Discontinuity = segment.Discontinuity || b.discontinuity
+	if b.init != nil {
+		segment.Map = b.init
+	}
+
+	if !b.dateTime.IsZero() {
+		segment.DateTime = b.dateTime
+	}
+	segment.DateRanges = append(segment.DateRanges, b.dateRanges...)
+
+	b.discontinuity, b.init, b.dateTime, b.dateRanges = false, nil, time.Time{}, nil
+	b.playlist.Segments = append(b.playlist.Segments, &segment)
+	return b
+}
+
+// End adds EXT-X-ENDLIST, after which no more segments can be appended
+func (b *MediaBuilder) End() *MediaBuilder {
+	b.playlist.EndList = true
+	return b
+}
+
+// Build returns the playlist, with the target duration raised to fit every
+// segment and the lowest EXT-X-VERSION that supports the tags it uses
+func (b *MediaBuilder) Build() (*MediaPlaylist, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if b.discontinuity || b.init != nil || !b.dateTime.IsZero() || len(b.dateRanges) != 0 {
+		return nil, fmt.Errorf("tags were added after the last segment")
+	}
+
+	playlist := b.playlist
+	playlist.Segments = append([]*Segment(nil), b.playlist.Segments...)
+	playlist.Keys = append([]*Key(nil), b.playlist.Keys...)
+
+	hasDateTime, hasDateRange := false, false
+	for _, segment := range playlist.Segments {
+		// 4.3.3.1 - Every duration rounded to the nearest integer has to be at most the target duration
+		if rounded := int64(math.Round(float64(segment.Duration))); rounded > playlist.TargetDuration {
+			playlist.TargetDuration = rounded
+		}
+
+		hasDateTime = hasDateTime || !segment.DateTime.IsZero()
+		hasDateRange = hasDateRange || len(segment.DateRanges) != 0
+	}
+
+	// 4.3.2.7 - A playlist with EXT-X-DATERANGE has to have at least one EXT-X-PROGRAM-DATE-TIME
+	if hasDateRange && !hasDateTime {
+		return nil, fmt.Errorf("playlists with date ranges require a program date time")
+	}
+
+	playlist.Version = minimumVersion(&playlist)
+	return &playlist, nil
+}
+
+// minimumVersion returns the lowest protocol version of a media playlist, following section 7
+func minimumVersion(m *MediaPlaylist) int {
+	version := 1
+	raise := func(to int) {
+		if to > version {
+			version = to
+		}
+	}
+
+	for _, key := range m.Keys {
+		if key.IV != "" {
+			raise(2)
+		}
+
+		if key.KeyFormat != "" || key.KeyVersions != "" {
+			raise(5)
+		}
+	}
+
+	if m.IFramesOnly {
+		raise(4)
+	}
+
+	for _, segment := range m.Segments {
+		if segment.Duration != float32(math.Trunc(float64(segment.Duration))) {
+			raise(3)
+		}
+
+		if segment.ByteRange != 0 {
+			raise(4)
+		}
+
+		if segment.Map != nil {
+			if m.IFramesOnly {
+				raise(5)
+			} else {
+				raise(6)
+			}
+		}
+	}
+	return version
+}
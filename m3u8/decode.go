@@ -0,0 +1,156 @@
+package m3u8
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxLineLength is the longest line the Decoder accepts
+const maxLineLength = 1 << 20
+
+// lineDecoder decodes the lines of one type of playlist
+type lineDecoder interface {
+	line(line string) error
+	finish() (Playlist, error)
+}
+
+// Decoder reads a playlist in a single pass, one line at a time, so only the
+// parsed playlist is kept in memory rather than every line of it
+type Decoder struct {
+	scanner   *bufio.Scanner
+	onSegment func(*MediaPlaylist, *Segment) error
+}
+
+// NewDecoder creates a Decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	return &Decoder{scanner: scanner}
+}
+
+// OnSegment sets a function that is called with each segment of a media
+// playlist as soon as it is decoded, along with the playlist decoded so far.
+// Segments passed to it are not added to the playlist, and Keys only holds the
+// key of the current segment, whose KeyIndex is then 0 or -1, so memory use
+// does not grow with the number of segments. Returning an error stops decoding
+func (d *Decoder) OnSegment(fn func(playlist *MediaPlaylist, segment *Segment) error) {
+	d.onSegment = fn
+}
+
+// next returns the next line that is not empty
+func (d *Decoder) next() (string, bool) {
+	for d.scanner.Scan() {
+		if text := strings.TrimSpace(d.scanner.Text()); text != "" { // Ignore stupid whitespace
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// Decode reads the playlist, determining its type from the first tag that
+// only appears in one type of playlist
+func (d *Decoder) Decode() (Playlist, error) {
+	if header, _ := d.next(); header != "#EXTM3U" {
+		if err := d.scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading playlist: %w", err)
+		}
+		return nil, fmt.Errorf(`provided reader is not a valid m3u8 file (does not contain header "#EXTM3U")`)
+	}
+
+	// Lines before the type is known are held, which are only the few tags
+	// that can appear in both types of playlist
+	var (
+		decoder lineDecoder
+		isMedia bool
+		held    []string
+	)
+
+	for {
+		line, ok := d.next()
+		if !ok {
+			break
+		}
+
+		if decoder == nil {
+			switch playlistType(line) {
+			case TypeMedia:
+				decoder, isMedia = newMediaDecoder(d.onSegment), true
+			case TypeMaster:
+				decoder = newMasterDecoder()
+			default:
+				held = append(held, line)
+				continue
+			}
+
+			for _, line := range held {
+				if err := decoder.line(line); err != nil {
+					return nil, d.wrap(isMedia, err)
+				}
+			}
+			held = nil
+		}
+
+		if err := decoder.line(line); err != nil {
+			return nil, d.wrap(isMedia, err)
+		}
+	}
+
+	if err := d.scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading playlist: %w", err)
+	}
+
+	// This assumes that all media playlists will have an EXT-X-TARGETDURATION, which is REQUIRED
+	if decoder == nil {
+		decoder = newMasterDecoder()
+		for _, line := range held {
+			if err := decoder.line(line); err != nil {
+				return nil, d.wrap(false, err)
+			}
+		}
+	}
+
+	playlist, err := decoder.finish()
+	if err != nil {
+		return nil, d.wrap(isMedia, err)
+	}
+	return playlist, nil
+}
+
+func (d *Decoder) wrap(isMedia bool, err error) error {
+	if isMedia {
+		return fmt.Errorf("parsing media playlist: %w", err)
+	}
+	return fmt.Errorf("parsing master playlist: %w", err)
+}
+
+// splitTag splits a tag into its name and value, returning false if the line is not a tag
+func splitTag(line string) (name, value string, isTag bool) {
+	if !strings.HasPrefix(line, "#EXT") {
+		return "", "", false
+	}
+
+	if colon := strings.IndexByte(line, ':'); colon != -1 {
+		return line[1:colon], line[colon+1:], true
+	}
+	return line[1:], "", true
+}
+
+// playlistType returns the type of playlist a line can only appear in, or -1 if it can appear in both
+func playlistType(line string) int {
+	name, _, isTag := splitTag(line)
+	if !isTag {
+		return -1
+	}
+
+	switch name {
+	// 4.3.3 - "A Media Playlist tag MUST NOT appear in a Master Playlist."
+	case "EXTINF", "EXT-X-BYTERANGE", "EXT-X-DISCONTINUITY", "EXT-X-KEY", "EXT-X-MAP", "EXT-X-PROGRAM-DATE-TIME", "EXT-X-DATERANGE",
+		"EXT-X-TARGETDURATION", "EXT-X-MEDIA-SEQUENCE", "EXT-X-DISCONTINUITY-SEQUENCE", "EXT-X-ENDLIST", "EXT-X-PLAYLIST-TYPE", "EXT-X-I-FRAMES-ONLY":
+		return TypeMedia
+	case "EXT-X-MEDIA", "EXT-X-STREAM-INF", "EXT-X-I-FRAME-STREAM-INF", "EXT-X-SESSION-DATA", "EXT-X-SESSION-KEY":
+		return TypeMaster
+	}
+	return -1
+}
@@ -0,0 +1,300 @@
+package m3u8
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func formatFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'f', -1, 32)
+}
+
+// attributeList builds an attribute list, skipping empty values
+type attributeList []string
+
+func (a *attributeList) enum(name, value string) {
+	if value != "" {
+		*a = append(*a, name+"="+value)
+	}
+}
+
+func (a *attributeList) quoted(name, value string) {
+	if value != "" {
+		*a = append(*a, name+`="`+value+`"`)
+	}
+}
+
+func (a *attributeList) integer(name string, value int64) {
+	if value != 0 {
+		*a = append(*a, name+"="+strconv.FormatInt(value, 10))
+	}
+}
+
+func (a *attributeList) float(name string, value float32) {
+	if value != 0 {
+		*a = append(*a, name+"="+formatFloat(value))
+	}
+}
+
+func (a *attributeList) resolution(value Resolution) {
+	if value.Width != 0 && value.Height != 0 {
+		*a = append(*a, fmt.Sprintf("RESOLUTION=%dx%d", value.Width, value.Height))
+	}
+}
+
+func (a attributeList) String() string {
+	return strings.Join(a, ",")
+}
+
+func encodeKey(w *bufio.Writer, tag string, key *Key) {
+	var attrs attributeList
+	attrs.enum("METHOD", key.Method)
+	attrs.quoted("URI", key.URI)
+	if key.IV != "" {
+		attrs.enum("IV", "0x"+strings.ToUpper(hex.EncodeToString([]byte(key.IV))))
+	}
+	attrs.quoted("KEYFORMAT", key.KeyFormat)
+	attrs.quoted("KEYFORMATVERSIONS", key.KeyVersions)
+	fmt.Fprintf(w, "#%s:%s\n", tag, attrs)
+}
+
+func encodeDateRange(w *bufio.Writer, dateRange *DateRange) {
+	var attrs attributeList
+	attrs.quoted("ID", dateRange.ID)
+	attrs.quoted("CLASS", dateRange.Class)
+	attrs.quoted("START-DATE", dateRange.StartDate.Format(time.RFC3339Nano))
+	if !dateRange.EndDate.IsZero() {
+		attrs.quoted("END-DATE", dateRange.EndDate.Format(time.RFC3339Nano))
+	}
+
+	attrs.float("DURATION", dateRange.Duration)
+	attrs.float("PLANNED-DURATION", dateRange.PlannedDuration)
+
+	names := make([]string, 0, len(dateRange.ClientAttrs))
+	for name := range dateRange.ClientAttrs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		attrs.enum(name, dateRange.ClientAttrs[name])
+	}
+
+	attrs.enum("SCTE35-CMD", dateRange.SCTE35Cmd)
+	attrs.enum("SCTE35-OUT", dateRange.SCTE35Out)
+	attrs.enum("SCTE35-IN", dateRange.SCTE35In)
+	if dateRange.EndOnNext {
+		attrs.enum("END-ON-NEXT", PreciseYes)
+	}
+	fmt.Fprintf(w, "#EXT-X-DATERANGE:%s\n", attrs)
+}
+
+func encodeTags(w *bufio.Writer, tags []Tag) {
+	for _, tag := range tags {
+		w.WriteString(tag.String())
+		w.WriteByte('\n')
+	}
+}
+
+func encodeStart(w *bufio.Writer, offset float32, precise bool) {
+	if offset == 0 && !precise {
+		return
+	}
+
+	attrs := attributeList{"TIME-OFFSET=" + formatFloat(offset)}
+	if precise {
+		attrs.enum("PRECISE", PreciseYes)
+	}
+	fmt.Fprintf(w, "#EXT-X-START:%s\n", attrs)
+}
+
+// Encode writes the playlist in the M3U8 format
+func (m *MediaPlaylist) Encode(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	b.WriteString("#EXTM3U\n")
+	if m.Version != 0 {
+		fmt.Fprintf(b, "#EXT-X-VERSION:%d\n", m.Version)
+	}
+
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", m.TargetDuration)
+	if m.MediaSequence != 0 {
+		fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.MediaSequence)
+	}
+
+	if m.DiscontinuitySeq != 0 {
+		fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", m.DiscontinuitySeq)
+	}
+
+	if m.PType != "" {
+		fmt.Fprintf(b, "#EXT-X-PLAYLIST-TYPE:%s\n", m.PType)
+	}
+
+	if m.IFramesOnly {
+		b.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	}
+
+	if m.Independent {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	encodeStart(b, m.TimeOffset, m.Precise)
+
+	keyIndex := -1
+	for i, segment := range m.Segments {
+		// EXT-X-KEY applies to every segment after it, so it is only
+		// written when the key changes. A segment without a key after
+		// one with a key needs METHOD=NONE to stop the previous key
+		if segment.KeyIndex != keyIndex {
+			if segment.KeyIndex == -1 {
+				encodeKey(b, "EXT-X-KEY", &Key{Method: CryptNone})
+			} else if segment.KeyIndex < len(m.Keys) {
+				encodeKey(b, "EXT-X-KEY", m.Keys[segment.KeyIndex])
+			} else {
+				return fmt.Errorf("segment %q has key index %d, but there are %d keys", segment.URI, segment.KeyIndex, len(m.Keys))
+			}
+			keyIndex = segment.KeyIndex
+		}
+
+		if segment.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+
+		if segment.Map != nil {
+			var attrs attributeList
+			attrs.quoted("URI", segment.Map.URI)
+			attrs.quoted("BYTERANGE", segment.Map.ByteRange)
+			fmt.Fprintf(b, "#EXT-X-MAP:%s\n", attrs)
+		}
+
+		if !segment.DateTime.IsZero() {
+			fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.DateTime.Format(time.RFC3339Nano))
+		}
+
+		for i := range segment.DateRanges {
+			encodeDateRange(b, &segment.DateRanges[i])
+		}
+		encodeTags(b, segment.Tags)
+
+		// 4.3.2.2 - The offset can only be left out when the segment
+		// continues a byte range of the same resource before it
+		if segment.ByteRange != 0 {
+			continues := i > 0 && m.Segments[i-1].ByteRange != 0 && m.Segments[i-1].URI == segment.URI
+			if segment.Offset == 0 && continues {
+				fmt.Fprintf(b, "#EXT-X-BYTERANGE:%d\n", segment.ByteRange)
+			} else {
+				fmt.Fprintf(b, "#EXT-X-BYTERANGE:%d@%d\n", segment.ByteRange, segment.Offset)
+			}
+		}
+
+		fmt.Fprintf(b, "#EXTINF:%s,%s\n%s\n", formatFloat(segment.Duration), segment.Title, segment.URI)
+	}
+
+	encodeTags(b, m.Tags)
+	if m.EndList {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.Flush()
+}
+
+// Encode writes the playlist in the M3U8 format
+func (m *MasterPlaylist) Encode(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	b.WriteString("#EXTM3U\n")
+	if m.Version != 0 {
+		fmt.Fprintf(b, "#EXT-X-VERSION:%d\n", m.Version)
+	}
+
+	if m.Independent {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	encodeStart(b, m.TimeOffset, m.Precise)
+
+	for _, session := range m.SessionData {
+		var attrs attributeList
+		attrs.quoted("DATA-ID", session.DataID)
+		attrs.quoted("VALUE", session.Value)
+		attrs.quoted("URI", session.URI)
+		attrs.quoted("LANGUAGE", session.Language)
+		fmt.Fprintf(b, "#EXT-X-SESSION-DATA:%s\n", attrs)
+	}
+
+	if m.SessionKey != nil {
+		encodeKey(b, "EXT-X-SESSION-KEY", m.SessionKey)
+	}
+
+	for _, rend := range m.Renditions {
+		encodeTags(b, rend.Tags)
+		var attrs attributeList
+		attrs.enum("TYPE", rend.Type)
+		attrs.quoted("URI", rend.URI)
+		attrs.quoted("GROUP-ID", rend.GroupID)
+		attrs.quoted("LANGUAGE", rend.Language)
+		attrs.quoted("ASSOC-LANGUAGE", rend.AssocLanguage)
+		attrs.quoted("NAME", rend.Name)
+		if rend.Default == MediaDefaultYES {
+			attrs.enum("DEFAULT", rend.Default)
+		}
+
+		if rend.AutoSelect == MediaDefaultYES {
+			attrs.enum("AUTOSELECT", rend.AutoSelect)
+		}
+
+		if rend.Forced == MediaDefaultYES {
+			attrs.enum("FORCED", rend.Forced)
+		}
+		attrs.quoted("INSTREAM-ID", rend.InstreamID)
+		attrs.quoted("CHARACTERISTICS", rend.Characteristics)
+		attrs.quoted("CHANNELS", rend.Channels)
+		fmt.Fprintf(b, "#EXT-X-MEDIA:%s\n", attrs)
+	}
+
+	for _, variant := range m.Variants {
+		encodeTags(b, variant.Tags)
+		var attrs attributeList
+		attrs.integer("PROGRAM-ID", int64(variant.ProgramID))
+		attrs = append(attrs, "BANDWIDTH="+strconv.FormatInt(variant.Bandwidth, 10))
+		attrs.integer("AVERAGE-BANDWIDTH", variant.BandwidthAvg)
+		attrs.quoted("CODECS", variant.Codecs)
+		attrs.resolution(variant.Resolution)
+		attrs.float("FRAME-RATE", variant.FrameRate)
+		attrs.enum("HDCP-LEVEL", variant.HDCPLevel)
+		attrs.quoted("AUDIO", variant.Audio)
+		attrs.quoted("VIDEO", variant.Video)
+		attrs.quoted("SUBTITLES", variant.Subtitles)
+		if variant.ClosedCaptions == CCNone {
+			attrs.enum("CLOSED-CAPTIONS", CCNone)
+		} else {
+			attrs.quoted("CLOSED-CAPTIONS", variant.ClosedCaptions)
+		}
+		fmt.Fprintf(b, "#EXT-X-STREAM-INF:%s\n%s\n", attrs, variant.URI)
+	}
+
+	for _, variant := range m.IVariants {
+		encodeTags(b, variant.Tags)
+		attrs := attributeList{"BANDWIDTH=" + strconv.FormatInt(variant.Bandwidth, 10)}
+		attrs.integer("AVERAGE-BANDWIDTH", variant.BandwidthAvg)
+		attrs.quoted("CODECS", variant.Codecs)
+		attrs.resolution(variant.Resolution)
+		attrs.enum("HDCP-LEVEL", variant.HDCPLevel)
+		attrs.quoted("VIDEO", variant.Video)
+		attrs.quoted("URI", variant.URI)
+		fmt.Fprintf(b, "#EXT-X-I-FRAME-STREAM-INF:%s\n", attrs)
+	}
+	encodeTags(b, m.Tags)
+	return b.Flush()
+}
+
+// EncodeString returns the playlist in the M3U8 format
+func EncodeString(playlist Playlist) (string, error) {
+	var b bytes.Buffer
+	if err := playlist.Encode(&b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,45 @@
+package m3u8
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonKey has the same JSON fields as Key, but the shallower IV field
+// replaces the raw IV bytes with their hexadecimal-sequence
+type jsonKey struct {
+	keyFields
+	IV string `json:"iv,omitempty"`
+}
+
+type keyFields Key
+
+// MarshalJSON encodes the key with the IV as a hexadecimal-sequence
+func (k Key) MarshalJSON() ([]byte, error) {
+	encoded := jsonKey{keyFields: keyFields(k)}
+	if k.IV != "" {
+		encoded.IV = "0x" + strings.ToUpper(hex.EncodeToString([]byte(k.IV)))
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes a key encoded by MarshalJSON
+func (k *Key) UnmarshalJSON(data []byte) error {
+	var decoded jsonKey
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*k = Key(decoded.keyFields)
+	if decoded.IV != "" {
+		iv := strings.TrimPrefix(strings.TrimPrefix(decoded.IV, "0x"), "0X")
+		raw, err := hex.DecodeString(iv)
+		if err != nil {
+			return fmt.Errorf("decoding key iv %q: %w", decoded.IV, err)
+		}
+		k.IV = string(raw)
+	}
+	return nil
+}
@@ -1,11 +1,10 @@
 package m3u8
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
+	"regexp"
 )
 
 // TODO: Figure out a good way to detect whether EXT-X-KEY is for the whole media playlist or for a media segment
@@ -38,23 +37,8 @@ const (
 	MediaDefaultNO  string = "NO"
 )
 
-// EmptyKey represents an empty key response
-var EmptyKey = []byte{0}
-
-const (
-	tagRegex string = `#([A-Z-]+):?(.+)?`
-
-	// Defined in Section 4.2
-	// end me please
-	attrRegex string = `([A-Z0-9-]+)=(0[xX][0-9A-F]+|[x0-9.-]+|[A-Z0-9-]+|"?[^\x0A\x0D\x22]+"?)`
-
-	// Longer version for comparison ...
-	// ([A-Z0-9-]+)=(0[xX][0-9A-F]+|[0-9\.-]+|[0-9\.]+|[0-9]+|[A-Z0-9-]+|"?[^\x0A\x0D\x22\x2C]+"?)
-
-	// Ugly regex for properly identifying INSTREAM-ID
-	// See regex test cases above for what worked and didn't
-	instreamRegex string = `"(CC[1-4]|SERVICE[1-5][0-9]?|SERVICE6[0-3])"`
-)
+// instreamPattern matches the valid values of INSTREAM-ID
+var instreamPattern = regexp.MustCompile(`^(CC[1-4]|SERVICE[1-5][0-9]?|SERVICE6[0-3])$`)
 
 // TODO: remove the random pointers in structs
 
@@ -62,48 +46,13 @@ const (
 // MasterPlaylist and MediaPlaylist fall under
 type Playlist interface {
 	Type() int
-	//Decode(string) error
+	Encode(io.Writer) error
 }
 
 // DecodeReader creates a playlist and determines the type. It is recommended that
 // this method be used when a m3u8 file is present, and DecodeURL be used with a URL
 func DecodeReader(reader io.Reader) (playlist Playlist, err error) {
-	var isMedia bool
-	var lines []string
-
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		text := strings.TrimSpace(scanner.Text())
-		if strings.TrimSpace(text) != "" { // Ignore stupid whitespace
-			lines = append(lines, text)
-		}
-
-		// 4.3.3   - "A Media Playlist tag MUST NOT appear in a Master Playlist."
-		// 4.3.3.1 - "The EXT-X-TARGETDURATION tag is REQUIRED."
-		if strings.HasPrefix(text, "#EXT-X-TARGETDURATION") {
-			isMedia = true
-		}
-	}
-
-	if len(lines) == 0 || lines[0] != "#EXTM3U" {
-		err = fmt.Errorf(`provided reader is not a valid m3u8 file (does not contain header "#EXTM3U")`)
-		return
-	}
-
-	// Remove the header tag from the split
-	lines = lines[1:]
-
-	// This check assumes that all master playlists will have at least one #EXT-X-STREAM-INF. I have found no proof that Master Playlists can be made without these, so if you find an example please open an issue with it
-	if isMedia {
-		if playlist, err = parseMediaPlaylist(lines); err != nil {
-			err = fmt.Errorf("parsing media playlist: %w", err)
-		}
-	} else {
-		if playlist, err = parseMasterPlaylist(lines); err != nil {
-			err = fmt.Errorf("parsing master playlist: %w", err)
-		}
-	}
-	return
+	return NewDecoder(reader).Decode()
 }
 
 // DecodeURL passes a URL to DecodeReader. Easier for downloading from websites
@@ -2,9 +2,14 @@ package m3u8
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"reflect"
+	"regexp"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 // got most of these tests from https://github.com/globocom/m3u8/blob/master/tests/playlists.py
@@ -172,7 +177,7 @@ func TestMediaPlaylistEncryptedSegments(t *testing.T) {
 	}
 
 	for i, seg := range segments {
-		assertEqual(t, playlist.Segments[i], seg)
+		assertEqual(t, *playlist.Segments[i], seg)
 	}
 }
 
@@ -254,3 +259,627 @@ func TestMasterPlaylistAvgBandwidth(t *testing.T) {
 		assertEqual(t, playlist.Variants[i], variant)
 	}
 }
+
+func TestMediaPlaylistKeyIV(t *testing.T) {
+	playlist := makeMediaPlaylist(`
+		#EXTM3U
+		#EXT-X-TARGETDURATION:15
+		#EXT-X-KEY:METHOD=AES-128,URI="https://priv.example.com/key.php?r=52",IV=0x0123456789ABCDEF0123456789ABCDEF
+		#EXTINF:15,
+		http://media.example.com/fileSequence52-1.ts
+	`, 1, t)
+
+	assertEqual(t, len(playlist.Keys), 1)
+	assertEqual(t, playlist.Keys[0].IV, "\x01\x23\x45\x67\x89\xAB\xCD\xEF\x01\x23\x45\x67\x89\xAB\xCD\xEF")
+}
+
+func TestMediaPlaylistSummary(t *testing.T) {
+	playlist := makeMediaPlaylist(`
+		#EXTM3U
+		#EXT-X-TARGETDURATION:10
+		#EXTINF:9.5,
+		http://media.example.com/clear.ts
+		#EXT-X-KEY:METHOD=AES-128,URI="https://priv.example.com/key.php?r=52"
+		#EXTINF:10,
+		http://media.example.com/encrypted1.ts
+		#EXTINF:10,
+		http://media.example.com/encrypted2.ts
+		#EXT-X-KEY:METHOD=AES-128,URI="https://priv.example.com/key.php?r=53"
+		#EXT-X-DISCONTINUITY
+		#EXTINF:4.5,
+		http://media.example.com/encrypted3.ts
+		#EXT-X-ENDLIST
+	`, 4, t)
+
+	assertEqual(t, playlist.Summary(), MediaSummary{
+		Segments:          4,
+		Duration:          34,
+		MaxDuration:       10,
+		EncryptedSegments: 3,
+		KeyRotations:      2,
+		Discontinuities:   1,
+		Ended:             true,
+	})
+}
+
+func TestKeyJSON(t *testing.T) {
+	key := Key{Method: CryptAES, URI: "key.bin", IV: "\x01\x23\x45\x67\x89\xAB\xCD\xEF\x01\x23\x45\x67\x89\xAB\xCD\xEF", Value: []byte("secret")}
+	data, err := json.Marshal(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %v", err)
+	}
+	assertEqual(t, string(data), `{"method":"AES-128","uri":"key.bin","iv":"0x0123456789ABCDEF0123456789ABCDEF"}`)
+
+	var decoded Key
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshalling key: %v", err)
+	}
+
+	key.Value = nil
+	assertEqual(t, decoded, key)
+}
+
+func assertRoundTrip(t *testing.T, playlist Playlist) {
+	encoded, err := EncodeString(playlist)
+	if err != nil {
+		t.Fatalf("encoding playlist: %v", err)
+	}
+
+	decoded, err := DecodeReader(strings.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decoding encoded playlist: %v\n%s", err, encoded)
+	}
+
+	if !reflect.DeepEqual(decoded, playlist) {
+		t.Errorf("playlist changed after encoding\n\tExpected:%+v\n\tGot:%+v\n%s", playlist, decoded, encoded)
+	}
+}
+
+func TestMediaPlaylistEncode(t *testing.T) {
+	playlist := makeMediaPlaylist(`
+		#EXTM3U
+		#EXT-X-VERSION:4
+		#EXT-X-MEDIA-SEQUENCE:7794
+		#EXT-X-TARGETDURATION:15
+		#EXT-X-PLAYLIST-TYPE:VOD
+		#EXT-X-START:TIME-OFFSET=10.5,PRECISE=YES
+		#EXT-X-KEY:METHOD=AES-128,URI="https://priv.example.com/key.php?r=52",IV=0x0123456789ABCDEF0123456789ABCDEF
+		#EXT-X-PROGRAM-DATE-TIME:2010-02-19T14:54:23.031+08:00
+		#EXTINF:15,first
+		http://media.example.com/fileSequence52-1.ts
+		#EXT-X-BYTERANGE:1000@200
+		#EXTINF:14.5,
+		http://media.example.com/fileSequence52-2.ts
+		#EXT-X-KEY:METHOD=AES-128,URI="https://priv.example.com/key.php?r=53"
+		#EXT-X-DISCONTINUITY
+		#EXTINF:0.000011,
+		http://media.example.com/fileSequence53-1.ts
+		#EXT-X-ENDLIST
+	`, 3, t)
+
+	assertRoundTrip(t, playlist)
+}
+
+func TestMediaPlaylistEncodeByteRange(t *testing.T) {
+	playlist, err := NewMediaBuilder().
+		AppendSegment(Segment{URI: "all.ts", Duration: 4, ByteRange: 100}).
+		AppendSegment(Segment{URI: "all.ts", Duration: 4, ByteRange: 200}).
+		AppendSegment(Segment{URI: "other.ts", Duration: 4, ByteRange: 300}).
+		AppendSegment(Segment{URI: "other.ts", Duration: 4, ByteRange: 400, Offset: 500}).
+		Build()
+	if err != nil {
+		t.Fatalf("building playlist: %v", err)
+	}
+
+	encoded, err := EncodeString(playlist)
+	if err != nil {
+		t.Fatalf("encoding playlist: %v", err)
+	}
+
+	// The offset is only left out when the range continues the one before it
+	var ranges []string
+	for _, line := range strings.Split(encoded, "\n") {
+		if strings.HasPrefix(line, "#EXT-X-BYTERANGE:") {
+			ranges = append(ranges, strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"))
+		}
+	}
+	assertEqual(t, ranges, []string{"100@0", "200", "300@0", "400@500"})
+	assertRoundTrip(t, playlist)
+}
+
+func TestMasterPlaylistEncode(t *testing.T) {
+	playlist := makeMasterPlaylist(`
+		#EXTM3U
+		#EXT-X-INDEPENDENT-SEGMENTS
+		#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,URI="audio/en.m3u8"
+		#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="sub",NAME="Deutsch",LANGUAGE="de",URI="subs/de.m3u8"
+		#EXT-X-STREAM-INF:BANDWIDTH=1280000,AVERAGE-BANDWIDTH=1000000,RESOLUTION=640x360,FRAME-RATE=29.97,CODECS="avc1.4d401e,mp4a.40.2",AUDIO="aud",SUBTITLES="sub"
+		low/index.m3u8
+		#EXT-X-STREAM-INF:BANDWIDTH=7680000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2",AUDIO="aud",SUBTITLES="sub",CLOSED-CAPTIONS=NONE
+		hi/index.m3u8
+		#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,RESOLUTION=640x360,URI="low/iframe.m3u8"
+	`, 3, t)
+
+	assertRoundTrip(t, playlist)
+}
+
+func TestMediaPlaylistDateRange(t *testing.T) {
+	playlist := makeMediaPlaylist(`
+		#EXTM3U
+		#EXT-X-TARGETDURATION:10
+		#EXT-X-PROGRAM-DATE-TIME:2014-03-05T11:14:00Z
+		#EXT-X-DATERANGE:ID="splice-6FFFFFF0",START-DATE="2014-03-05T11:15:00Z",PLANNED-DURATION=59.993,X-COM-EXAMPLE-AD-ID="XYZ123",SCTE35-OUT=0xFC002F0000000000FF000014056FFFFFF000E011622DCAFF000052636200000000000A0008029896F50000008700000000
+		#EXTINF:10,
+		first.ts
+		#EXT-X-DATERANGE:ID="splice-6FFFFFF0",START-DATE="2014-03-05T11:15:00Z",END-DATE="2014-03-05T11:16:00.5Z",DURATION=60.5
+		#EXTINF:10,
+		second.ts
+	`, 2, t)
+
+	dateRanges := playlist.Segments[0].DateRanges
+	if len(dateRanges) != 1 {
+		t.Fatalf("expected 1 date range, got %d", len(dateRanges))
+	}
+
+	assertEqual(t, dateRanges[0].ID, "splice-6FFFFFF0")
+	assertEqual(t, dateRanges[0].StartDate, time.Date(2014, 3, 5, 11, 15, 0, 0, time.UTC))
+	assertEqual(t, dateRanges[0].PlannedDuration, float32(59.993))
+	assertEqual(t, dateRanges[0].ClientAttrs["X-COM-EXAMPLE-AD-ID"], `"XYZ123"`)
+	assertEqual(t, dateRanges[0].SCTE35Out[:6], "0xFC00")
+
+	end := playlist.Segments[1].DateRanges[0]
+	assertEqual(t, end.EndDate.Sub(end.StartDate), 60500*time.Millisecond)
+	assertEqual(t, end.Duration, float32(60.5))
+
+	assertRoundTrip(t, playlist)
+}
+
+func TestMediaBuilder(t *testing.T) {
+	key := &Key{Method: CryptAES, URI: "key.bin"}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	playlist, err := NewMediaBuilder().
+		SetPlaylistType(PlaylistVOD).
+		SetTargetDuration(4).
+		SetMap(&Map{URI: "init.mp4"}).
+		SetProgramDateTime(start).
+		AddDateRange(DateRange{ID: "ad", Class: "com.example.ad", StartDate: start, EndOnNext: true}).
+		AppendSegment(Segment{URI: "0.m4s", Duration: 4}).
+		SetKey(key).
+		AppendSegment(Segment{URI: "1.m4s", Duration: 5.6}).
+		SetKey(nil).
+		AddDiscontinuity().
+		AppendSegment(Segment{URI: "2.m4s", Duration: 2, KeyIndex: 3}).
+		SetKey(key).
+		AppendSegment(Segment{URI: "3.m4s", Duration: 1}).
+		End().
+		Build()
+
+	if err != nil {
+		t.Fatalf("building playlist: %v", err)
+	}
+
+	assertEqual(t, playlist.TargetDuration, int64(6))
+	assertEqual(t, playlist.Version, 6)
+	assertEqual(t, len(playlist.Keys), 1)
+	for i, index := range []int{-1, 0, -1, 0} {
+		assertEqual(t, playlist.Segments[i].KeyIndex, index)
+	}
+	assertEqual(t, playlist.Segments[2].Discontinuity, true)
+	assertEqual(t, playlist.Segments[1].Map == nil, true)
+	assertEqual(t, playlist.MapAt(3).URI, "init.mp4")
+
+	// The parser makes a key for every EXT-X-KEY, so the encoded playlists are compared instead
+	encoded, err := EncodeString(playlist)
+	if err != nil {
+		t.Fatalf("encoding playlist: %v", err)
+	}
+
+	decoded, err := DecodeReader(strings.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decoding playlist: %v", err)
+	}
+
+	if reencoded, _ := EncodeString(decoded); reencoded != encoded {
+		t.Errorf("playlist changed after decoding\n%s\n%s", encoded, reencoded)
+	}
+
+	// Integer durations without other features only need version 1
+	playlist, err = NewMediaBuilder().AppendSegment(Segment{URI: "a.ts", Duration: 10}).Build()
+	if err != nil {
+		t.Fatalf("building playlist: %v", err)
+	}
+	assertEqual(t, playlist.Version, 1)
+	assertEqual(t, playlist.TargetDuration, int64(10))
+
+	errors := []*MediaBuilder{
+		NewMediaBuilder().End().AppendSegment(Segment{URI: "a.ts"}),
+		NewMediaBuilder().AppendSegment(Segment{URI: "a.ts"}).AddDiscontinuity(),
+		NewMediaBuilder().AddDateRange(DateRange{ID: "x", StartDate: start}).AppendSegment(Segment{URI: "a.ts"}),
+		NewMediaBuilder().AddDateRange(DateRange{ID: "x", StartDate: start, EndDate: start.Add(-time.Second)}),
+		NewMediaBuilder().SetKey(&Key{Method: CryptAES}),
+		NewMediaBuilder().SetPlaylistType("LIVE"),
+	}
+
+	for i, builder := range errors {
+		if _, err := builder.Build(); err == nil {
+			t.Errorf("builder %d did not return an error", i)
+		}
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	attributes, err := ParseAttributes(`URI="a,b=c.m3u8",IV=0x0123456789abcdef0123456789ABCDEF,BANDWIDTH=1280000,FRAME-RATE=29.97,TIME-OFFSET=-4.5,TYPE=AUDIO,RESOLUTION=1920x1080, X-EMPTY=""`)
+	if err != nil {
+		t.Fatalf("parsing attributes: %v", err)
+	}
+
+	expected := []Attribute{
+		{"URI", ValueString, "a,b=c.m3u8"},
+		{"IV", ValueHex, "0x0123456789abcdef0123456789ABCDEF"},
+		{"BANDWIDTH", ValueInteger, "1280000"},
+		{"FRAME-RATE", ValueFloat, "29.97"},
+		{"TIME-OFFSET", ValueSignedFloat, "-4.5"},
+		{"TYPE", ValueEnum, "AUDIO"},
+		{"RESOLUTION", ValueResolution, "1920x1080"},
+		{"X-EMPTY", ValueString, ""},
+	}
+	assertEqual(t, attributes, expected)
+
+	iv, _ := attributes[1].Hex()
+	assertEqual(t, iv, []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+
+	resolution, _ := attributes[6].Resolution()
+	assertEqual(t, resolution, Resolution{Width: 1920, Height: 1080})
+
+	if _, err := attributes[0].Integer(); err == nil {
+		t.Errorf("quoted-string was parsed as an integer")
+	}
+
+	for _, line := range []string{`URI="unterminated`, `URI`, `=1`, `URI="a"B=1`, `A=1,`, `A=1,,B=2`, `A=two words`, `A=1,A=2`} {
+		if _, err := parseAttributes(line); err == nil {
+			t.Errorf("%q did not return an error", line)
+		}
+	}
+}
+
+func TestMediaPlaylistLowercaseIV(t *testing.T) {
+	playlist := makeMediaPlaylist(`
+		#EXTM3U
+		#EXT-X-TARGETDURATION:10
+		#EXT-X-KEY:METHOD=AES-128,URI="key?a=1,b=2",IV=0x0123456789abcdef0123456789abcdef
+		#EXTINF:10,
+		a.ts
+	`, 1, t)
+
+	assertEqual(t, playlist.Keys[0].URI, "key?a=1,b=2")
+	assertEqual(t, playlist.Keys[0].IV, "\x01\x23\x45\x67\x89\xab\xcd\xef\x01\x23\x45\x67\x89\xab\xcd\xef")
+}
+
+// benchmarkPlaylist returns a media playlist of 10000 segments, each with its own key
+func benchmarkPlaylist() string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:6\n")
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&b, "#EXT-X-KEY:METHOD=AES-128,URI=\"https://keys.example.com/key?id=%d\",IV=0x%032X,KEYFORMAT=\"identity\"\n", i, i)
+		fmt.Fprintf(&b, "#EXTINF:5.005,\nsegment%d.ts\n", i)
+	}
+	return b.String()
+}
+
+// regexAttributes is how attribute lists were parsed before ParseAttributes, for comparison
+func regexAttributes(line string) map[string]string {
+	attribs := make(map[string]string)
+	linePattern := regexp.MustCompile(`([A-Z0-9-]+)=(0[xX][0-9A-F]+|[x0-9.-]+|[A-Z0-9-]+|"?[^\x0A\x0D\x22]+"?)`)
+	for _, arr := range linePattern.FindAllStringSubmatch(line, -1) {
+		attribs[arr[1]] = arr[2]
+	}
+	return attribs
+}
+
+func benchmarkAttributeLines() []string {
+	var lines []string
+	for _, line := range strings.Split(benchmarkPlaylist(), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-KEY:") {
+			lines = append(lines, strings.TrimPrefix(line, "#EXT-X-KEY:"))
+		}
+	}
+	return lines
+}
+
+func BenchmarkParseAttributes(b *testing.B) {
+	lines := benchmarkAttributeLines()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			if _, err := parseAttributes(line); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkParseAttributesRegex(b *testing.B) {
+	lines := benchmarkAttributeLines()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			regexAttributes(line)
+		}
+	}
+}
+
+func BenchmarkDecodeMediaPlaylist(b *testing.B) {
+	data := benchmarkPlaylist()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeReader(strings.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecoderOnSegment(t *testing.T) {
+	decoder := NewDecoder(strings.NewReader(benchmarkPlaylist()))
+
+	var count int
+	decoder.OnSegment(func(playlist *MediaPlaylist, segment *Segment) error {
+		if expected := fmt.Sprintf("segment%d.ts", count); segment.URI != expected || segment.Duration != 5.005 {
+			return fmt.Errorf("segment %d is %+v", count, segment)
+		}
+
+		if len(playlist.Keys) != 1 || segment.KeyIndex != 0 {
+			return fmt.Errorf("segment %d has key index %d of %d keys", count, segment.KeyIndex, len(playlist.Keys))
+		}
+
+		if key := playlist.Keys[segment.KeyIndex]; key.URI != fmt.Sprintf("https://keys.example.com/key?id=%d", count) {
+			return fmt.Errorf("segment %d has key %+v", count, key)
+		}
+		count++
+		return nil
+	})
+
+	playlist, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("decoding playlist: %v", err)
+	}
+
+	assertEqual(t, count, 10000)
+	assertEqual(t, len(playlist.(*MediaPlaylist).Segments), 0)
+	assertEqual(t, playlist.(*MediaPlaylist).TargetDuration, int64(6))
+}
+
+func TestDecoderPlaylistType(t *testing.T) {
+	// Tags that can appear in both types are held until the type is known
+	playlist := makeMediaPlaylist(`
+		#EXTM3U
+		#EXT-X-VERSION:3
+		#EXT-X-INDEPENDENT-SEGMENTS
+		# a comment
+		#EXTINF:4,title, with a comma
+		a.ts
+		#EXT-X-TARGETDURATION:4
+	`, 1, t)
+
+	assertEqual(t, playlist.Version, 3)
+	assertEqual(t, playlist.Independent, true)
+	assertEqual(t, playlist.Segments[0].Title, "title, with a comma")
+
+	master := makeMasterPlaylist(`
+		#EXTM3U
+		#EXT-X-VERSION:3
+		#EXT-X-STREAM-INF:BANDWIDTH=1000
+		low.m3u8
+	`, 1, t)
+	assertEqual(t, master.Version, 3)
+
+	if _, err := DecodeReader(strings.NewReader("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\n")); err == nil {
+		t.Errorf("variant without a URI did not return an error")
+	}
+}
+
+// benchmarkDecoder decodes a playlist of the given number of segments, passing
+// them to OnSegment so that memory use does not depend on the number of segments
+func benchmarkDecoder(b *testing.B, segments int) {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:6\n#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	for i := 0; i < segments; i++ {
+		fmt.Fprintf(&playlist, "#EXT-X-KEY:METHOD=AES-128,URI=\"key%d.bin\"\n", i)
+		fmt.Fprintf(&playlist, "#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:00:00.000Z\n#EXTINF:5.005,\nsegment%d.ts\n", i)
+	}
+	data := playlist.String()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	var decoded Playlist
+	for i := 0; i < b.N; i++ {
+		decoder := NewDecoder(strings.NewReader(data))
+		decoder.OnSegment(func(*MediaPlaylist, *Segment) error { return nil })
+
+		var err error
+		if decoded, err = decoder.Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// Linear time shows as a constant time per segment
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*segments), "ns/segment")
+
+	// The heap still in use by the last decoded playlist stays the same as segments are added
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(data)
+	runtime.KeepAlive(decoded)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)), "live-B")
+}
+
+func BenchmarkDecoder10k(b *testing.B) { benchmarkDecoder(b, 10000) }
+func BenchmarkDecoder40k(b *testing.B) { benchmarkDecoder(b, 40000) }
+
+func TestMediaPlaylistTags(t *testing.T) {
+	RegisterTag("EXT-X-CUE-OUT", func(value string) (interface{}, error) {
+		var duration float64
+		if _, err := fmt.Sscanf(value, "%f", &duration); err != nil {
+			return nil, err
+		}
+		return duration, nil
+	})
+	defer RegisterTag("EXT-X-CUE-OUT", nil)
+
+	playlist := makeMediaPlaylist(`
+		#EXTM3U
+		#EXT-X-TARGETDURATION:10
+		# generated by an encoder
+		#EXTINF:10,
+		first.ts
+		#EXT-X-CUE-OUT:30
+		#EXT-OATCLS-SCTE35:/DAlAAAAAAAAAP/wFAUAAAABf+/+AAAAAH4AKTLgAAEAAAAAAAA=
+		#EXTINF:10,
+		ad.ts
+		#EXT-X-CUE-IN
+		#EXTINF:10,
+		second.ts
+		#EXT-X-VENDOR-END:1
+		#EXT-X-ENDLIST
+	`, 3, t)
+
+	assertEqual(t, playlist.Segments[0].Tags, []Tag{{Value: " generated by an encoder"}})
+	assertEqual(t, playlist.Segments[1].Tags, []Tag{
+		{Name: "EXT-X-CUE-OUT", Value: "30", Data: float64(30)},
+		{Name: "EXT-OATCLS-SCTE35", Value: "/DAlAAAAAAAAAP/wFAUAAAABf+/+AAAAAH4AKTLgAAEAAAAAAAA="},
+	})
+	assertEqual(t, playlist.Segments[2].Tags, []Tag{{Name: "EXT-X-CUE-IN"}})
+	assertEqual(t, playlist.Tags, []Tag{{Name: "EXT-X-VENDOR-END", Value: "1"}})
+	assertRoundTrip(t, playlist)
+
+	if _, err := DecodeReader(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-CUE-OUT:soon\n#EXTINF:10,\na.ts\n")); err == nil {
+		t.Errorf("tag parser error was not returned")
+	}
+
+	// Master playlist tags stay with the variant or rendition after them
+	master := makeMasterPlaylist(`
+		#EXTM3U
+		#EXT-X-VENDOR-INFO:id=1
+		#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="audio.m3u8"
+		# low quality
+		#EXT-X-STREAM-INF:BANDWIDTH=1000
+		low.m3u8
+		#EXT-X-VENDOR-INFO:id=2
+		#EXT-X-STREAM-INF:BANDWIDTH=2000
+		high.m3u8
+		#EXT-X-VENDOR-INFO:id=3
+		#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=100,URI="iframes.m3u8"
+		# the end
+	`, 3, t)
+	assertEqual(t, master.Renditions[0].Tags, []Tag{{Name: "EXT-X-VENDOR-INFO", Value: "id=1"}})
+	assertEqual(t, master.Variants[0].Tags, []Tag{{Value: " low quality"}})
+	assertEqual(t, master.Variants[1].Tags, []Tag{{Name: "EXT-X-VENDOR-INFO", Value: "id=2"}})
+	assertEqual(t, master.IVariants[0].Tags, []Tag{{Name: "EXT-X-VENDOR-INFO", Value: "id=3"}})
+	assertEqual(t, master.Tags, []Tag{{Value: " the end"}})
+	assertRoundTrip(t, master)
+
+	encoded, err := EncodeString(master)
+	if err != nil {
+		t.Fatalf("encoding master playlist: %v", err)
+	}
+
+	if !strings.Contains(encoded, "#EXT-X-VENDOR-INFO:id=2\n#EXT-X-STREAM-INF:BANDWIDTH=2000\n") || !strings.HasSuffix(encoded, "# the end\n") {
+		t.Errorf("tags were not encoded in place:\n%s", encoded)
+	}
+}
+
+func TestParseDateTime(t *testing.T) {
+	expected := time.Date(2010, 2, 19, 6, 54, 23, 31000000, time.UTC)
+	for _, value := range []string{
+		"2010-02-19T14:54:23.031+08:00",
+		"2010-02-19T14:54:23.031+0800",
+		"2010-02-19T14:54:23.031+08",
+		"2010-02-19T06:54:23.031Z",
+		"2010-02-19T06:54:23.031000000Z",
+		"2010-02-19t06:54:23.031z",
+		"2010-02-19 06:54:23.031Z",
+		"2010-02-19T06:54:23,031Z",
+		"2010-02-19T02:54:23.031-04:00",
+	} {
+		date, err := ParseDateTime(value)
+		if err != nil {
+			t.Errorf("parsing %q: %v", value, err)
+		} else if !date.Equal(expected) {
+			t.Errorf("parsed %q as %v", value, date)
+		}
+	}
+
+	for _, value := range []string{"", "2010-02-19", "yesterday", "2010-02-19T25:00:00Z", "2010-02-19T06:54:23.031"} {
+		if _, err := ParseDateTime(value); err == nil {
+			t.Errorf("invalid date and time %q was parsed", value)
+		}
+	}
+}
+
+func TestMediaPlaylistTimeline(t *testing.T) {
+	playlist := makeMediaPlaylist(`
+		#EXTM3U
+		#EXT-X-TARGETDURATION:4
+		#EXTINF:4,
+		0.ts
+		#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:00:04Z
+		#EXTINF:4,
+		1.ts
+		#EXTINF:4,
+		2.ts
+		#EXT-X-DISCONTINUITY
+		#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:01:00Z
+		#EXTINF:4,
+		3.ts
+		#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:01:04.05Z
+		#EXTINF:4,
+		4.ts
+		#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:01:02Z
+		#EXTINF:4,
+		5.ts
+	`, 6, t)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeline := playlist.Timeline()
+	starts := []time.Duration{0, 4 * time.Second, 8 * time.Second, time.Minute, time.Minute + 4050*time.Millisecond, time.Minute + 2*time.Second}
+	for i, entry := range timeline.Segments {
+		assertEqual(t, entry.Index, i)
+		assertEqual(t, entry.Offset, time.Duration(i)*4*time.Second)
+		assertEqual(t, entry.Start, start.Add(starts[i]))
+		assertEqual(t, entry.Extrapolated, i == 0 || i == 2)
+	}
+
+	// The 50ms difference before 4.ts is within the tolerance for rounding
+	assertEqual(t, timeline.Jumps, []TimeJump{
+		{Index: 3, Expected: start.Add(12 * time.Second), Actual: start.Add(time.Minute)},
+		{Index: 5, Expected: start.Add(time.Minute + 8050*time.Millisecond), Actual: start.Add(time.Minute + 2*time.Second)},
+	})
+	assertEqual(t, timeline.Jumps[0].Gap(), 48*time.Second)
+
+	segment, ok := timeline.SegmentAt(start.Add(10 * time.Second))
+	assertEqual(t, ok, true)
+	assertEqual(t, segment.Segment.URI, "2.ts")
+
+	// The clock jumps back to 00:01:02, so that time is in 3.ts and 5.ts
+	segment, _ = timeline.SegmentAt(start.Add(time.Minute + 3*time.Second))
+	assertEqual(t, segment.Segment.URI, "3.ts")
+
+	_, ok = timeline.SegmentAt(start.Add(30 * time.Second))
+	assertEqual(t, ok, false)
+
+	segment, ok = timeline.SegmentAtOffset(17 * time.Second)
+	assertEqual(t, ok, true)
+	assertEqual(t, segment.Segment.URI, "4.ts")
+
+	_, ok = timeline.SegmentAtOffset(24 * time.Second)
+	assertEqual(t, ok, false)
+	_, ok = timeline.SegmentAtOffset(-time.Second)
+	assertEqual(t, ok, false)
+}
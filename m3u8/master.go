@@ -2,35 +2,36 @@ package m3u8
 
 import (
 	"fmt"
-	"regexp"
+	"strings"
 )
 
 // Resolution contains the width and
 // height of a MasterPlaylist stream
 type Resolution struct { // 4.3.4.2
-	Height int64
-	Width  int64
+	Height int64 `json:"height"`
+	Width  int64 `json:"width"`
 }
 
 // IVariant represents the "I-EXT-X-STREAM-INF" type
 type IVariant struct { // 4.3.4.3
-	URI          string
-	Bandwidth    int64
-	BandwidthAvg int64
-	Codecs       string
-	Resolution   Resolution
-	Video        string
-	HDCPLevel    string
+	URI          string     `json:"uri"`
+	Bandwidth    int64      `json:"bandwidth"`
+	BandwidthAvg int64      `json:"average_bandwidth,omitempty"`
+	Codecs       string     `json:"codecs,omitempty"`
+	Resolution   Resolution `json:"resolution"`
+	Video        string     `json:"video,omitempty"`
+	HDCPLevel    string     `json:"hdcp_level,omitempty"`
+	Tags         []Tag      `json:"tags,omitempty"` // unknown tags and comments that appear before the variant
 }
 
 // Variant represents the EXT-X-STREAM-INF type
 type Variant struct { // 4.3.4.2
 	IVariant
-	ProgramID      int // Removed in Protocol 6
-	FrameRate      float32
-	Audio          string
-	Subtitles      string
-	ClosedCaptions string
+	ProgramID      int     `json:"program_id,omitempty"` // Removed in Protocol 6
+	FrameRate      float32 `json:"frame_rate,omitempty"`
+	Audio          string  `json:"audio,omitempty"`
+	Subtitles      string  `json:"subtitles,omitempty"`
+	ClosedCaptions string  `json:"closed_captions,omitempty"`
 }
 
 // SessionData represents the "EXT-X-SESSION-DATA" variable
@@ -38,41 +39,43 @@ type Variant struct { // 4.3.4.2
 // but they cannot have the same DATA-ID and LANGUAGE information.
 // I'll add support for that later if it's really necessary
 type SessionData struct { // 4.3.4.4
-	DataID   string
-	Value    string
-	URI      string
-	Language string // Should be RFC5646-compliant
+	DataID   string `json:"data_id"`
+	Value    string `json:"value,omitempty"`
+	URI      string `json:"uri,omitempty"`
+	Language string `json:"language,omitempty"` // Should be RFC5646-compliant
 }
 
 // Rendition contains alternative renditions
 // of the same content in the Master Playlist
 type Rendition struct { // 4.3.4.1
-	Type            string
-	URI             string
-	GroupID         string
-	Language        string
-	AssocLanguage   string
-	Name            string
-	Default         string // defaults to no
-	AutoSelect      string // defaults to no
-	Forced          string // defaults to no
-	InstreamID      string
-	Characteristics string
-	Channels        string
+	Type            string `json:"type"`
+	URI             string `json:"uri,omitempty"`
+	GroupID         string `json:"group_id"`
+	Language        string `json:"language,omitempty"`
+	AssocLanguage   string `json:"assoc_language,omitempty"`
+	Name            string `json:"name"`
+	Default         string `json:"default"`    // defaults to no
+	AutoSelect      string `json:"autoselect"` // defaults to no
+	Forced          string `json:"forced"`     // defaults to no
+	InstreamID      string `json:"instream_id,omitempty"`
+	Characteristics string `json:"characteristics,omitempty"`
+	Channels        string `json:"channels,omitempty"`
+	Tags            []Tag  `json:"tags,omitempty"` // unknown tags and comments that appear before the rendition
 }
 
 // MasterPlaylist represents a Master Playlist M3U8 file
 type MasterPlaylist struct { // 4.3.4
-	Variants     []Variant
-	IVariants    []IVariant
-	SessionData  []SessionData //A Playlist MAY contain multiple EXT-X-SESSION-DATA tags with the same DATA-ID attribute
-	SessionKey   *Key
-	Renditions   []Rendition
-	Independent  bool
-	TimeOffset   float32
-	Precise      bool
-	Version      int
-	VariantCount int
+	Variants     []Variant     `json:"variants"`
+	IVariants    []IVariant    `json:"i_frame_variants,omitempty"`
+	SessionData  []SessionData `json:"session_data,omitempty"` //A Playlist MAY contain multiple EXT-X-SESSION-DATA tags with the same DATA-ID attribute
+	SessionKey   *Key          `json:"session_key,omitempty"`
+	Renditions   []Rendition   `json:"renditions,omitempty"`
+	Independent  bool          `json:"independent_segments,omitempty"`
+	TimeOffset   float32       `json:"time_offset,omitempty"`
+	Precise      bool          `json:"precise,omitempty"`
+	Version      int           `json:"version,omitempty"`
+	VariantCount int           `json:"-"`
+	Tags         []Tag         `json:"tags,omitempty"` // unknown tags and comments after the last variant or rendition
 }
 
 // Type returns master playlist type
@@ -80,260 +83,284 @@ func (m *MasterPlaylist) Type() int {
 	return TypeMaster
 }
 
-func parseMasterPlaylist(lines []string) (playlist *MasterPlaylist, err error) {
-	playlist = new(MasterPlaylist)
-	for i, line := range lines {
-		if results := regexp.MustCompile(tagRegex).FindStringSubmatch(line); results != nil {
-			switch results[1] {
-			case "EXT-X-TARGETDURATION", "EXT-X-MEDIA-SEQUENCE", "EXT-X-DISCONTINUITY-SEQUENCE", "EXT-X-ENDLIST", "EXT-X-PLAYLIST-TYPE", "EXT-X-I-FRAMES-ONLY":
-				err = fmt.Errorf("found media playlists tags in master playlist")
-				return
-			case "EXT-X-MEDIA":
-				rend := new(Rendition)
-				attributes := parseAttributes(results[2])
-
-				val, exists := attributes["TYPE"]
-				if exists == false {
-					err = fmt.Errorf("Media tag MUST include type information")
-					return
-				}
-
-				if val != MediaAudio && val != MediaVideo && val != MediaSubtitles && val != MediaCaptions {
-					err = fmt.Errorf("invalid media type %q", val)
-					return
-				}
-
-				if _, exists = attributes["GROUP-ID"]; exists == false {
-					err = fmt.Errorf("Media tag MUST include group id")
-					return
-				}
-
-				if _, exists = attributes["NAME"]; exists == false {
-					err = fmt.Errorf("Media tag MUST include name")
-					return
-				}
-
-				if _, exist := attributes["INSTREAM-ID"]; exist == false && val == MediaCaptions {
-					err = fmt.Errorf("Media tag MUST contain instream id if media type is closed captions")
-					return
-				} else if exist == false && val == MediaCaptions {
-					err = fmt.Errorf("Media tag MUST NOT contain instead id if media type is not closed captions")
-					return
-				}
-
-				// Set default values for assumption
-				rend.Default = MediaDefaultNO
-				rend.AutoSelect = MediaDefaultNO
-				rend.Forced = MediaDefaultNO
-
-				for attrib, value := range attributes {
-					switch attrib {
-					case "TYPE":
-						rend.Type = value
-					case "URI":
-						if val == MediaCaptions {
-							err = fmt.Errorf("URI cannot exist with type defined as %q", MediaCaptions)
-						} else {
-							_, err = fmt.Sscanf(value, "%q", &rend.URI)
-						}
-					case "GROUP-ID":
-						_, err = fmt.Sscanf(value, "%q", &rend.GroupID)
-					case "LANGUAGE":
-						_, err = fmt.Sscanf(value, "%q", &rend.Language)
-					case "ASSOC-LANGUAGE":
-						_, err = fmt.Sscanf(value, "%q", &rend.AssocLanguage)
-					case "NAME":
-						_, err = fmt.Sscanf(value, "%q", &rend.Name)
-					case "DEFAULT":
-						if value != MediaDefaultNO && value != MediaDefaultYES {
-							err = fmt.Errorf("invalid media default value %q", value)
-						}
-						rend.Default = value
-					case "AUTOSELECT":
-						if value != MediaDefaultNO && value != MediaDefaultYES {
-							err = fmt.Errorf("invalid media autoselect value %q", value)
-						}
-						rend.AutoSelect = value
-					case "FORCED":
-						if value != MediaDefaultNO && value != MediaDefaultYES {
-							err = fmt.Errorf("invalid media forced value %q", value)
-						}
-						rend.Forced = value
-					case "INSTREAM-ID":
-						match := regexp.MustCompile(instreamRegex).FindStringSubmatch(value)
-						if match == nil {
-							err = fmt.Errorf("invalid instream id value %q", value)
-							return
-						}
-						rend.InstreamID = match[1]
-					case "CHARACTERISTICS":
-						// TODO: Properly parse this (it's comma-separated)
-						_, err = fmt.Sscanf(value, "%q", &rend.Characteristics)
-					case "CHANNELS":
-						// TODO: Properly parse this (it's backslash-separated)
-						_, err = fmt.Sscanf(value, "%q", &rend.Channels)
-					}
-
-					if err != nil {
-						err = fmt.Errorf("error parsing Rendition attribute %s: %w", attrib, err)
-						return
-					}
-				}
-				playlist.Renditions = append(playlist.Renditions, *rend)
-			case "EXT-X-STREAM-INF": // 4.3.4.2
-				variant := new(Variant)
-				attributes := parseAttributes(results[2])
-
-				// Bandwidth is a required argument
-				if _, exists := attributes["BANDWIDTH"]; exists == false {
-					err = fmt.Errorf("Variant stream MUST include bandwidth information")
-					return
-				}
-
-				for attrib, value := range attributes {
-					switch attrib {
-					case "PROGRAM-ID":
-						_, err = fmt.Sscanf(value, "%d", &variant.ProgramID)
-					case "BANDWIDTH":
-						_, err = fmt.Sscanf(value, "%d", &variant.Bandwidth)
-					case "AVERAGE-BANDWIDTH":
-						_, err = fmt.Sscanf(value, "%d", &variant.BandwidthAvg)
-					case "CODECS":
-						_, err = fmt.Sscanf(value, "%q", &variant.Codecs)
-					case "RESOLUTION":
-						_, err = fmt.Sscanf(value, "%dx%d", &variant.Resolution.Width, &variant.Resolution.Height)
-					case "FRAME-RATE":
-						_, err = fmt.Sscanf(value, "%f", &variant.FrameRate)
-					case "HDCP-LEVEL":
-						variant.HDCPLevel = value
-						if variant.HDCPLevel != HDCPLevel0 && variant.HDCPLevel != HDCPLevelNone {
-							err = fmt.Errorf("invalid enum for %s: %q", attrib, value)
-							return
-						}
-					case "AUDIO":
-						_, err = fmt.Sscanf(value, "%q", &variant.Audio)
-					case "VIDEO":
-						_, err = fmt.Sscanf(value, "%q", &variant.Video)
-					case "SUBTITLES":
-						_, err = fmt.Sscanf(value, "%q", &variant.Subtitles)
-					case "CLOSED-CAPTIONS":
-						if value == CCNone {
-							variant.ClosedCaptions = CCNone
-						} else {
-							_, err = fmt.Sscanf(value, "%q", &variant.ClosedCaptions)
-						}
-					}
-
-					if err != nil {
-						err = fmt.Errorf("error parsing Variant attribute %s: %w", attrib, err)
-						return
-					}
-				}
-				variant.URI = lines[i+1]
-				playlist.Variants = append(playlist.Variants, *variant)
-			case "EXT-X-I-FRAME-STREAM-INF": // 4.3.4.3
-				variant := new(IVariant)
-				attributes := parseAttributes(results[2])
-
-				for attrib, value := range attributes {
-					switch attrib {
-					case "BANDWIDTH":
-						_, err = fmt.Sscanf(value, "%d", &variant.Bandwidth)
-					case "AVERAGE-BANDWIDTH":
-						_, err = fmt.Sscanf(value, "%d", &variant.BandwidthAvg)
-					case "CODECS":
-						_, err = fmt.Sscanf(value, "%q", &variant.Codecs)
-					case "RESOLUTION":
-						_, err = fmt.Sscanf(value, "%dx%d", &variant.Resolution.Width, &variant.Resolution.Height)
-					case "HDCP-LEVEL":
-						switch value {
-						case HDCPLevel0:
-						case HDCPLevelNone:
-						default:
-							err = fmt.Errorf("invalid enum for %s: %q", attrib, value)
-						}
-
-						variant.HDCPLevel = value
-						if variant.HDCPLevel != HDCPLevel0 && variant.HDCPLevel != HDCPLevelNone {
-							err = fmt.Errorf("invalid enum for %s: %q", attrib, value)
-							return
-						}
-					case "VIDEO":
-						_, err = fmt.Sscanf(value, "%q", &variant.Video)
-					case "URI":
-						_, err = fmt.Sscanf(value, "%q", &variant.URI)
-					}
-
-					if err != nil {
-						err = fmt.Errorf("error parsing IVariant attribute %s: %w", attrib, err)
-						return
-					}
-				}
-
-				if variant.Bandwidth == 0 || variant.URI == "" {
-					err = fmt.Errorf("IVariant stream MUST include uri and bandwidth information")
-					return
-				}
-				playlist.IVariants = append(playlist.IVariants, *variant)
-			case "EXT-X-SESSION-DATA": // 4.3.4.4
-				session := new(SessionData)
-				attributes := parseAttributes(results[2])
-				if _, exists := attributes["DATA-ID"]; exists == false {
-					err = fmt.Errorf("session data MUST include a data id")
-					return
-				}
-
-				for attrib, value := range attributes {
-					switch attrib {
-					case "DATA-ID":
-						_, err = fmt.Sscanf(value, "%q", &session.DataID)
-					case "VALUE":
-						_, err = fmt.Sscanf(value, "%q", &session.Value)
-					case "URI":
-						_, err = fmt.Sscanf(value, "%q", &session.URI)
-					case "LANGUAGE":
-						_, err = fmt.Sscanf(value, "%q", &session.Language)
-					}
-
-					if err != nil {
-						err = fmt.Errorf("error parsing session data attribute %s: %w", attrib, err)
-						return
-					}
-				}
-
-				if session.URI != "" || session.Value != "" {
-					if session.URI != "" && session.Value != "" {
-						err = fmt.Errorf("URI and VALUE attributes are mutually exclusive, cannot contain both")
-						return
-					}
-				}
-				playlist.SessionData = append(playlist.SessionData, *session)
-			case "EXT-X-SESSION-KEY": // 4.3.4.5
-				playlist.SessionKey, err = parseKey(results[2])
-			case "EXT-X-INDEPENDENT-SEGMENTS": // 4.3.5.1
-				playlist.Independent = true
-			case "EXT-X-START": // 4.3.5.2
-				attributes := parseAttributes(results[2])
-				if value, _ := attributes["PRECISE"]; value == PreciseYes {
-					playlist.Precise = true
-				}
-
-				if value, exists := attributes["TIME-OFFSET"]; exists {
-					_, err = fmt.Sscanf(value, "%f", &playlist.TimeOffset)
-				}
-			case "EXT-X-VERSION": // 4.3.1.2
-				if playlist.Version != 0 { // It has been already set, but there cannot be more than one EXT-X-VERSION tag per playlist
-					err = fmt.Errorf("master playlist contains more than one %s", results[1])
-					return
-				}
-
-				if _, err = fmt.Sscanf(results[2], "%d", &playlist.Version); err != nil {
-					err = fmt.Errorf("parsing %s to integer: %w", results[1], err)
-					return
-				}
+// masterDecoder decodes a master playlist one line at a time
+type masterDecoder struct {
+	playlist *MasterPlaylist
+	variant  *Variant // the variant waiting for its URI
+	tags     []Tag    // the unknown tags and comments seen since the last variant or rendition
+}
+
+func newMasterDecoder() *masterDecoder {
+	return &masterDecoder{playlist: new(MasterPlaylist)}
+}
+
+func (m *masterDecoder) line(line string) (err error) {
+	name, value, isTag := splitTag(line)
+	if !isTag {
+		// 4.3.4.2 - The URI line comes after EXT-X-STREAM-INF
+		if strings.HasPrefix(line, "#") {
+			m.tags = append(m.tags, Tag{Value: line[1:]})
+		} else if m.variant != nil {
+			m.variant.URI, m.variant.Tags = line, m.tags
+			m.playlist.Variants = append(m.playlist.Variants, *m.variant)
+			m.variant, m.tags = nil, nil
+		}
+		return nil
+	}
+
+	playlist := m.playlist
+	switch name {
+	case "EXT-X-TARGETDURATION", "EXT-X-MEDIA-SEQUENCE", "EXT-X-DISCONTINUITY-SEQUENCE", "EXT-X-ENDLIST", "EXT-X-PLAYLIST-TYPE", "EXT-X-I-FRAMES-ONLY":
+		return fmt.Errorf("found media playlists tags in master playlist")
+	case "EXT-X-MEDIA":
+		var rend *Rendition
+		if rend, err = parseRendition(value); err != nil {
+			return err
+		}
+		rend.Tags, m.tags = m.tags, nil
+		playlist.Renditions = append(playlist.Renditions, *rend)
+	case "EXT-X-STREAM-INF": // 4.3.4.2
+		if m.variant != nil {
+			return fmt.Errorf("variant stream is not followed by a URI")
+		}
+
+		if m.variant, err = parseVariant(value); err != nil {
+			return err
+		}
+	case "EXT-X-I-FRAME-STREAM-INF": // 4.3.4.3
+		variant := new(IVariant)
+		var attributes map[string]Attribute
+		if attributes, err = parseAttributes(value); err != nil {
+			return fmt.Errorf("parsing IVariant attributes: %w", err)
+		}
+
+		for attrib, value := range attributes {
+			if err = variant.parseAttribute(attrib, value); err == nil && attrib == "URI" {
+				variant.URI, err = value.Quoted()
+			}
+
+			if err != nil {
+				return fmt.Errorf("error parsing IVariant attribute %s: %w", attrib, err)
+			}
+		}
+
+		if variant.Bandwidth == 0 || variant.URI == "" {
+			return fmt.Errorf("IVariant stream MUST include uri and bandwidth information")
+		}
+		variant.Tags, m.tags = m.tags, nil
+		playlist.IVariants = append(playlist.IVariants, *variant)
+	case "EXT-X-SESSION-DATA": // 4.3.4.4
+		session := new(SessionData)
+		var attributes map[string]Attribute
+		if attributes, err = parseAttributes(value); err != nil {
+			return fmt.Errorf("parsing session data attributes: %w", err)
+		}
+
+		if _, exists := attributes["DATA-ID"]; exists == false {
+			return fmt.Errorf("session data MUST include a data id")
+		}
+
+		for attrib, value := range attributes {
+			switch attrib {
+			case "DATA-ID":
+				session.DataID, err = value.Quoted()
+			case "VALUE":
+				session.Value, err = value.Quoted()
+			case "URI":
+				session.URI, err = value.Quoted()
+			case "LANGUAGE":
+				session.Language, err = value.Quoted()
+			}
+
+			if err != nil {
+				return fmt.Errorf("error parsing session data attribute %s: %w", attrib, err)
 			}
 		}
+
+		if session.URI != "" && session.Value != "" {
+			return fmt.Errorf("URI and VALUE attributes are mutually exclusive, cannot contain both")
+		}
+		playlist.SessionData = append(playlist.SessionData, *session)
+	case "EXT-X-SESSION-KEY": // 4.3.4.5
+		if playlist.SessionKey, err = parseKey(value); err != nil {
+			return fmt.Errorf("parsing session key: %w", err)
+		}
+	case "EXT-X-INDEPENDENT-SEGMENTS": // 4.3.5.1
+		playlist.Independent = true
+	case "EXT-X-START": // 4.3.5.2
+		if playlist.TimeOffset, playlist.Precise, err = parseStart(value); err != nil {
+			return fmt.Errorf("parsing %s: %w", name, err)
+		}
+	case "EXT-X-VERSION": // 4.3.1.2
+		if playlist.Version != 0 { // It has been already set, but there cannot be more than one EXT-X-VERSION tag per playlist
+			return fmt.Errorf("master playlist contains more than one %s", name)
+		}
+
+		if _, err = fmt.Sscanf(value, "%d", &playlist.Version); err != nil {
+			return fmt.Errorf("parsing %s to integer: %w", name, err)
+		}
+	default:
+		// 4.1 - Unknown tags are ignored, but they are kept for the next variant or rendition
+		var tag Tag
+		if tag, err = parseTag(name, value); err != nil {
+			return err
+		}
+		m.tags = append(m.tags, tag)
+	}
+	return nil
+}
+
+func (m *masterDecoder) finish() (Playlist, error) {
+	if m.variant != nil {
+		return nil, fmt.Errorf("variant stream is not followed by a URI")
+	}
+
+	// Tags after the last variant or rendition belong to the playlist
+	m.playlist.Tags = m.tags
+	m.playlist.VariantCount = len(m.playlist.Variants) + len(m.playlist.IVariants)
+	return m.playlist, nil
+}
+
+// yesNo returns the value of an enumerated-string that is either YES or NO
+func yesNo(value Attribute) (string, error) {
+	enum, err := value.Enum()
+	if err == nil && enum != MediaDefaultNO && enum != MediaDefaultYES {
+		err = fmt.Errorf("invalid %s value %q", strings.ToLower(value.Name), enum)
+	}
+	return enum, err
+}
+
+func parseRendition(attrib string) (*Rendition, error) { // 4.3.4.1
+	attributes, err := parseAttributes(attrib)
+	if err != nil {
+		return nil, fmt.Errorf("parsing rendition attributes: %w", err)
+	}
+
+	typ, exists := attributes["TYPE"]
+	if exists == false {
+		return nil, fmt.Errorf("Media tag MUST include type information")
+	}
+
+	val := typ.Value
+	if val != MediaAudio && val != MediaVideo && val != MediaSubtitles && val != MediaCaptions {
+		return nil, fmt.Errorf("invalid media type %q", val)
+	}
+
+	if _, exists = attributes["GROUP-ID"]; exists == false {
+		return nil, fmt.Errorf("Media tag MUST include group id")
+	}
+
+	if _, exists = attributes["NAME"]; exists == false {
+		return nil, fmt.Errorf("Media tag MUST include name")
+	}
+
+	if _, exists = attributes["INSTREAM-ID"]; exists == false && val == MediaCaptions {
+		return nil, fmt.Errorf("Media tag MUST contain instream id if media type is closed captions")
+	}
+
+	// Set default values for assumption
+	rend := &Rendition{Default: MediaDefaultNO, AutoSelect: MediaDefaultNO, Forced: MediaDefaultNO}
+	for attrib, value := range attributes {
+		switch attrib {
+		case "TYPE":
+			rend.Type, err = value.Enum()
+		case "URI":
+			if val == MediaCaptions {
+				err = fmt.Errorf("URI cannot exist with type defined as %q", MediaCaptions)
+			} else {
+				rend.URI, err = value.Quoted()
+			}
+		case "GROUP-ID":
+			rend.GroupID, err = value.Quoted()
+		case "LANGUAGE":
+			rend.Language, err = value.Quoted()
+		case "ASSOC-LANGUAGE":
+			rend.AssocLanguage, err = value.Quoted()
+		case "NAME":
+			rend.Name, err = value.Quoted()
+		case "DEFAULT":
+			rend.Default, err = yesNo(value)
+		case "AUTOSELECT":
+			rend.AutoSelect, err = yesNo(value)
+		case "FORCED":
+			rend.Forced, err = yesNo(value)
+		case "INSTREAM-ID":
+			if rend.InstreamID, err = value.Quoted(); err == nil && !instreamPattern.MatchString(rend.InstreamID) {
+				err = fmt.Errorf("invalid instream id value %q", rend.InstreamID)
+			}
+		case "CHARACTERISTICS":
+			// TODO: Properly parse this (it's comma-separated)
+			rend.Characteristics, err = value.Quoted()
+		case "CHANNELS":
+			// TODO: Properly parse this (it's backslash-separated)
+			rend.Channels, err = value.Quoted()
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Rendition attribute %s: %w", attrib, err)
+		}
+	}
+	return rend, nil
+}
+
+// parseAttribute parses the attributes shared by EXT-X-STREAM-INF and EXT-X-I-FRAME-STREAM-INF
+func (v *IVariant) parseAttribute(attrib string, value Attribute) (err error) {
+	switch attrib {
+	case "BANDWIDTH":
+		v.Bandwidth, err = value.Integer()
+	case "AVERAGE-BANDWIDTH":
+		v.BandwidthAvg, err = value.Integer()
+	case "CODECS":
+		v.Codecs, err = value.Quoted()
+	case "RESOLUTION":
+		v.Resolution, err = value.Resolution()
+	case "HDCP-LEVEL":
+		if v.HDCPLevel, err = value.Enum(); err == nil && v.HDCPLevel != HDCPLevel0 && v.HDCPLevel != HDCPLevelNone {
+			err = fmt.Errorf("invalid enum for %s: %q", attrib, value.Value)
+		}
+	case "VIDEO":
+		v.Video, err = value.Quoted()
 	}
-	playlist.VariantCount = len(playlist.Variants) + len(playlist.IVariants)
 	return
 }
+
+func parseVariant(attrib string) (*Variant, error) { // 4.3.4.2
+	attributes, err := parseAttributes(attrib)
+	if err != nil {
+		return nil, fmt.Errorf("parsing variant attributes: %w", err)
+	}
+
+	// Bandwidth is a required argument
+	if _, exists := attributes["BANDWIDTH"]; exists == false {
+		return nil, fmt.Errorf("Variant stream MUST include bandwidth information")
+	}
+
+	variant := new(Variant)
+	for attrib, value := range attributes {
+		switch attrib {
+		case "PROGRAM-ID":
+			var id int64
+			id, err = value.Integer()
+			variant.ProgramID = int(id)
+		case "FRAME-RATE":
+			variant.FrameRate, err = value.float32()
+		case "AUDIO":
+			variant.Audio, err = value.Quoted()
+		case "SUBTITLES":
+			variant.Subtitles, err = value.Quoted()
+		case "CLOSED-CAPTIONS":
+			if value.Type == ValueEnum && value.Value == CCNone {
+				variant.ClosedCaptions = CCNone
+			} else {
+				variant.ClosedCaptions, err = value.Quoted()
+			}
+		default:
+			err = variant.parseAttribute(attrib, value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Variant attribute %s: %w", attrib, err)
+		}
+	}
+	return variant, nil
+}
@@ -2,117 +2,217 @@ package m3u8
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"regexp"
 	"strings"
+	"time"
 )
 
-// Map represents
+// Map represents the media initialization section of a segment
 type Map struct { // 4.3.2.5
-	URI       string
-	ByteRange string
+	URI       string `json:"uri"`
+	ByteRange string `json:"byte_range,omitempty"`
+}
+
+// Range returns the length and offset of the BYTERANGE of the section,
+// or a length of 0 if it has none. The offset defaults to 0
+func (m *Map) Range() (length, offset int, err error) {
+	if m.ByteRange == "" {
+		return 0, 0, nil
+	}
+
+	if _, err := fmt.Sscanf(m.ByteRange, "%d@%d", &length, &offset); err != nil {
+		offset = 0
+		if _, err := fmt.Sscanf(m.ByteRange, "%d", &length); err != nil {
+			return 0, 0, fmt.Errorf("parsing map byte range %q: %w", m.ByteRange, err)
+		}
+	}
+
+	if length <= 0 || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid map byte range %q", m.ByteRange)
+	}
+	return length, offset, nil
 }
 
 // Key contains information for decrypting encrypted segments
 type Key struct { // 4.3.2.4
-	Method      string
-	URI         string
-	IV          string
-	KeyFormat   string
-	KeyVersions string
-	Value       []byte
+	Method      string `json:"method"`
+	URI         string `json:"uri,omitempty"`
+	IV          string `json:"iv,omitempty"` // raw bytes, encoded as hexadecimal in JSON
+	KeyFormat   string `json:"key_format,omitempty"`
+	KeyVersions string `json:"key_format_versions,omitempty"`
+	Value       []byte `json:"-"` // set by whoever loads the key, such as hls.Downloader.LoadKey
 }
 
-// Load loads the key into the Value field, using
-// client as the request client and base and a base url if necessary
-func (k *Key) Load(client *http.Client, base string) error {
-	if k.Method != CryptAES {
-		if k.Method == CryptNone {
-			k.Value = EmptyKey
-			return nil
-		}
-		return fmt.Errorf("this parser does not yet support aes sample keys")
-	}
+// DateRange associates a range of time with a set of attributes, such as an ad break
+type DateRange struct { // 4.3.2.7
+	ID              string            `json:"id"`
+	Class           string            `json:"class,omitempty"`
+	StartDate       time.Time         `json:"start_date"`
+	EndDate         time.Time         `json:"end_date,omitempty"`
+	Duration        float32           `json:"duration,omitempty"`
+	PlannedDuration float32           `json:"planned_duration,omitempty"`
+	SCTE35Cmd       string            `json:"scte35_cmd,omitempty"` // hexadecimal-sequence, including the 0x prefix
+	SCTE35Out       string            `json:"scte35_out,omitempty"`
+	SCTE35In        string            `json:"scte35_in,omitempty"`
+	EndOnNext       bool              `json:"end_on_next,omitempty"`
+	ClientAttrs     map[string]string `json:"client_attributes,omitempty"` // X- attributes, with quotes kept on quoted strings
+}
 
-	resp, err := client.Get(k.URI)
+func parseDateRange(attrib string) (dateRange DateRange, err error) {
+	attributes, err := parseAttributes(attrib)
 	if err != nil {
-		return fmt.Errorf("getting key response: %w", err)
+		return dateRange, err
 	}
 
-	defer resp.Body.Close()
-	k.Value, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("getting key bytes: %w", err)
+	for name, value := range attributes {
+		switch name {
+		case "ID":
+			dateRange.ID, err = value.Quoted()
+		case "CLASS":
+			dateRange.Class, err = value.Quoted()
+		case "START-DATE", "END-DATE":
+			var date string
+			if date, err = value.Quoted(); err == nil {
+				var parsed time.Time
+				if parsed, err = ParseDateTime(date); name == "START-DATE" {
+					dateRange.StartDate = parsed
+				} else {
+					dateRange.EndDate = parsed
+				}
+			}
+		case "DURATION":
+			dateRange.Duration, err = value.float32()
+		case "PLANNED-DURATION":
+			dateRange.PlannedDuration, err = value.float32()
+		case "SCTE35-CMD", "SCTE35-OUT", "SCTE35-IN":
+			if value.Type != ValueHex {
+				err = value.typeError("a hexadecimal-sequence")
+			} else if name == "SCTE35-CMD" {
+				dateRange.SCTE35Cmd = value.Value
+			} else if name == "SCTE35-OUT" {
+				dateRange.SCTE35Out = value.Value
+			} else {
+				dateRange.SCTE35In = value.Value
+			}
+		case "END-ON-NEXT":
+			var enum string
+			enum, err = value.Enum()
+			dateRange.EndOnNext = enum == PreciseYes
+		default:
+			if strings.HasPrefix(name, "X-") {
+				if dateRange.ClientAttrs == nil {
+					dateRange.ClientAttrs = make(map[string]string)
+				}
+
+				if value.Type == ValueString {
+					dateRange.ClientAttrs[name] = `"` + value.Value + `"`
+				} else {
+					dateRange.ClientAttrs[name] = value.Value
+				}
+			}
+		}
+
+		if err != nil {
+			return dateRange, fmt.Errorf("parsing date range attribute %s: %w", name, err)
+		}
 	}
-	return nil
+
+	if dateRange.ID == "" || dateRange.StartDate.IsZero() {
+		return dateRange, fmt.Errorf("ID and START-DATE are REQUIRED")
+	}
+	return dateRange, nil
 }
 
 // Segment represents an individual media segment from a MediaPlaylist
 type Segment struct { // 4.3.2
-	URI           string
-	Duration      float32
-	Title         string
-	ByteRange     int
-	Offset        int
-	Discontinuity bool
-	DateTime      string
-	KeyIndex      int
-	Map           *Map
-	// TODO: 4.3.2.7.  EXT-X-DATERANGE
+	URI           string      `json:"uri"`
+	Duration      float32     `json:"duration"`
+	Title         string      `json:"title,omitempty"`
+	ByteRange     int         `json:"byte_range,omitempty"`
+	Offset        int         `json:"offset,omitempty"`
+	Discontinuity bool        `json:"discontinuity,omitempty"`
+	DateTime      time.Time   `json:"program_date_time,omitempty"`
+	KeyIndex      int         `json:"key_index"`
+	Map           *Map        `json:"map,omitempty"`         // only set on the first segment after EXT-X-MAP, see MapAt
+	DateRanges    []DateRange `json:"date_ranges,omitempty"` // the date ranges that appear before the segment
+	Tags          []Tag       `json:"tags,omitempty"`        // unknown tags and comments that appear before the segment
 }
 
 // MediaPlaylist represents a MediaPlaylist M3U8 file
 type MediaPlaylist struct { // 4.3.3
-	Segments         []*Segment
-	Keys             []*Key
-	TargetDuration   int64
-	MediaSequence    int64
-	DiscontinuitySeq int64 // defaults to 0
-	PType            string
-	IFramesOnly      bool
-	Independent      bool
-	TimeOffset       float32
-	Precise          bool
-	Version          int
+	Segments         []*Segment `json:"segments"`
+	Keys             []*Key     `json:"keys,omitempty"`
+	TargetDuration   int64      `json:"target_duration"`
+	MediaSequence    int64      `json:"media_sequence"`
+	DiscontinuitySeq int64      `json:"discontinuity_sequence"` // defaults to 0
+	PType            string     `json:"playlist_type,omitempty"`
+	EndList          bool       `json:"end_list"` // no more segments will be added to the playlist
+	IFramesOnly      bool       `json:"i_frames_only,omitempty"`
+	Independent      bool       `json:"independent_segments,omitempty"`
+	TimeOffset       float32    `json:"time_offset,omitempty"`
+	Precise          bool       `json:"precise,omitempty"`
+	Version          int        `json:"version,omitempty"`
+	Tags             []Tag      `json:"tags,omitempty"` // unknown tags and comments after the last segment
 }
 
-// Type returns media playlist type
-func (m *MediaPlaylist) Type() int {
-	return TypeMedia
+// MapAt returns the media initialization section that applies to the segment
+// at index i. EXT-X-MAP applies to every segment after it until the next one,
+// but Map is only set on the first of them. nil means no media initialization
+// section applies, as with MPEG-TS
+func (m *MediaPlaylist) MapAt(i int) *Map {
+	for ; i >= 0; i-- {
+		if init := m.Segments[i].Map; init != nil {
+			return init
+		}
+	}
+	return nil
 }
 
-func parseAttributes(line string) map[string]string { // 4.2
-	attribs := make(map[string]string)
-	linePattern := regexp.MustCompile(attrRegex)
-	if matches := linePattern.FindAllStringSubmatch(line, -1); matches != nil {
-		for _, arr := range matches {
-			attribs[arr[1]] = arr[2] // strings.Trim(arr[2], "\"")
+// ByteOffsets returns where the byte range of every segment starts. A byte
+// range without an offset starts where the previous one of the same resource
+// ended. The playlist does not keep an explicit offset of 0, so one directly
+// after a range of the same resource is treated as if it had no offset
+func (m *MediaPlaylist) ByteOffsets() []int {
+	offsets := make([]int, len(m.Segments))
+	for i, segment := range m.Segments {
+		offsets[i] = segment.Offset
+		if i > 0 && segment.Offset == 0 && segment.ByteRange != 0 {
+			if prev := m.Segments[i-1]; prev.ByteRange != 0 && prev.URI == segment.URI {
+				offsets[i] = offsets[i-1] + prev.ByteRange
+			}
 		}
 	}
-	return attribs
+	return offsets
+}
+
+// Type returns media playlist type
+func (m *MediaPlaylist) Type() int {
+	return TypeMedia
 }
 
 func parseKey(attrib string) (*Key, error) {
 	key := new(Key)
-	attributes := parseAttributes(attrib)
+	attributes, err := parseAttributes(attrib)
+	if err != nil {
+		return nil, err
+	}
 
 	for attrib, value := range attributes {
-		var err error
 		switch attrib {
 		case "METHOD":
-			if value != CryptNone && value != CryptAES && value != CryptSampleAES {
-				return nil, fmt.Errorf("invalid key METHOD value %q", value)
+			key.Method, err = value.Enum()
+			if err == nil && key.Method != CryptNone && key.Method != CryptAES && key.Method != CryptSampleAES {
+				return nil, fmt.Errorf("invalid key METHOD value %q", key.Method)
 			}
-			key.Method = value
 		case "URI":
-			_, err = fmt.Sscanf(value, "%q", &key.URI)
+			key.URI, err = value.Quoted()
 		case "IV":
-			_, err = fmt.Sscanf(value, "%X", &key.IV)
+			var iv []byte
+			iv, err = value.Hex()
+			key.IV = string(iv)
 		case "KEYFORMAT":
-			_, err = fmt.Sscanf(value, "%q", &key.KeyFormat)
+			key.KeyFormat, err = value.Quoted()
 		case "KEYFORMATVERSIONS":
-			_, err = fmt.Sscanf(value, "%q", &key.KeyVersions)
+			key.KeyVersions, err = value.Quoted()
 		}
 
 		if err != nil {
@@ -126,139 +226,181 @@ func parseKey(attrib string) (*Key, error) {
 	return key, nil
 }
 
-func parseMediaSegment(lines []string, last, current, keyIndex int) (segment Segment, err error) {
-	segment.URI = lines[current]
-	segment.KeyIndex = keyIndex
-
-	for i := last; i < current; i++ {
-		results := regexp.MustCompile(tagRegex).FindStringSubmatch(lines[i])
-		if results != nil {
-			switch results[1] {
-			case "EXTINF": // 4.3.2.1
-				options := strings.Split(results[2], ",")
-				if _, err = fmt.Sscanf(options[0], "%f", &segment.Duration); err == nil && len(options) > 1 && options[1] != "" {
-					segment.Title = options[1]
-				}
-			case "EXT-X-BYTERANGE": // 4.3.2.2
-				options := strings.Split(results[2], "@")
-				if _, err = fmt.Sscanf(options[0], "%d", &segment.ByteRange); err == nil && len(options) > 1 {
-					_, err = fmt.Sscanf(options[1], "%d", &segment.Offset)
-				}
-			case "EXT-X-DISCONTINUITY": // 4.3.2.3
-				segment.Discontinuity = true
-			//case "EXT-X-KEY": // 4.3.2.4
-			case "EXT-X-MAP": // 4.3.2.5
-				init := new(Map)
-				attributes := parseAttributes(results[2])
-
-				if uri, exists := attributes["URI"]; exists == false {
-					_, err = fmt.Sscanf(uri, "%q", &init.URI)
-				} else {
-					err = fmt.Errorf("URI is REQUIRED")
-					return
-				}
+// parseStart parses the attributes of EXT-X-START, which is the same in both playlist types
+func parseStart(attrib string) (offset float32, precise bool, err error) { // 4.3.5.2
+	attributes, err := parseAttributes(attrib)
+	if err != nil {
+		return 0, false, err
+	}
 
-				if byteRange, exists := attributes["BYTERANGE"]; exists == true {
-					_, err = fmt.Sscanf(byteRange, "%q", &init.ByteRange)
-				}
-				segment.Map = init
-			case "EXT-X-PROGRAM-DATE-TIME": // 4.3.2.6
-				segment.DateTime = results[2]
-			}
-		}
+	value, exists := attributes["TIME-OFFSET"]
+	if !exists {
+		return 0, false, fmt.Errorf("TIME-OFFSET is REQUIRED")
+	}
 
-		if err != nil {
-			err = fmt.Errorf("parsing segment attribute %q: %w", results[1], err)
-			return
+	if offset, err = value.float32(); err != nil {
+		return 0, false, err
+	}
+
+	if value, exists := attributes["PRECISE"]; exists {
+		var enum string
+		if enum, err = value.Enum(); err != nil {
+			return 0, false, err
 		}
+		precise = enum == PreciseYes
 	}
-	return
+	return offset, precise, nil
 }
 
-func parseMediaPlaylist(lines []string) (playlist *MediaPlaylist, err error) {
-	playlist = new(MediaPlaylist)
-	var (
-		hasDuration bool
-		hasEndlist  bool
-		lastSegment int
-		keyIndex    = -1 // EXT-X-KEY will always appear before the URL, so we start at -1 becuase keyIndex will increment before parseMediaSegment is called
-	)
-
-	for i, line := range lines {
-		if hasEndlist {
-			break
+func parseMap(attrib string) (*Map, error) { // 4.3.2.5
+	attributes, err := parseAttributes(attrib)
+	if err != nil {
+		return nil, err
+	}
+
+	uri, exists := attributes["URI"]
+	if !exists {
+		return nil, fmt.Errorf("URI is REQUIRED")
+	}
+
+	init := new(Map)
+	if init.URI, err = uri.Quoted(); err != nil {
+		return nil, err
+	}
+
+	if byteRange, exists := attributes["BYTERANGE"]; exists {
+		if init.ByteRange, err = byteRange.Quoted(); err != nil {
+			return nil, err
 		}
+	}
+	return init, nil
+}
 
-		results := regexp.MustCompile(tagRegex).FindStringSubmatch(line)
-		if results == nil { // it is a URL
-			segment, segErr := parseMediaSegment(lines, lastSegment, i, keyIndex)
-			if segErr != nil {
-				err = fmt.Errorf("making new segment: %w", segErr)
-				return
-			}
-			lastSegment = i
-			playlist.Segments = append(playlist.Segments, &segment)
-		} else {
-			switch results[1] {
-			case "EXT-X-MEDIA", "EXT-X-STREAM-INF", "EXT-X-I-FRAME-STREAM-INF", "EXT-X-SESSION-DATA", "EXT-X-SESSION-KEY":
-				err = fmt.Errorf("found master playlists tags in media playlist")
-			case "EXT-X-TARGETDURATION": // 4.3.3.1
-				hasDuration = true
-				_, err = fmt.Sscanf(results[2], "%d", &playlist.TargetDuration)
-			case "EXT-X-KEY":
-				// TODO: fix a lot of 4.3.2.4.  EXT-X-KEY weird stuff
-				key, err := parseKey(results[2])
-				if err != nil {
-					return nil, fmt.Errorf("parsing media playlist key: %w", err)
-				}
-				playlist.Keys = append(playlist.Keys, key)
-				keyIndex++
-			case "EXT-X-MEDIA-SEQUENCE": // 4.3.3.2
-				_, err = fmt.Sscanf(results[2], "%d", &playlist.MediaSequence)
-			case "EXT-X-DISCONTINUITY-SEQUENCE": // 4.3.3.3
-				_, err = fmt.Sscanf(results[2], "%d", &playlist.DiscontinuitySeq)
-			case "EXT-X-ENDLIST": // 4.3.3.4
-				hasEndlist = true
-			case "EXT-X-PLAYLIST-TYPE": // 4.3.3.5
-				if results[2] != PlaylistEvent && results[2] != PlaylistVOD {
-					err = fmt.Errorf("invalid playlist type enum: %s", results[2])
-				}
-				playlist.PType = results[2]
-			case "EXT-X-I-FRAMES-ONLY": // 4.3.3.6
-				playlist.IFramesOnly = true
-			case "EXT-X-INDEPENDENT-SEGMENTS": // 4.3.5.1
-				playlist.Independent = true
-			case "EXT-X-START": // 4.3.5.2
-				attributes := parseAttributes(results[2])
-
-				if value := attributes["PRECISE"]; value == PreciseYes {
-					playlist.Precise = true
-				}
+// mediaDecoder decodes a media playlist one line at a time
+type mediaDecoder struct {
+	playlist    *MediaPlaylist
+	segment     Segment // the tags seen since the last segment
+	keyIndex    int
+	hasDuration bool
+	onSegment   func(*MediaPlaylist, *Segment) error
+}
 
-				if value, exists := attributes["TIME-OFFSET"]; exists {
-					_, err = fmt.Sscanf(value, "%f", &playlist.TimeOffset)
-				}
-			case "EXT-X-VERSION": // 4.3.1.2
-				if playlist.Version != 0 { // It has been already set, but there cannot be more than one EXT-X-VERSION tag per playlist
-					err = fmt.Errorf("media playlist contains more than one %s tag", results[1])
-					return
-				}
+func newMediaDecoder(onSegment func(*MediaPlaylist, *Segment) error) *mediaDecoder {
+	// EXT-X-KEY will always appear before the URL, so we start at -1 because keyIndex will increment before the segment is added
+	return &mediaDecoder{playlist: new(MediaPlaylist), keyIndex: -1, onSegment: onSegment}
+}
 
-				if _, err = fmt.Sscanf(results[2], "%d", &playlist.Version); err != nil {
-					err = fmt.Errorf("parsing %s to integer: %w", results[1], err)
-				}
-			}
+func (m *mediaDecoder) line(line string) (err error) {
+	// Anything after the end of the playlist is ignored
+	if m.playlist.EndList {
+		return nil
+	}
+
+	name, value, isTag := splitTag(line)
+	if !isTag {
+		if strings.HasPrefix(line, "#") { // 4.1 - Lines that start with # and not #EXT are comments
+			m.segment.Tags = append(m.segment.Tags, Tag{Value: line[1:]})
+			return nil
+		}
+		return m.addSegment(line)
+	}
 
-			if err != nil {
-				err = fmt.Errorf("error parsing Variant attribute %q: %w", results[1], err)
-				return
+	playlist, segment := m.playlist, &m.segment
+	switch name {
+	case "EXT-X-MEDIA", "EXT-X-STREAM-INF", "EXT-X-I-FRAME-STREAM-INF", "EXT-X-SESSION-DATA", "EXT-X-SESSION-KEY":
+		return fmt.Errorf("found master playlists tags in media playlist")
+	case "EXTINF": // 4.3.2.1
+		options := strings.SplitN(value, ",", 2)
+		if _, err = fmt.Sscanf(options[0], "%f", &segment.Duration); err == nil && len(options) > 1 {
+			segment.Title = options[1]
+		}
+	case "EXT-X-BYTERANGE": // 4.3.2.2
+		options := strings.Split(value, "@")
+		if _, err = fmt.Sscanf(options[0], "%d", &segment.ByteRange); err == nil && len(options) > 1 {
+			_, err = fmt.Sscanf(options[1], "%d", &segment.Offset)
+		}
+	case "EXT-X-DISCONTINUITY": // 4.3.2.3
+		segment.Discontinuity = true
+	case "EXT-X-KEY": // 4.3.2.4
+		// TODO: fix a lot of 4.3.2.4.  EXT-X-KEY weird stuff
+		var key *Key
+		if key, err = parseKey(value); err == nil {
+			if m.onSegment != nil {
+				// Segments are not kept, so neither are the keys they used
+				playlist.Keys, m.keyIndex = []*Key{key}, 0
+			} else {
+				playlist.Keys = append(playlist.Keys, key)
+				m.keyIndex++
 			}
 		}
+	case "EXT-X-MAP": // 4.3.2.5
+		segment.Map, err = parseMap(value)
+	case "EXT-X-PROGRAM-DATE-TIME": // 4.3.2.6
+		segment.DateTime, err = ParseDateTime(value)
+	case "EXT-X-DATERANGE": // 4.3.2.7
+		var dateRange DateRange
+		if dateRange, err = parseDateRange(value); err == nil {
+			segment.DateRanges = append(segment.DateRanges, dateRange)
+		}
+	case "EXT-X-TARGETDURATION": // 4.3.3.1
+		m.hasDuration = true
+		_, err = fmt.Sscanf(value, "%d", &playlist.TargetDuration)
+	case "EXT-X-MEDIA-SEQUENCE": // 4.3.3.2
+		_, err = fmt.Sscanf(value, "%d", &playlist.MediaSequence)
+	case "EXT-X-DISCONTINUITY-SEQUENCE": // 4.3.3.3
+		_, err = fmt.Sscanf(value, "%d", &playlist.DiscontinuitySeq)
+	case "EXT-X-ENDLIST": // 4.3.3.4
+		playlist.EndList = true
+	case "EXT-X-PLAYLIST-TYPE": // 4.3.3.5
+		if value != PlaylistEvent && value != PlaylistVOD {
+			err = fmt.Errorf("invalid playlist type enum: %s", value)
+		}
+		playlist.PType = value
+	case "EXT-X-I-FRAMES-ONLY": // 4.3.3.6
+		playlist.IFramesOnly = true
+	case "EXT-X-INDEPENDENT-SEGMENTS": // 4.3.5.1
+		playlist.Independent = true
+	case "EXT-X-START": // 4.3.5.2
+		playlist.TimeOffset, playlist.Precise, err = parseStart(value)
+	case "EXT-X-VERSION": // 4.3.1.2
+		if playlist.Version != 0 { // It has been already set, but there cannot be more than one EXT-X-VERSION tag per playlist
+			return fmt.Errorf("media playlist contains more than one %s tag", name)
+		}
+		_, err = fmt.Sscanf(value, "%d", &playlist.Version)
+	default:
+		// 4.1 - Unknown tags are ignored, but they are kept for the next segment
+		var tag Tag
+		if tag, err = parseTag(name, value); err == nil {
+			segment.Tags = append(segment.Tags, tag)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+// addSegment adds a segment with the tags seen since the previous one, or
+// passes it to onSegment if it is set
+func (m *mediaDecoder) addSegment(uri string) error {
+	segment := m.segment
+	segment.URI, segment.KeyIndex = uri, m.keyIndex
+	m.segment = Segment{}
+
+	if m.onSegment != nil {
+		return m.onSegment(m.playlist, &segment)
 	}
+	m.playlist.Segments = append(m.playlist.Segments, &segment)
+	return nil
+}
 
-	if hasDuration == false {
-		err = fmt.Errorf("EXT-X-TARGETDURATION is a required field, but is missing")
-		return
+func (m *mediaDecoder) finish() (Playlist, error) {
+	if !m.hasDuration {
+		return nil, fmt.Errorf("EXT-X-TARGETDURATION is a required field, but is missing")
 	}
-	return
+
+	// Tags after the last segment belong to the playlist
+	m.playlist.Tags = m.segment.Tags
+	return m.playlist, nil
 }
@@ -0,0 +1,89 @@
+package m3u8
+
+// MediaSummary contains statistics computed from a MediaPlaylist
+type MediaSummary struct {
+	Segments          int     `json:"segments"`
+	Duration          float64 `json:"duration"`             // in seconds
+	MaxDuration       float64 `json:"max_segment_duration"` // in seconds
+	EncryptedSegments int     `json:"encrypted_segments"`
+	KeyRotations      int     `json:"key_rotations"` // times the key changes between segments
+	Discontinuities   int     `json:"discontinuities"`
+	Ended             bool    `json:"ended"`
+}
+
+// Summary computes statistics about the segments of the playlist
+func (m *MediaPlaylist) Summary() MediaSummary {
+	summary := MediaSummary{Segments: len(m.Segments), Ended: m.EndList}
+
+	lastKey := -1
+	for i, segment := range m.Segments {
+		duration := float64(segment.Duration)
+		summary.Duration += duration
+		if duration > summary.MaxDuration {
+			summary.MaxDuration = duration
+		}
+
+		if segment.Discontinuity {
+			summary.Discontinuities++
+		}
+
+		encrypted := segment.KeyIndex != -1 && segment.KeyIndex < len(m.Keys) && m.Keys[segment.KeyIndex].Method != CryptNone
+		if encrypted {
+			summary.EncryptedSegments++
+		}
+
+		if i > 0 && segment.KeyIndex != lastKey {
+			summary.KeyRotations++
+		}
+		lastKey = segment.KeyIndex
+	}
+	return summary
+}
+
+// VariantSummary contains the bitrates and
+// format of a variant in a MasterPlaylist
+type VariantSummary struct {
+	URI              string     `json:"uri"`
+	IFrame           bool       `json:"i_frame"`
+	Bandwidth        int64      `json:"bandwidth"`
+	AverageBandwidth int64      `json:"average_bandwidth,omitempty"`
+	Resolution       Resolution `json:"resolution"`
+	Codecs           string     `json:"codecs,omitempty"`
+}
+
+// MasterSummary contains statistics computed from a MasterPlaylist
+type MasterSummary struct {
+	Variants     []VariantSummary `json:"variants"`
+	MinBandwidth int64            `json:"min_bandwidth"`
+	MaxBandwidth int64            `json:"max_bandwidth"`
+	Renditions   map[string]int   `json:"renditions"` // number of renditions of each media type
+}
+
+// Summary computes the bitrates of every variant
+// and counts the renditions of each type
+func (m *MasterPlaylist) Summary() MasterSummary {
+	summary := MasterSummary{Renditions: make(map[string]int)}
+	add := func(v VariantSummary) {
+		if len(summary.Variants) == 0 || v.Bandwidth < summary.MinBandwidth {
+			summary.MinBandwidth = v.Bandwidth
+		}
+
+		if v.Bandwidth > summary.MaxBandwidth {
+			summary.MaxBandwidth = v.Bandwidth
+		}
+		summary.Variants = append(summary.Variants, v)
+	}
+
+	for _, v := range m.Variants {
+		add(VariantSummary{URI: v.URI, Bandwidth: v.Bandwidth, AverageBandwidth: v.BandwidthAvg, Resolution: v.Resolution, Codecs: v.Codecs})
+	}
+
+	for _, v := range m.IVariants {
+		add(VariantSummary{URI: v.URI, IFrame: true, Bandwidth: v.Bandwidth, AverageBandwidth: v.BandwidthAvg, Resolution: v.Resolution, Codecs: v.Codecs})
+	}
+
+	for _, r := range m.Renditions {
+		summary.Renditions[r.Type]++
+	}
+	return summary
+}
@@ -0,0 +1,73 @@
+package m3u8
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Tag is a tag or comment that the decoder does not handle itself, such as
+// vendor tags like EXT-X-CUE-OUT. Tags are kept in the order they appear so
+// they are written back by the encoder
+type Tag struct {
+	Name  string      `json:"name,omitempty"` // without the #, and empty for comments
+	Value string      `json:"value,omitempty"`
+	Data  interface{} `json:"data,omitempty"` // set by the TagParser registered for the tag
+}
+
+// IsComment returns whether the tag is a comment, which is any line starting with # but not #EXT
+func (t Tag) IsComment() bool {
+	return t.Name == ""
+}
+
+// String returns the line the tag was written as. The encoder writes Value,
+// so changes to Data have to be made to Value as well
+func (t Tag) String() string {
+	if t.IsComment() {
+		return "#" + t.Value
+	}
+
+	if t.Value == "" {
+		return "#" + t.Name
+	}
+	return "#" + t.Name + ":" + t.Value
+}
+
+// TagParser parses the value of a custom tag, which is everything after the
+// colon, into the Data of the Tag. Returning an error stops decoding
+type TagParser func(value string) (interface{}, error)
+
+var (
+	tagParsersLock sync.RWMutex
+	tagParsers     = make(map[string]TagParser)
+)
+
+// RegisterTag sets the TagParser for tags with the given name, without the #.
+// A nil parser removes the one registered. Tags defined in RFC 8216 are
+// always handled by the decoder itself
+func RegisterTag(name string, parser TagParser) {
+	tagParsersLock.Lock()
+	defer tagParsersLock.Unlock()
+
+	if parser == nil {
+		delete(tagParsers, name)
+		return
+	}
+	tagParsers[name] = parser
+}
+
+// parseTag returns a tag the decoder does not handle, with its Data set if a TagParser is registered for it
+func parseTag(name, value string) (Tag, error) {
+	tag := Tag{Name: name, Value: value}
+
+	tagParsersLock.RLock()
+	parser := tagParsers[name]
+	tagParsersLock.RUnlock()
+
+	if parser != nil {
+		var err error
+		if tag.Data, err = parser(value); err != nil {
+			return tag, fmt.Errorf("parsing %s: %w", name, err)
+		}
+	}
+	return tag, nil
+}
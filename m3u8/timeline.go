@@ -0,0 +1,174 @@
+package m3u8
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dateTimeLayouts are the forms of ISO 8601 date and time accepted by
+// ParseDateTime, after the date and time are separated by T. Fractional
+// seconds of any precision are accepted after the seconds by time.Parse
+var dateTimeLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05Z07",
+	"2006-01-02T15:04Z07:00",
+}
+
+// ParseDateTime parses the ISO 8601 date and time of EXT-X-PROGRAM-DATE-TIME
+// and EXT-X-DATERANGE. Besides the RFC 3339 form, offsets without a colon or
+// minutes, a space or lowercase t between the date and time and a comma
+// before the fractional seconds are accepted. 4.3.2.6 requires a time zone,
+// and a date without one is an error rather than a guess at UTC
+func ParseDateTime(value string) (time.Time, error) {
+	normalized := strings.TrimSpace(value)
+	if len(normalized) > 10 && (normalized[10] == ' ' || normalized[10] == 't') {
+		normalized = normalized[:10] + "T" + normalized[11:]
+	}
+
+	if strings.HasSuffix(normalized, "z") {
+		normalized = normalized[:len(normalized)-1] + "Z"
+	}
+
+	// The decimal sign can be a comma in ISO 8601, but time.Parse only accepts a period before Go 1.17
+	if comma := strings.IndexByte(normalized, ','); comma > 10 {
+		normalized = normalized[:comma] + "." + normalized[comma+1:]
+	}
+
+	if !hasTimeZone(normalized) {
+		return time.Time{}, fmt.Errorf("date and time %q has no time zone", value)
+	}
+
+	for _, layout := range dateTimeLayouts {
+		if date, err := time.Parse(layout, normalized); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date and time %q", value)
+}
+
+// hasTimeZone returns whether the time after the T ends with Z or an offset
+func hasTimeZone(value string) bool {
+	t := strings.IndexByte(value, 'T')
+	if t == -1 {
+		return false
+	}
+	clock := value[t+1:]
+	return strings.HasSuffix(clock, "Z") || strings.ContainsAny(clock, "+-")
+}
+
+// jumpTolerance is how far the date of a segment can be from the end of
+// the segment before it without being reported as a TimeJump, to allow for
+// durations that were rounded
+const jumpTolerance = 100 * time.Millisecond
+
+// SegmentTime is the position of a segment in a Timeline
+type SegmentTime struct {
+	Segment      *Segment
+	Index        int           // in the Segments of the playlist
+	Offset       time.Duration // from the start of the playlist
+	Start        time.Time     // zero if the playlist has no EXT-X-PROGRAM-DATE-TIME
+	Extrapolated bool          // Start was computed from the date of another segment
+}
+
+// End returns the wall-clock time at the end of the segment
+func (s SegmentTime) End() time.Time {
+	return s.Start.Add(Seconds(s.Segment.Duration))
+}
+
+// TimeJump is a segment whose EXT-X-PROGRAM-DATE-TIME does not match the end
+// of the segment before it. A positive Gap is missing media, and a negative
+// one is the clock going backwards or media that overlaps
+type TimeJump struct {
+	Index    int       // of the segment with the date
+	Expected time.Time // the end of the segment before it
+	Actual   time.Time
+}
+
+// Gap returns the difference between the date of the segment and the one expected
+func (j TimeJump) Gap() time.Duration {
+	return j.Actual.Sub(j.Expected)
+}
+
+// Timeline is the offset and wall-clock time of every segment of a MediaPlaylist
+type Timeline struct {
+	Segments []SegmentTime
+	Jumps    []TimeJump
+}
+
+// Timeline computes the start of every segment. Segments without their own
+// EXT-X-PROGRAM-DATE-TIME are given the date of the last segment with one
+// plus the durations since it, or the first one minus the durations until
+// it for the segments before it
+func (m *MediaPlaylist) Timeline() *Timeline {
+	timeline := &Timeline{Segments: make([]SegmentTime, len(m.Segments))}
+
+	first := -1
+	var offset time.Duration
+	for i, segment := range m.Segments {
+		timeline.Segments[i] = SegmentTime{Segment: segment, Index: i, Offset: offset}
+		offset += Seconds(segment.Duration)
+		if first == -1 && !segment.DateTime.IsZero() {
+			first = i
+		}
+	}
+
+	if first == -1 {
+		return timeline
+	}
+
+	start := m.Segments[first].DateTime
+	for i := 0; i < first; i++ {
+		entry := &timeline.Segments[i]
+		entry.Start = start.Add(entry.Offset - timeline.Segments[first].Offset)
+		entry.Extrapolated = true
+	}
+
+	var expected time.Time
+	for i := first; i < len(m.Segments); i++ {
+		entry := &timeline.Segments[i]
+		if date := entry.Segment.DateTime; date.IsZero() {
+			entry.Start = expected
+			entry.Extrapolated = true
+		} else {
+			entry.Start = date
+			if gap := date.Sub(expected); i != first && (gap > jumpTolerance || gap < -jumpTolerance) {
+				timeline.Jumps = append(timeline.Jumps, TimeJump{Index: i, Expected: expected, Actual: date})
+			}
+		}
+		expected = entry.End()
+	}
+	return timeline
+}
+
+// SegmentAtOffset returns the segment covering the offset from the start of the playlist
+func (t *Timeline) SegmentAtOffset(offset time.Duration) (SegmentTime, bool) {
+	i := sort.Search(len(t.Segments), func(i int) bool {
+		return t.Segments[i].Offset > offset
+	}) - 1
+
+	if i < 0 || offset >= t.Segments[i].Offset+Seconds(t.Segments[i].Segment.Duration) {
+		return SegmentTime{}, false
+	}
+	return t.Segments[i], true
+}
+
+// SegmentAt returns the segment covering the wall-clock time. If the clock
+// jumped backwards and more than one segment covers it, the first is returned.
+// Times in a gap, and playlists without dates, have no segment
+func (t *Timeline) SegmentAt(date time.Time) (SegmentTime, bool) {
+	for _, entry := range t.Segments {
+		if !entry.Start.IsZero() && !date.Before(entry.Start) && date.Before(entry.End()) {
+			return entry, true
+		}
+	}
+	return SegmentTime{}, false
+}
+
+// Seconds converts a duration in seconds from a playlist, such as the
+// Duration of a Segment or DateRange, into a time.Duration
+func Seconds(duration float32) time.Duration {
+	return time.Duration(float64(duration) * float64(time.Second))
+}
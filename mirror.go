@@ -0,0 +1,335 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// mirror tracks the files written while mirroring a stream, so every
+// remote resource is downloaded once and given a unique local path
+type mirror struct {
+	d     *Downloader
+	dir   string
+	paths map[string]string // absolute URL to a slash separated path relative to dir
+	used  map[string]bool
+}
+
+// localPath returns the path that uri is mirrored to, and whether this is
+// the first time it was asked for. Paths are built from the host and path
+// of the URL, cleaned so that they can not refer to anything outside dir
+func (m *mirror) localPath(uri string) (string, bool) {
+	if local, exists := m.paths[uri]; exists {
+		return local, false
+	}
+
+	var host, remote string
+	if u, err := url.Parse(uri); err == nil {
+		host, remote = u.Host, u.Path
+		if u.Opaque != "" {
+			host, remote = u.Scheme, u.Opaque
+		}
+	} else {
+		remote = uri
+	}
+
+	host = strings.NewReplacer(":", "_", "/", "_", `\`, "_").Replace(host)
+	if host == "." || host == ".." {
+		host = "_"
+	}
+
+	local := strings.TrimPrefix(path.Join(host, path.Clean("/"+strings.Replace(remote, `\`, "_", -1))), "/")
+	if local == "" || local == host {
+		local = path.Join(local, "index")
+	}
+
+	// Different URLs can clean to the same path, like those that only differ by
+	// query, so later ones get a number added before the extension
+	ext := path.Ext(local)
+	unique := local
+	for i := 1; m.used[unique]; i++ {
+		unique = strings.TrimSuffix(local, ext) + "-" + strconv.Itoa(i) + ext
+	}
+
+	m.used[unique] = true
+	m.paths[uri] = unique
+	return unique, true
+}
+
+// relative returns the URI of target for a playlist at from, where both are local paths
+func relative(from, target string) string {
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(from)), filepath.FromSlash(target))
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(rel)
+}
+
+// write writes data to the local path, making sure it stays inside of the mirror directory
+func (m *mirror) write(local string, data []byte) error {
+	full := filepath.Join(m.dir, filepath.FromSlash(local))
+	if rel, err := filepath.Rel(m.dir, full); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("mirrored path %q is outside of %q", local, m.dir)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(full), os.ModePerm); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+
+	if err := ioutil.WriteFile(full, data, 0644); err != nil {
+		return fmt.Errorf("writing %q: %w", local, err)
+	}
+	return nil
+}
+
+// encode writes the playlist to the local path
+func (m *mirror) encode(local string, playlist m3u8.Playlist) error {
+	data, err := m3u8.EncodeString(playlist)
+	if err != nil {
+		return fmt.Errorf("encoding playlist: %w", err)
+	}
+	return m.write(local, []byte(data))
+}
+
+// mediaPlaylist mirrors the keys, media initialization sections and segments
+// of the playlist, then writes a copy of it that refers to them locally
+func (m *mirror) mediaPlaylist(playlist *m3u8.MediaPlaylist, playlistURL, local string) error {
+	copied := *playlist
+	copied.Keys = make([]*m3u8.Key, len(playlist.Keys))
+	for i, key := range playlist.Keys {
+		k := *key
+		copied.Keys[i] = &k
+
+		if key.URI == "" {
+			continue
+		}
+
+		// Only AES-128 keys can be loaded, others such as SAMPLE-AES with a
+		// DRM key format are left pointing at where they came from
+		if key.Method != m3u8.CryptAES {
+			k.URI = m.d.resolve(playlistURL, key.URI)
+			continue
+		}
+
+		keyPath, fresh := m.localPath(m.d.resolve(playlistURL, key.URI))
+		if fresh {
+			value, err := m.d.loadKey(context.Background(), key, playlistURL)
+			if err != nil {
+				return fmt.Errorf("loading key value: %w", err)
+			}
+
+			if err := m.write(keyPath, value); err != nil {
+				return err
+			}
+		}
+		k.URI = relative(local, keyPath)
+	}
+
+	// Segments and maps are downloaded as they are, so they still need the
+	// keys to play. Byte ranges of the same file only download it once
+	var (
+		jobs  []job
+		files []string
+	)
+
+	queue := func(uri string) string {
+		file, fresh := m.localPath(m.d.resolve(playlistURL, uri))
+		if fresh {
+			jobs = append(jobs, job{index: len(jobs), segment: &m3u8.Segment{URI: uri}, playlistURL: playlistURL, raw: true})
+			files = append(files, file)
+		}
+		return relative(local, file)
+	}
+
+	copied.Segments = make([]*m3u8.Segment, len(playlist.Segments))
+	for i, segment := range playlist.Segments {
+		s := *segment
+		if segment.Map != nil {
+			init := *segment.Map
+			init.URI = queue(init.URI)
+			s.Map = &init
+		}
+		s.URI = queue(segment.URI)
+		copied.Segments[i] = &s
+	}
+
+	produce := func(ctx context.Context, add func(job) bool) error {
+		for _, j := range jobs {
+			j.total = len(jobs)
+			if !add(j) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	err := m.d.fetchAll(produce, func(index int, data []byte) error {
+		return m.write(files[index], data)
+	})
+
+	if err != nil {
+		return err
+	}
+	return m.encode(local, &copied)
+}
+
+// variant mirrors the media playlist at uri, relative to the master playlist,
+// and returns the URI the master playlist should use for it
+func (m *mirror) variant(masterURL, uri string) (string, error) {
+	playlistURL := m.d.resolve(masterURL, uri)
+	local, fresh := m.localPath(playlistURL)
+	if fresh {
+		playlist, err := m.d.decodeURL(context.Background(), playlistURL)
+		if err != nil {
+			return "", fmt.Errorf("getting media playlist from master: %w", err)
+		}
+
+		media, ok := playlist.(*m3u8.MediaPlaylist)
+		if !ok {
+			return "", fmt.Errorf("got master playlist from master playlist url (?)")
+		}
+
+		m.d.log(LevelInfo, "mirroring media playlist", Field{"uri", playlistURL}, Field{"path", local})
+		if err := m.mediaPlaylist(media, playlistURL, local); err != nil {
+			return "", fmt.Errorf("mirroring media playlist %q: %w", playlistURL, err)
+		}
+	}
+	return relative(mirrorIndex, local), nil
+}
+
+// masterPlaylist mirrors the variants and renditions of the master playlist,
+// either all of them or the variant chosen by quality and the renditions it uses
+func (m *mirror) masterPlaylist(master *m3u8.MasterPlaylist, stream string, all bool) error {
+	copied := *master
+	copied.Variants = append([]m3u8.Variant(nil), master.Variants...)
+	copied.IVariants = append([]m3u8.IVariant(nil), master.IVariants...)
+	copied.Renditions = append([]m3u8.Rendition(nil), master.Renditions...)
+	copied.SessionData = append([]m3u8.SessionData(nil), master.SessionData...)
+
+	if !all {
+		best, err := m.d.selectVariant(master)
+		if err != nil {
+			return err
+		}
+
+		groups := map[string]string{
+			m3u8.MediaAudio:     best.Audio,
+			m3u8.MediaVideo:     best.Video,
+			m3u8.MediaSubtitles: best.Subtitles,
+			m3u8.MediaCaptions:  best.ClosedCaptions,
+		}
+
+		var renditions []m3u8.Rendition
+		for _, rend := range copied.Renditions {
+			if group := groups[rend.Type]; group != "" && group == rend.GroupID {
+				renditions = append(renditions, rend)
+			}
+		}
+
+		copied.Variants = []m3u8.Variant{*best}
+		copied.IVariants = nil
+		copied.Renditions = renditions
+	}
+
+	var err error
+	for i := range copied.Variants {
+		if copied.Variants[i].URI, err = m.variant(stream, copied.Variants[i].URI); err != nil {
+			return err
+		}
+	}
+
+	for i := range copied.IVariants {
+		if copied.IVariants[i].URI, err = m.variant(stream, copied.IVariants[i].URI); err != nil {
+			return err
+		}
+	}
+
+	for i, rend := range copied.Renditions {
+		if rend.URI == "" {
+			continue
+		}
+
+		if copied.Renditions[i].URI, err = m.variant(stream, rend.URI); err != nil {
+			return err
+		}
+	}
+
+	for i, session := range copied.SessionData {
+		if session.URI == "" {
+			continue
+		}
+
+		uri := m.d.resolve(stream, session.URI)
+		local, fresh := m.localPath(uri)
+		if fresh {
+			data, err := m.d.fetchRaw(context.Background(), uri)
+			if err != nil {
+				return fmt.Errorf("getting session data %q: %w", session.DataID, err)
+			}
+
+			if err := m.write(local, data); err != nil {
+				return err
+			}
+		}
+		copied.SessionData[i].URI = relative(mirrorIndex, local)
+	}
+
+	if key := master.SessionKey; key != nil && key.URI != "" {
+		// The session key is only a hint for preloading, so it points at the
+		// mirrored key if a media playlist used it and otherwise stays remote
+		k := *key
+		k.URI = m.d.resolve(stream, key.URI)
+		if local, exists := m.paths[k.URI]; exists && key.Method == m3u8.CryptAES {
+			k.URI = relative(mirrorIndex, local)
+		}
+		copied.SessionKey = &k
+	}
+	return m.encode(mirrorIndex, &copied)
+}
+
+// mirrorIndex is the path of the top level playlist of a mirror
+const mirrorIndex = "index.m3u8"
+
+// Mirror downloads the stream to dir as a copy that can be played locally,
+// instead of remuxing it. The top level playlist is written to index.m3u8, and
+// everything it refers to is written to a path made from its URL, with every
+// playlist rewritten to use relative paths. Segments are written as they were
+// received, so encrypted streams stay encrypted and their keys are mirrored.
+// If allVariants is false only the variant chosen by quality and its
+// renditions are mirrored. Live playlists are mirrored as they currently are
+func (d *Downloader) Mirror(dir, stream string, allVariants bool) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("creating mirror directory: %w", err)
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("getting mirror directory: %w", err)
+	}
+
+	playlist, err := d.decodeURL(context.Background(), stream)
+	if err != nil {
+		return fmt.Errorf("decoding m3u8 playlist to url: %w", err)
+	}
+
+	m := &mirror{d: d, dir: abs, paths: map[string]string{stream: mirrorIndex}, used: map[string]bool{mirrorIndex: true}}
+	switch playlist := playlist.(type) {
+	case *m3u8.MediaPlaylist:
+		err = m.mediaPlaylist(playlist, stream, mirrorIndex)
+	case *m3u8.MasterPlaylist:
+		err = m.masterPlaylist(playlist, stream, allVariants)
+	}
+
+	if err != nil {
+		return fmt.Errorf("mirroring playlist: %w", err)
+	}
+	return nil
+}
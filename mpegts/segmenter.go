@@ -0,0 +1,326 @@
+package mpegts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// maxKeyframeScan is how much of a video PES packet is searched for a keyframe.
+// The picture comes after the parameter sets and SEI, which are small
+const maxKeyframeScan = 64 << 10
+
+// CreateFunc returns where segment index is written, and the URI
+// it is given in the playlist. The writer is closed once it is complete
+type CreateFunc func(index int) (io.WriteCloser, string, error)
+
+// Segmenter cuts a transport stream into HLS segments. Segments are cut
+// at the first keyframe after the target duration, so every segment can be
+// decoded on its own, and their durations are measured from the PTS of the
+// video, or of the audio if the stream does not have video
+type Segmenter struct {
+	target time.Duration
+	create CreateFunc
+}
+
+// NewSegmenter creates a Segmenter cutting segments of at least target,
+// which are written to the writers returned by create
+func NewSegmenter(target time.Duration, create CreateFunc) *Segmenter {
+	return &Segmenter{target: target, create: create}
+}
+
+// segmentState is the state of a single call to Segment
+type segmentState struct {
+	*Segmenter
+	segments []*m3u8.Segment
+
+	out   io.WriteCloser
+	buf   *bufio.Writer
+	uri   string
+	index int
+
+	pat, pmt    packet
+	pmtPID      uint16
+	hasPAT      bool
+	primary     uint16 // the stream whose PES packets segments are cut on
+	primaryType byte
+	hasPrimary  bool
+
+	// Packets from the start of a PES packet of the primary stream are held
+	// until the next one starts, to know if it is a keyframe before writing
+	pending     []packet
+	pendingData []byte
+	pendingPTS  int64
+	pendingHas  bool
+	pendingRA   bool
+	inPending   bool
+
+	start, latest, frame int64
+	hasStart             bool
+	lastRaw, wraps       int64
+	hasRaw               bool
+}
+
+// Segment reads the transport stream from r and writes it as segments,
+// returning a MediaPlaylist of them
+func (s *Segmenter) Segment(r io.Reader) (*m3u8.MediaPlaylist, error) {
+	st := &segmentState{Segmenter: s}
+	reader := newPacketReader(r)
+	for {
+		p, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			st.abort()
+			return nil, fmt.Errorf("reading packet: %w", err)
+		}
+
+		if err := st.packet(p); err != nil {
+			st.abort()
+			return nil, err
+		}
+	}
+	return st.finish()
+}
+
+func (st *segmentState) packet(p packet) error {
+	pid := p.pid()
+	switch {
+	case pid == pidPAT && p.start():
+		pmtPID, err := parsePAT(p.payload())
+		if err != nil {
+			return err
+		}
+		st.pat, st.pmtPID, st.hasPAT = p, pmtPID, true
+	case st.hasPAT && pid == st.pmtPID && p.start():
+		streams, err := parsePMT(p.payload())
+		if err != nil {
+			return err
+		}
+		st.pmt = p
+
+		if !st.hasPrimary {
+			st.choosePrimary(streams)
+		}
+	case st.hasPrimary && pid == st.primary && p.start():
+		if err := st.flush(); err != nil {
+			return err
+		}
+
+		payload := p.payload()
+		pts, hasPTS, offset := parsePES(payload)
+		st.pending = append(st.pending[:0], p)
+		st.pendingData = st.pendingData[:0]
+		if offset < len(payload) {
+			st.pendingData = append(st.pendingData, payload[offset:]...)
+		}
+		st.pendingPTS, st.pendingHas, st.pendingRA, st.inPending = pts, hasPTS, p.randomAccess(), true
+		return nil
+	}
+
+	if st.inPending {
+		st.pending = append(st.pending, p)
+		if pid == st.primary && len(st.pendingData) < maxKeyframeScan {
+			st.pendingData = append(st.pendingData, p.payload()...)
+		}
+		return nil
+	}
+	return st.write(p)
+}
+
+// choosePrimary picks the first video stream, or the first audio stream if there is no video
+func (st *segmentState) choosePrimary(streams []elementaryStream) {
+	for _, stream := range streams {
+		if isVideo(stream.streamType) {
+			st.primary, st.primaryType, st.hasPrimary = stream.pid, stream.streamType, true
+			return
+		}
+	}
+
+	for _, stream := range streams {
+		if isAudio(stream.streamType) {
+			st.primary, st.primaryType, st.hasPrimary = stream.pid, stream.streamType, true
+			return
+		}
+	}
+}
+
+// unwrap returns the PTS continuing from the previous one when it wraps around after 2^33
+func (st *segmentState) unwrap(pts int64) int64 {
+	if st.hasRaw {
+		if pts < st.lastRaw-ptsWrap/2 {
+			st.wraps += ptsWrap
+		} else if pts > st.lastRaw+ptsWrap/2 {
+			st.wraps -= ptsWrap
+		}
+	}
+	st.lastRaw, st.hasRaw = pts, true
+	return pts + st.wraps
+}
+
+// flush writes the held PES packet, cutting a new segment before it if it is
+// a keyframe and the current segment has reached the target duration
+func (st *segmentState) flush() error {
+	if !st.inPending {
+		return nil
+	}
+	st.inPending = false
+
+	if st.pendingHas {
+		pts := st.unwrap(st.pendingPTS)
+		key := st.pendingRA || !isVideo(st.primaryType) || keyframe(st.primaryType, st.pendingData)
+
+		if !st.hasStart {
+			st.start, st.latest, st.hasStart = pts, pts, true
+		} else if key && st.out != nil && pts-st.start >= int64(st.target.Seconds()*clockRate) {
+			if err := st.closeSegment(pts - st.start); err != nil {
+				return err
+			}
+			st.start = pts
+		}
+
+		// With B-frames the PTS is not in order, so the smallest step
+		// between them is taken as the duration of a single frame
+		if delta := pts - st.latest; delta > 0 {
+			if st.frame == 0 || delta < st.frame {
+				st.frame = delta
+			}
+			st.latest = pts
+		}
+	}
+
+	for _, p := range st.pending {
+		if err := st.write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *segmentState) write(p packet) error {
+	if st.out == nil {
+		out, uri, err := st.create(st.index)
+		if err != nil {
+			return fmt.Errorf("creating segment %d: %w", st.index, err)
+		}
+		st.out, st.uri, st.buf = out, uri, bufio.NewWriter(out)
+
+		// Every segment starts with the program tables so it can be played on its own
+		if st.index > 0 && st.pat != nil && st.pmt != nil {
+			st.buf.Write(st.pat)
+			st.buf.Write(st.pmt)
+		}
+	}
+
+	if _, err := st.buf.Write(p); err != nil {
+		return fmt.Errorf("writing segment %d: %w", st.index, err)
+	}
+	return nil
+}
+
+func (st *segmentState) closeSegment(ticks int64) error {
+	err := st.buf.Flush()
+	if closeErr := st.out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("writing segment %d: %w", st.index, err)
+	}
+
+	st.segments = append(st.segments, &m3u8.Segment{URI: st.uri, Duration: float32(float64(ticks) / clockRate), KeyIndex: -1})
+	st.out, st.buf = nil, nil
+	st.index++
+	return nil
+}
+
+// abort closes the segment being written after an error
+func (st *segmentState) abort() {
+	if st.out != nil {
+		st.out.Close()
+	}
+}
+
+func (st *segmentState) finish() (*m3u8.MediaPlaylist, error) {
+	if err := st.flush(); err != nil {
+		st.abort()
+		return nil, err
+	}
+
+	if st.out != nil {
+		// The last segment ends when its last frame finishes
+		var ticks int64
+		if st.hasStart {
+			ticks = st.latest + st.frame - st.start
+		}
+
+		if err := st.closeSegment(ticks); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(st.segments) == 0 {
+		return nil, fmt.Errorf("stream does not contain any packets")
+	}
+
+	if !st.hasPrimary {
+		return nil, fmt.Errorf("stream does not contain any audio or video")
+	}
+
+	// 4.3.3.1 - Every duration rounded to the nearest integer has to be at most the target duration
+	playlist := &m3u8.MediaPlaylist{Segments: st.segments, Version: 3, PType: m3u8.PlaylistVOD, EndList: true}
+	for _, segment := range st.segments {
+		if target := int64(math.Round(float64(segment.Duration))); target > playlist.TargetDuration {
+			playlist.TargetDuration = target
+		}
+	}
+	return playlist, nil
+}
+
+// SegmentFile cuts the transport stream at input into segments of at least
+// target in dir, named segment0.ts, segment1.ts and so on, and writes
+// their playlist to index.m3u8
+func SegmentFile(input, dir string, target time.Duration) (*m3u8.MediaPlaylist, error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, fmt.Errorf("opening input: %w", err)
+	}
+	defer file.Close()
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating output directory: %w", err)
+	}
+
+	playlist, err := NewSegmenter(target, func(index int) (io.WriteCloser, string, error) {
+		name := fmt.Sprintf("segment%d.ts", index)
+		out, err := os.Create(filepath.Join(dir, name))
+		return out, name, err
+	}).Segment(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.Create(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		return nil, fmt.Errorf("creating playlist: %w", err)
+	}
+
+	err = playlist.Encode(out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("writing playlist: %w", err)
+	}
+	return playlist, nil
+}
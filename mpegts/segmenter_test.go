@@ -0,0 +1,186 @@
+package mpegts
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+const (
+	testVideoPID = 0x100
+	testAudioPID = 0x101
+)
+
+// testMuxer writes a transport stream with an H.264 and an AAC stream
+type testMuxer struct {
+	bytes.Buffer
+	counters map[uint16]byte
+}
+
+// packets splits the payload into packets, padding the last one with an adaptation field
+func (m *testMuxer) packets(pid uint16, payload []byte, randomAccess bool) {
+	for first := true; first || len(payload) > 0; first = false {
+		p := make([]byte, PacketSize)
+		p[0], p[1], p[2] = syncByte, byte(pid>>8), byte(pid)
+		if first {
+			p[1] |= 0x40
+		}
+
+		p[3] = 0x10 | m.counters[pid]&0x0f
+		m.counters[pid]++
+
+		offset := 4
+		if size := len(payload); size < PacketSize-4 || (first && randomAccess) {
+			if size > PacketSize-6 {
+				size = PacketSize - 6
+			}
+
+			p[3] |= 0x20
+			p[4] = byte(PacketSize - 5 - size)
+			if p[4] > 0 {
+				for i := 6; i < PacketSize-size; i++ {
+					p[i] = 0xff
+				}
+				if first && randomAccess {
+					p[5] = 0x40
+				}
+			}
+			offset = PacketSize - size
+		}
+
+		n := copy(p[offset:], payload)
+		payload = payload[n:]
+		m.Write(p)
+	}
+}
+
+func (m *testMuxer) tables() {
+	m.packets(pidPAT, []byte{0, 0x00, 0xB0, 13, 0, 1, 0xC1, 0, 0, 0, 1, 0xE0 | 0x10, 0x00, 0, 0, 0, 0}, false)
+	m.packets(0x1000, []byte{
+		0, 0x02, 0xB0, 23, 0, 1, 0xC1, 0, 0, 0xE1, 0x00, 0xF0, 0x00,
+		StreamH264, 0xE1, 0x00, 0xF0, 0x00,
+		StreamAAC, 0xE1, 0x01, 0xF0, 0x00,
+		0, 0, 0, 0,
+	}, false)
+}
+
+func pes(streamID byte, pts int64, data []byte) []byte {
+	pts &= ptsWrap - 1
+	header := []byte{
+		0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5,
+		byte(0x21 | pts>>29&0x0e), byte(pts >> 22), byte(pts>>14&0xfe | 1), byte(pts >> 7), byte(pts<<1&0xfe | 1),
+	}
+	return append(header, data...)
+}
+
+// testStream returns a stream of 25 frames per second with a keyframe every second,
+// and an audio frame every 100ms, starting at the PTS start
+func testStream(start int64, seconds int) []byte {
+	m := &testMuxer{counters: make(map[uint16]byte)}
+	m.tables()
+
+	frame := int64(clockRate / 25)
+	for i := 0; i < seconds*25; i++ {
+		pts := start + int64(i)*frame
+
+		// The access unit delimiter and padding make the picture start in a later packet
+		data := append([]byte{0, 0, 0, 1, 0x09, 0xf0}, bytes.Repeat([]byte{0xaa}, 300)...)
+		if i%25 == 0 {
+			data = append(data, 0, 0, 1, 0x65)
+		} else {
+			data = append(data, 0, 0, 1, 0x41)
+		}
+		m.packets(testVideoPID, pes(0xE0, pts, append(data, bytes.Repeat([]byte{0xbb}, 200)...)), false)
+
+		if i%(25/10*2) == 0 {
+			m.packets(testAudioPID, pes(0xC0, pts, bytes.Repeat([]byte{0xcc}, 50)), false)
+		}
+	}
+	return m.Bytes()
+}
+
+type bufferCloser struct {
+	*bytes.Buffer
+}
+
+func (bufferCloser) Close() error {
+	return nil
+}
+
+func TestSegmenter(t *testing.T) {
+	for _, start := range []int64{clockRate, ptsWrap - 3*clockRate} {
+		input := testStream(start, 10)
+
+		var outputs []*bytes.Buffer
+		segmenter := NewSegmenter(2*time.Second, func(index int) (io.WriteCloser, string, error) {
+			outputs = append(outputs, new(bytes.Buffer))
+			return bufferCloser{outputs[index]}, fmt.Sprintf("segment%d.ts", index), nil
+		})
+
+		playlist, err := segmenter.Segment(bytes.NewReader(input))
+		if err != nil {
+			t.Fatalf("segmenting: %v", err)
+		}
+
+		if len(playlist.Segments) != 5 || len(outputs) != 5 {
+			t.Fatalf("start %d: expected 5 segments, got %d", start, len(playlist.Segments))
+		}
+
+		if playlist.TargetDuration != 2 || !playlist.EndList {
+			t.Errorf("start %d: unexpected playlist %+v", start, playlist)
+		}
+
+		total := 0
+		for i, segment := range playlist.Segments {
+			if segment.Duration != 2 || segment.URI != fmt.Sprintf("segment%d.ts", i) {
+				t.Errorf("start %d: segment %d is %+v", start, i, segment)
+			}
+
+			data := outputs[i].Bytes()
+			total += len(data)
+			if len(data)%PacketSize != 0 || packet(data).pid() != pidPAT {
+				t.Errorf("start %d: segment %d does not start with a PAT", start, i)
+			}
+
+			// The first video packet of every segment starts a keyframe
+			for offset := 0; offset < len(data); offset += PacketSize {
+				if p := packet(data[offset : offset+PacketSize]); p.pid() == testVideoPID {
+					if !p.start() || !bytes.Contains(data[offset:offset+3*PacketSize], []byte{0, 0, 1, 0x65}) {
+						t.Errorf("start %d: segment %d does not start with a keyframe", start, i)
+					}
+					break
+				}
+			}
+		}
+
+		// Every segment after the first has the PAT and PMT added to it
+		if expected := len(input) + 4*2*PacketSize; total != expected {
+			t.Errorf("start %d: segments contain %d bytes, expected %d", start, total, expected)
+		}
+	}
+}
+
+func TestSegmenterRandomAccess(t *testing.T) {
+	// Streams of other codecs can be cut on the random_access_indicator
+	m := &testMuxer{counters: make(map[uint16]byte)}
+	m.tables()
+	for i := 0; i < 8; i++ {
+		m.packets(testVideoPID, pes(0xE0, int64(i)*clockRate, []byte{1, 2, 3}), i%2 == 0)
+	}
+
+	var count int
+	playlist, err := NewSegmenter(time.Second, func(index int) (io.WriteCloser, string, error) {
+		count++
+		return bufferCloser{new(bytes.Buffer)}, fmt.Sprint(index), nil
+	}).Segment(bytes.NewReader(m.Bytes()))
+
+	if err != nil {
+		t.Fatalf("segmenting: %v", err)
+	}
+
+	if len(playlist.Segments) != 4 || count != 4 {
+		t.Errorf("expected 4 segments, got %d", len(playlist.Segments))
+	}
+}
@@ -0,0 +1,219 @@
+// Package mpegts reads MPEG transport streams and cuts them into HLS segments
+package mpegts
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	// PacketSize is the size of every transport stream packet
+	PacketSize = 188
+	syncByte   = 0x47
+
+	pidPAT = 0x0000
+
+	// clockRate is the frequency of PTS and DTS values
+	clockRate = 90000
+	ptsWrap   = 1 << 33
+)
+
+// Stream types from ISO/IEC 13818-1 table 2-34 that are cut on keyframes
+const (
+	StreamMPEG2Video = 0x02
+	StreamH264       = 0x1B
+	StreamH265       = 0x24
+	StreamMPEG1Audio = 0x03
+	StreamMPEG2Audio = 0x04
+	StreamAAC        = 0x0F
+	StreamAC3        = 0x81
+	StreamEAC3       = 0x87
+)
+
+// packet is a single transport stream packet
+type packet []byte
+
+func (p packet) pid() uint16 {
+	return uint16(p[1]&0x1f)<<8 | uint16(p[2])
+}
+
+// start returns whether a PES packet or PSI section starts in this packet
+func (p packet) start() bool {
+	return p[1]&0x40 != 0
+}
+
+// randomAccess returns the random_access_indicator of the adaptation field,
+// which some muxers set on the packets that start a keyframe
+func (p packet) randomAccess() bool {
+	return p[3]&0x20 != 0 && p[4] > 0 && p[5]&0x40 != 0
+}
+
+func (p packet) payload() []byte {
+	control := p[3] >> 4 & 0x3
+	offset := 4
+	if control&0x2 != 0 {
+		offset += 1 + int(p[4])
+	}
+
+	if control&0x1 == 0 || offset >= PacketSize {
+		return nil
+	}
+	return p[offset:]
+}
+
+// packetReader reads packets from a transport stream, skipping
+// any bytes between them until it finds the next sync byte
+type packetReader struct {
+	r *bufio.Reader
+}
+
+func newPacketReader(r io.Reader) *packetReader {
+	return &packetReader{r: bufio.NewReaderSize(r, 64*PacketSize)}
+}
+
+func (r *packetReader) next() (packet, error) {
+	for {
+		b, err := r.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if b[0] == syncByte {
+			break
+		}
+		r.r.Discard(1)
+	}
+
+	p := make(packet, PacketSize)
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// section returns the PSI section starting in the payload, skipping its pointer field
+func section(payload []byte) ([]byte, error) {
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil, fmt.Errorf("invalid pointer field")
+	}
+
+	data := payload[1+int(payload[0]):]
+	if len(data) < 3 {
+		return nil, fmt.Errorf("section is too short")
+	}
+
+	length := int(data[1]&0x0f)<<8 | int(data[2])
+	if 3+length > len(data) || length < 4 {
+		return nil, fmt.Errorf("section of %d bytes does not fit in a single packet", length)
+	}
+
+	// The CRC at the end is not part of the section data
+	return data[:3+length-4], nil
+}
+
+// parsePAT returns the PID of the PMT of the first program in a PAT
+func parsePAT(payload []byte) (uint16, error) {
+	data, err := section(payload)
+	if err != nil {
+		return 0, fmt.Errorf("parsing PAT: %w", err)
+	}
+
+	for i := 8; i+4 <= len(data); i += 4 {
+		// Program number 0 is the network PID, not a program
+		if program := uint16(data[i])<<8 | uint16(data[i+1]); program != 0 {
+			return uint16(data[i+2]&0x1f)<<8 | uint16(data[i+3]), nil
+		}
+	}
+	return 0, fmt.Errorf("PAT has no programs")
+}
+
+// elementaryStream is a stream listed in a PMT
+type elementaryStream struct {
+	pid        uint16
+	streamType byte
+}
+
+func parsePMT(payload []byte) ([]elementaryStream, error) {
+	data, err := section(payload)
+	if err != nil {
+		return nil, fmt.Errorf("parsing PMT: %w", err)
+	}
+
+	if len(data) < 12 {
+		return nil, fmt.Errorf("PMT is too short")
+	}
+
+	var streams []elementaryStream
+	for i := 12 + (int(data[10]&0x0f)<<8 | int(data[11])); i+5 <= len(data); {
+		streams = append(streams, elementaryStream{pid: uint16(data[i+1]&0x1f)<<8 | uint16(data[i+2]), streamType: data[i]})
+		i += 5 + (int(data[i+3]&0x0f)<<8 | int(data[i+4]))
+	}
+	return streams, nil
+}
+
+// parsePES returns the PTS of a PES packet if it has one, and the offset of its data
+func parsePES(payload []byte) (pts int64, hasPTS bool, offset int) {
+	if len(payload) < 9 || !bytes.HasPrefix(payload, []byte{0, 0, 1}) {
+		return 0, false, 0
+	}
+
+	// Streams such as padding and private_stream_2 do not have the optional header
+	switch payload[3] {
+	case 0xBC, 0xBE, 0xBF, 0xF0, 0xF1, 0xF2, 0xF8, 0xFF:
+		return 0, false, 6
+	}
+
+	offset = 9 + int(payload[8])
+	if payload[7]&0x80 != 0 && len(payload) >= 14 {
+		b := payload[9:14]
+		pts = int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+		hasPTS = true
+	}
+	return pts, hasPTS, offset
+}
+
+// keyframe returns whether the data of a video PES packet starts a keyframe,
+// meaning an IDR picture for H.264, an IRAP picture for H.265 or a sequence
+// header for MPEG-2, which decoders can start decoding from
+func keyframe(streamType byte, data []byte) bool {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+
+		header := data[i+3]
+		switch streamType {
+		case StreamH264:
+			if header&0x1f == 5 {
+				return true
+			}
+		case StreamH265:
+			if typ := header >> 1 & 0x3f; typ >= 16 && typ <= 21 {
+				return true
+			}
+		case StreamMPEG2Video:
+			if header == 0xB3 {
+				return true
+			}
+		}
+		i += 2
+	}
+	return false
+}
+
+func isVideo(streamType byte) bool {
+	return streamType == StreamH264 || streamType == StreamH265 || streamType == StreamMPEG2Video
+}
+
+func isAudio(streamType byte) bool {
+	switch streamType {
+	case StreamMPEG1Audio, StreamMPEG2Audio, StreamAAC, StreamAC3, StreamEAC3:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+// Package origin serves a directory of HLS playlists and segments over HTTP
+package origin
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStaticMaxAge = 365 * 24 * time.Hour
+	defaultLiveMaxAge   = time.Second
+)
+
+// contentTypes are the MIME types of the files found in HLS streams
+var contentTypes = map[string]string{
+	".m3u8":   "application/vnd.apple.mpegurl",
+	".m3u":    "application/vnd.apple.mpegurl",
+	".ts":     "video/mp2t",
+	".mp4":    "video/mp4",
+	".m4s":    "video/mp4",
+	".m4v":    "video/mp4",
+	".cmfv":   "video/mp4",
+	".m4a":    "audio/mp4",
+	".cmfa":   "audio/mp4",
+	".aac":    "audio/aac",
+	".mp3":    "audio/mpeg",
+	".ac3":    "audio/ac3",
+	".ec3":    "audio/eac3",
+	".vtt":    "text/vtt",
+	".webvtt": "text/vtt",
+	".key":    "application/octet-stream",
+	".bin":    "application/octet-stream",
+	".json":   "application/json",
+}
+
+// ContentType returns the MIME type of a file in an HLS stream by its extension
+func ContentType(name string) string {
+	if typ, exists := contentTypes[strings.ToLower(path.Ext(name))]; exists {
+		return typ
+	}
+	return "application/octet-stream"
+}
+
+// Server is an http.Handler serving the playlists and segments in a directory.
+// Segments and ended playlists can be cached for a long time, while live
+// playlists are only cached for half of their target duration so players
+// see new segments. Range requests are supported for byte range playlists
+type Server struct {
+	root         http.FileSystem
+	allowOrigin  string
+	staticMaxAge time.Duration
+	liveMaxAge   time.Duration
+}
+
+// New creates a Server for the files in dir, allowing requests from any origin
+func New(dir string) *Server {
+	return &Server{root: http.Dir(dir), allowOrigin: "*", staticMaxAge: defaultStaticMaxAge}
+}
+
+// SetAllowOrigin sets the Access-Control-Allow-Origin of every response,
+// so players on other origins can request the stream. "" disables CORS
+func (s *Server) SetAllowOrigin(origin string) {
+	s.allowOrigin = origin
+}
+
+// SetCacheControl sets how long segments and ended playlists, and live
+// playlists can be cached. A live of 0 uses half of the target duration
+// of the playlist, and master playlists are always treated as live
+func (s *Server) SetCacheControl(static, live time.Duration) {
+	s.staticMaxAge, s.liveMaxAge = static, live
+}
+
+// ServeHTTP serves the file at the path of the request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.allowOrigin != "" {
+		header := w.Header()
+		header.Set("Access-Control-Allow-Origin", s.allowOrigin)
+		header.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		header.Set("Access-Control-Allow-Headers", "Range")
+		header.Set("Access-Control-Expose-Headers", "Content-Length, Content-Range")
+		if s.allowOrigin != "*" {
+			header.Add("Vary", "Origin")
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// http.Dir keeps the cleaned path inside of the directory
+	name := path.Clean("/" + r.URL.Path)
+	file, err := s.root.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "error opening file", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	typ := ContentType(name)
+	w.Header().Set("Content-Type", typ)
+	if typ != contentTypes[".m3u8"] {
+		w.Header().Set("Cache-Control", cacheControl(s.staticMaxAge, true))
+		http.ServeContent(w, r, name, info.ModTime(), file)
+		return
+	}
+
+	// Playlists are small, so they are read to find out whether they are live
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(file); err != nil {
+		http.Error(w, "error reading file", http.StatusInternalServerError)
+		return
+	}
+
+	if ended, target := playlistInfo(b.Bytes()); ended {
+		w.Header().Set("Cache-Control", cacheControl(s.staticMaxAge, false))
+	} else {
+		maxAge := s.liveMaxAge
+		if maxAge == 0 {
+			maxAge = defaultLiveMaxAge
+			if target > 0 {
+				maxAge = target / 2
+			}
+		}
+		w.Header().Set("Cache-Control", cacheControl(maxAge, false))
+	}
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(b.Bytes()))
+}
+
+func cacheControl(maxAge time.Duration, immutable bool) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+
+	value := "public, max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if immutable {
+		value += ", immutable"
+	}
+	return value
+}
+
+// playlistInfo returns whether a media playlist has ended and its target duration.
+// It only scans for the tags it needs instead of decoding the whole playlist
+func playlistInfo(data []byte) (ended bool, target time.Duration) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "#EXT-X-ENDLIST", line == "#EXT-X-PLAYLIST-TYPE:VOD":
+			ended = true
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:")); err == nil {
+				target = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return ended, target
+}
@@ -0,0 +1,103 @@
+package origin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	dir, err := ioutil.TempDir("", "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"vod.m3u8":  "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6,\nseg0.ts\n#EXT-X-ENDLIST\n",
+		"live.m3u8": "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6,\nseg0.ts\n",
+		"seg0.ts":   "0123456789",
+		"sub.vtt":   "WEBVTT\n",
+	}
+
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return httptest.NewServer(New(dir)), dir
+}
+
+func request(t *testing.T, method, uri string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("requesting %q: %v", uri, err)
+	}
+
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestServer(t *testing.T) {
+	server, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	tests := []struct {
+		path         string
+		contentType  string
+		cacheControl string
+	}{
+		{"/vod.m3u8", "application/vnd.apple.mpegurl", "public, max-age=31536000"},
+		{"/live.m3u8", "application/vnd.apple.mpegurl", "public, max-age=3"},
+		{"/seg0.ts", "video/mp2t", "public, max-age=31536000, immutable"},
+		{"/sub.vtt", "text/vtt", "public, max-age=31536000, immutable"},
+	}
+
+	for _, test := range tests {
+		resp, _ := request(t, http.MethodGet, server.URL+test.path, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %q", test.path, resp.Status)
+		}
+
+		if typ := resp.Header.Get("Content-Type"); typ != test.contentType {
+			t.Errorf("%s: Content-Type is %q, expected %q", test.path, typ, test.contentType)
+		}
+
+		if cache := resp.Header.Get("Cache-Control"); cache != test.cacheControl {
+			t.Errorf("%s: Cache-Control is %q, expected %q", test.path, cache, test.cacheControl)
+		}
+
+		if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+			t.Errorf("%s: Access-Control-Allow-Origin is %q", test.path, origin)
+		}
+	}
+
+	resp, body := request(t, http.MethodGet, server.URL+"/seg0.ts", http.Header{"Range": {"bytes=2-5"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "2345" {
+		t.Errorf("range request returned %q: %q", resp.Status, body)
+	}
+
+	resp, _ = request(t, http.MethodOptions, server.URL+"/seg0.ts", nil)
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Headers") != "Range" {
+		t.Errorf("preflight request returned %q", resp.Status)
+	}
+
+	for _, path := range []string{"/missing.ts", "/../origin.go", "/"} {
+		if resp, _ := request(t, http.MethodGet, server.URL+path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: unexpected status %q", path, resp.Status)
+		}
+	}
+}
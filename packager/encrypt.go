@@ -0,0 +1,327 @@
+// Package packager writes HLS streams: encrypting segments, maintaining
+// live playlists and generating master playlists
+package packager
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// Encrypt encrypts data with AES-128-CBC, adding PKCS7 padding
+func Encrypt(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("creating aes cipher: %w", err)
+	}
+
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("iv is %d bytes, expected %d", len(iv), aes.BlockSize)
+	}
+
+	// 5.2 - Padding is always added, so a full block of it is added when
+	// the data is already a multiple of the block size
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := make([]byte, len(data)+padding)
+	copy(padded, data)
+	copy(padded[len(data):], bytes.Repeat([]byte{byte(padding)}, padding))
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	return padded, nil
+}
+
+// sequenceIV returns the IV used for a segment without an explicit IV,
+// which is its media sequence number as a big-endian 128-bit integer
+func sequenceIV(sequence int64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	return iv
+}
+
+// KeyWriter stores the value of key number index, and returns the URI
+// that players can request it from
+type KeyWriter func(index int, value []byte) (uri string, err error)
+
+// KeyFiles returns a KeyWriter that writes keys to dir as key0.key,
+// key1.key and so on, with their URIs made by adding the name to baseURI
+func KeyFiles(dir, baseURI string) KeyWriter {
+	return func(index int, value []byte) (string, error) {
+		name := fmt.Sprintf("key%d.key", index)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), value, 0600); err != nil {
+			return "", fmt.Errorf("writing key file: %w", err)
+		}
+		return baseURI + name, nil
+	}
+}
+
+// Encrypter encrypts segments with AES-128 and builds the media playlist
+// listing them, with an EXT-X-KEY every time the key changes
+type Encrypter struct {
+	writeKey   KeyWriter
+	rotate     int
+	explicitIV bool
+	random     io.Reader
+	playlist   *m3u8.MediaPlaylist
+	next       *m3u8.Key // key of the next segment, once Key has made it
+	written    int       // keys passed to writeKey
+	used       int       // segments encrypted with the current key
+}
+
+// NewEncrypter creates an Encrypter that stores its keys with writeKey. By
+// default a single key is used for every segment, and IVs are derived from
+// the media sequence number of each segment
+func NewEncrypter(writeKey KeyWriter) *Encrypter {
+	return &Encrypter{writeKey: writeKey, random: rand.Reader, playlist: &m3u8.MediaPlaylist{Version: 3}}
+}
+
+// SetKeyRotation sets the number of segments encrypted with each key
+// before a new one is made. 0 uses the same key for every segment
+func (e *Encrypter) SetKeyRotation(segments int) {
+	e.rotate = segments
+}
+
+// SetExplicitIV sets whether a random IV is made for every segment and
+// written in an EXT-X-KEY before it, instead of deriving them from the media
+// sequence number. The key value is still only changed by rotation
+func (e *Encrypter) SetExplicitIV(explicit bool) {
+	e.explicitIV = explicit
+}
+
+// SetMediaSequence sets the media sequence number of the first segment,
+// which is used for the IVs derived from it
+func (e *Encrypter) SetMediaSequence(sequence int64) {
+	e.playlist.MediaSequence = sequence
+}
+
+// Playlist returns the media playlist of the segments encrypted so far
+func (e *Encrypter) Playlist() *m3u8.MediaPlaylist {
+	return e.playlist
+}
+
+// Key returns the key that the next segment will be encrypted with,
+// making a new one if the current one has been rotated out. With explicit
+// IVs every segment gets its own copy of the key with a fresh IV
+func (e *Encrypter) Key() (*m3u8.Key, error) {
+	if e.next != nil {
+		return e.next, nil
+	}
+
+	var key *m3u8.Key
+	if keys := e.playlist.Keys; len(keys) != 0 && (e.rotate <= 0 || e.used < e.rotate) {
+		if !e.explicitIV {
+			return keys[len(keys)-1], nil
+		}
+
+		copied := *keys[len(keys)-1]
+		key = &copied
+	} else {
+		value := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(e.random, value); err != nil {
+			return nil, fmt.Errorf("generating key: %w", err)
+		}
+
+		uri, err := e.writeKey(e.written, value)
+		if err != nil {
+			return nil, err
+		}
+
+		key = &m3u8.Key{Method: m3u8.CryptAES, URI: uri, Value: value}
+		e.written++
+		e.used = 0
+	}
+
+	if e.explicitIV {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(e.random, iv); err != nil {
+			return nil, fmt.Errorf("generating iv: %w", err)
+		}
+		key.IV = string(iv)
+	}
+
+	e.playlist.Keys = append(e.playlist.Keys, key)
+	e.next = key
+	return key, nil
+}
+
+// Encrypt encrypts the data of a segment and adds it to the playlist
+func (e *Encrypter) Encrypt(segment *m3u8.Segment, data []byte) ([]byte, error) {
+	key, err := e.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	iv := []byte(key.IV)
+	if key.IV == "" {
+		iv = sequenceIV(e.playlist.MediaSequence + int64(len(e.playlist.Segments)))
+	}
+
+	encrypted, err := Encrypt(data, key.Value, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *segment
+	copied.KeyIndex = len(e.playlist.Keys) - 1
+	e.playlist.Segments = append(e.playlist.Segments, &copied)
+	e.next = nil
+	e.used++
+
+	if rounded := int64(math.Round(float64(copied.Duration))); rounded > e.playlist.TargetDuration {
+		e.playlist.TargetDuration = rounded
+	}
+	return encrypted, nil
+}
+
+// relative reports whether uri is a path below the directory of the playlist
+func relative(uri string) bool {
+	clean := path.Clean(uri)
+	return !strings.Contains(uri, "://") && !path.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// writeOutput writes data to the file at the relative uri in dir
+func writeOutput(dir, uri string, data []byte) error {
+	name := filepath.Join(dir, filepath.FromSlash(uri))
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+// EncryptDir encrypts the segments of the media playlist at input, which
+// have to be whole files relative to it, and writes them to the directory
+// output along with the playlist as index.m3u8. Keys are written by the
+// KeyWriter. Media initialization sections are encrypted with the key of
+// the segment they are declared before, which needs explicit IVs (4.3.2.5)
+func (e *Encrypter) EncryptDir(input, output string) (*m3u8.MediaPlaylist, error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, fmt.Errorf("opening playlist: %w", err)
+	}
+
+	playlist, err := m3u8.DecodeReader(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("decoding playlist: %w", err)
+	}
+
+	media, ok := playlist.(*m3u8.MediaPlaylist)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a media playlist", input)
+	}
+
+	if err := os.MkdirAll(output, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating output directory: %w", err)
+	}
+
+	e.playlist.MediaSequence = media.MediaSequence
+	maps := make(map[string]bool)
+	for _, segment := range media.Segments {
+		if segment.KeyIndex != -1 {
+			return nil, fmt.Errorf("segment %q is already encrypted", segment.URI)
+		}
+
+		if !relative(segment.URI) {
+			return nil, fmt.Errorf("segment %q is not relative to the playlist", segment.URI)
+		}
+
+		// Each segment is encrypted as a whole file, so ranges sharing one can not be
+		if segment.ByteRange != 0 {
+			return nil, fmt.Errorf("segment %q is a byte range, which can not be encrypted on its own", segment.URI)
+		}
+
+		if segment.Map != nil {
+			if err := e.encryptMap(segment.Map, input, output, maps); err != nil {
+				return nil, err
+			}
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(input), filepath.FromSlash(segment.URI)))
+		if err != nil {
+			return nil, fmt.Errorf("reading segment: %w", err)
+		}
+
+		encrypted, err := e.Encrypt(segment, data)
+		if err != nil {
+			return nil, fmt.Errorf("encrypting segment %q: %w", segment.URI, err)
+		}
+
+		if err := writeOutput(output, segment.URI, encrypted); err != nil {
+			return nil, fmt.Errorf("writing segment: %w", err)
+		}
+	}
+
+	// Everything other than the segments and keys is kept from the input playlist
+	encrypted := *media
+	encrypted.Segments, encrypted.Keys = e.playlist.Segments, e.playlist.Keys
+	if encrypted.Version < 3 {
+		encrypted.Version = 3
+	}
+
+	if encrypted.TargetDuration < e.playlist.TargetDuration {
+		encrypted.TargetDuration = e.playlist.TargetDuration
+	}
+
+	data, err := m3u8.EncodeString(&encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("encoding playlist: %w", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(output, "index.m3u8"), []byte(data), 0644); err != nil {
+		return nil, fmt.Errorf("writing playlist: %w", err)
+	}
+	return &encrypted, nil
+}
+
+// encryptMap encrypts the media initialization section m of the next
+// segment with its key and writes it to output. Every map is written once,
+// since its key and IV differ from those of any earlier declaration
+func (e *Encrypter) encryptMap(m *m3u8.Map, input, output string, written map[string]bool) error {
+	if !relative(m.URI) {
+		return fmt.Errorf("map %q is not relative to the playlist", m.URI)
+	}
+
+	if m.ByteRange != "" {
+		return fmt.Errorf("map %q is a byte range, which can not be encrypted on its own", m.URI)
+	}
+
+	if written[m.URI] {
+		return fmt.Errorf("map %q is declared more than once", m.URI)
+	}
+	written[m.URI] = true
+
+	key, err := e.Key()
+	if err != nil {
+		return err
+	}
+
+	if key.IV == "" {
+		return fmt.Errorf("map %q needs an explicit IV to be encrypted", m.URI)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(input), filepath.FromSlash(m.URI)))
+	if err != nil {
+		return fmt.Errorf("reading map: %w", err)
+	}
+
+	encrypted, err := Encrypt(data, key.Value, []byte(key.IV))
+	if err != nil {
+		return fmt.Errorf("encrypting map %q: %w", m.URI, err)
+	}
+
+	if err := writeOutput(output, m.URI, encrypted); err != nil {
+		return fmt.Errorf("writing map: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package packager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// expiredSegment is a segment that has left the playlist, and is deleted once at has passed
+type expiredSegment struct {
+	file string
+	at   time.Time
+}
+
+// LiveWriter maintains the media playlist of a live stream as segments are
+// completed, keeping only the most recent ones in a sliding window. The
+// playlist file is replaced atomically on every update, so players never
+// read a partially written playlist
+type LiveWriter struct {
+	lock     sync.Mutex
+	file     string
+	window   int
+	grace    time.Duration
+	playlist m3u8.MediaPlaylist
+	expired  []expiredSegment
+	ended    bool
+	now      func() time.Time
+}
+
+// NewLiveWriter creates a LiveWriter for the playlist at file, listing up to
+// window segments. Segment URIs are relative to the directory of the playlist.
+// A window of 0 keeps every segment, like an EVENT playlist
+func NewLiveWriter(file string, window int) *LiveWriter {
+	return &LiveWriter{file: file, window: window, playlist: m3u8.MediaPlaylist{Version: 3}, now: time.Now}
+}
+
+// SetGracePeriod sets how long segment files are kept after they leave the
+// playlist, since players may still request them. By default it is the
+// duration of the playlist plus the target duration, as required by 6.2.2
+func (w *LiveWriter) SetGracePeriod(grace time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.grace = grace
+}
+
+// SetTargetDuration sets the target duration of the playlist. It should be set
+// before the first segment, since 6.2.1 does not allow it to change. Otherwise
+// it is the longest segment added so far, rounded to the nearest second
+func (w *LiveWriter) SetTargetDuration(seconds int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.playlist.TargetDuration = seconds
+}
+
+// Playlist returns a copy of the current playlist
+func (w *LiveWriter) Playlist() *m3u8.MediaPlaylist {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	copied := w.playlist
+	copied.Segments = append([]*m3u8.Segment(nil), w.playlist.Segments...)
+	copied.Keys = append([]*m3u8.Key(nil), w.playlist.Keys...)
+	return &copied
+}
+
+// segmentFile returns the path of a segment relative to the playlist,
+// or false if it is not a file that can be deleted
+func (w *LiveWriter) segmentFile(uri string) (string, bool) {
+	clean := path.Clean(uri)
+	if strings.Contains(uri, "://") || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(w.file), filepath.FromSlash(clean)), true
+}
+
+// WriteSegment writes the data of a segment to its URI, relative to the
+// playlist, and then adds it to the playlist
+func (w *LiveWriter) WriteSegment(segment *m3u8.Segment, data []byte) error {
+	file, ok := w.segmentFile(segment.URI)
+	if !ok {
+		return fmt.Errorf("segment %q is not relative to the playlist", segment.URI)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return fmt.Errorf("creating segment directory: %w", err)
+	}
+
+	if err := writeAtomic(file, data); err != nil {
+		return fmt.Errorf("writing segment: %w", err)
+	}
+	return w.AddSegment(segment, nil)
+}
+
+// AddSegment adds a completed segment to the end of the playlist, removing the
+// oldest ones if there are more than the window, and rewrites the playlist.
+// The key the segment is encrypted with, if any, is given separately since
+// KeyIndex is managed by the LiveWriter. Setting Discontinuity on the segment
+// adds an EXT-X-DISCONTINUITY before it
+func (w *LiveWriter) AddSegment(segment *m3u8.Segment, key *m3u8.Key) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.ended {
+		return fmt.Errorf("playlist has already ended")
+	}
+
+	copied := *segment
+	copied.KeyIndex = -1
+	if key != nil && key.Method != m3u8.CryptNone {
+		copied.KeyIndex = len(w.playlist.Keys)
+		if last := len(w.playlist.Keys) - 1; last >= 0 && w.playlist.Keys[last] == key {
+			copied.KeyIndex = last
+		} else {
+			w.playlist.Keys = append(w.playlist.Keys, key)
+		}
+	}
+
+	if rounded := int64(math.Round(float64(copied.Duration))); rounded > w.playlist.TargetDuration {
+		w.playlist.TargetDuration = rounded
+	}
+
+	w.playlist.Segments = append(w.playlist.Segments, &copied)
+	w.slide()
+	return w.update()
+}
+
+// slide removes the segments that have left the window
+func (w *LiveWriter) slide() {
+	if w.window <= 0 || len(w.playlist.Segments) <= w.window {
+		return
+	}
+
+	grace := w.grace
+	if grace == 0 {
+		var duration float64
+		for _, segment := range w.playlist.Segments {
+			duration += float64(segment.Duration)
+		}
+		grace = time.Duration((duration + float64(w.playlist.TargetDuration)) * float64(time.Second))
+	}
+
+	removed := w.playlist.Segments[:len(w.playlist.Segments)-w.window]
+	remaining := w.playlist.Segments[len(removed):]
+	init := w.playlist.MapAt(len(removed))
+	for _, segment := range removed {
+		// 6.2.2 - The discontinuity sequence counts the discontinuities that have been removed
+		w.playlist.MediaSequence++
+		if segment.Discontinuity {
+			w.playlist.DiscontinuitySeq++
+		}
+
+		if file, ok := w.segmentFile(segment.URI); ok {
+			w.expired = append(w.expired, expiredSegment{file: file, at: w.now().Add(grace)})
+		}
+	}
+
+	// The media initialization section only appears on the first segment it
+	// applies to, so it has to be carried over if that segment was removed
+	if remaining[0].Map == nil && init != nil {
+		first := *remaining[0]
+		first.Map = init
+		remaining[0] = &first
+	}
+
+	w.playlist.Segments = append([]*m3u8.Segment(nil), remaining...)
+	w.pruneKeys()
+}
+
+// pruneKeys removes the keys that no segment uses anymore
+func (w *LiveWriter) pruneKeys() {
+	var keys []*m3u8.Key
+	indexes := make(map[int]int)
+	for i, segment := range w.playlist.Segments {
+		if segment.KeyIndex == -1 {
+			continue
+		}
+
+		index, exists := indexes[segment.KeyIndex]
+		if !exists {
+			index = len(keys)
+			indexes[segment.KeyIndex] = index
+			keys = append(keys, w.playlist.Keys[segment.KeyIndex])
+		}
+
+		if index != segment.KeyIndex {
+			copied := *segment
+			copied.KeyIndex = index
+			w.playlist.Segments[i] = &copied
+		}
+	}
+	w.playlist.Keys = keys
+}
+
+// update writes the playlist and deletes the expired segments whose grace period has passed
+func (w *LiveWriter) update() error {
+	data, err := m3u8.EncodeString(&w.playlist)
+	if err != nil {
+		return fmt.Errorf("encoding playlist: %w", err)
+	}
+
+	if err := writeAtomic(w.file, []byte(data)); err != nil {
+		return fmt.Errorf("writing playlist: %w", err)
+	}
+
+	now := w.now()
+	remaining := w.expired[:0]
+	for _, segment := range w.expired {
+		if now.Before(segment.at) {
+			remaining = append(remaining, segment)
+			continue
+		}
+
+		if err := os.Remove(segment.file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing expired segment: %w", err)
+		}
+	}
+	w.expired = remaining
+	return nil
+}
+
+// End adds EXT-X-ENDLIST to the playlist, after which no more segments can be added
+func (w *LiveWriter) End() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.ended = true
+	w.playlist.EndList = true
+	return w.update()
+}
+
+// writeAtomic writes data to a temporary file next to name and renames it over
+// name, so readers only ever see the old or the new contents
+func writeAtomic(name string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), name)
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
@@ -0,0 +1,259 @@
+package packager
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// SizeFunc returns the size in bytes of a segment
+type SizeFunc func(segment *m3u8.Segment) (int64, error)
+
+// FileSizes returns a SizeFunc for segments that are files relative to dir.
+// Segments with a byte range use the length of the range
+func FileSizes(dir string) SizeFunc {
+	return func(segment *m3u8.Segment) (int64, error) {
+		if segment.ByteRange != 0 {
+			return int64(segment.ByteRange), nil
+		}
+
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(segment.URI)))
+		if err != nil {
+			return 0, fmt.Errorf("getting segment size: %w", err)
+		}
+		return info.Size(), nil
+	}
+}
+
+// Bandwidth returns the peak and average bit rates of a media playlist. As
+// defined in 4.3.4.2, the peak is the largest bit rate of any run of segments
+// lasting between 0.5 and 1.5 times the target duration
+func Bandwidth(playlist *m3u8.MediaPlaylist, sizes SizeFunc) (peak, average int64, err error) {
+	bits := make([]float64, len(playlist.Segments))
+	var totalBits, totalDuration float64
+	for i, segment := range playlist.Segments {
+		size, err := sizes(segment)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		bits[i] = float64(size) * 8
+		totalBits += bits[i]
+		totalDuration += float64(segment.Duration)
+	}
+
+	if totalDuration == 0 {
+		return 0, 0, fmt.Errorf("playlist has no duration")
+	}
+
+	target := float64(playlist.TargetDuration)
+	var peakRate float64
+	for i := range playlist.Segments {
+		var runBits, runDuration float64
+		for j := i; j < len(playlist.Segments); j++ {
+			runBits += bits[j]
+			runDuration += float64(playlist.Segments[j].Duration)
+			if runDuration > 1.5*target {
+				break
+			}
+
+			if runDuration >= 0.5*target && runBits/runDuration > peakRate {
+				peakRate = runBits / runDuration
+			}
+		}
+	}
+
+	// Playlists that are too short for any run use their whole duration
+	if peakRate == 0 {
+		peakRate = totalBits / totalDuration
+	}
+	return int64(math.Ceil(peakRate)), int64(math.Ceil(totalBits / totalDuration)), nil
+}
+
+// StreamInfo describes a variant stream with what can not be found from its
+// segments. Audio, Video, Subtitles and ClosedCaptions are the group IDs of
+// the renditions it can be played with
+type StreamInfo struct {
+	URI            string
+	Codecs         string
+	Resolution     m3u8.Resolution
+	FrameRate      float32
+	HDCPLevel      string
+	Audio          string
+	Video          string
+	Subtitles      string
+	ClosedCaptions string
+}
+
+// bandwidth is the peak and average bit rate of a stream
+type bandwidth struct {
+	peak, average int64
+}
+
+// MasterBuilder builds a master playlist from the media playlists it lists,
+// computing the bandwidth of each from the size of its segments
+type MasterBuilder struct {
+	sizes      SizeFunc
+	master     m3u8.MasterPlaylist
+	variants   []bandwidth
+	renditions []bandwidth
+}
+
+// NewMasterBuilder creates a MasterBuilder that gets the size of segments with sizes
+func NewMasterBuilder(sizes SizeFunc) *MasterBuilder {
+	return &MasterBuilder{sizes: sizes, master: m3u8.MasterPlaylist{Version: 3}}
+}
+
+// AddVariant adds an EXT-X-STREAM-INF for the media playlist. Its BANDWIDTH and
+// AVERAGE-BANDWIDTH include the renditions of the groups it uses, so they are
+// computed in Build once every rendition has been added
+func (b *MasterBuilder) AddVariant(playlist *m3u8.MediaPlaylist, info StreamInfo) error {
+	peak, average, err := Bandwidth(playlist, b.sizes)
+	if err != nil {
+		return fmt.Errorf("computing bandwidth of %q: %w", info.URI, err)
+	}
+
+	variant := m3u8.Variant{
+		IVariant: m3u8.IVariant{
+			URI:        info.URI,
+			Codecs:     info.Codecs,
+			Resolution: info.Resolution,
+			Video:      info.Video,
+			HDCPLevel:  info.HDCPLevel,
+		},
+		FrameRate:      info.FrameRate,
+		Audio:          info.Audio,
+		Subtitles:      info.Subtitles,
+		ClosedCaptions: info.ClosedCaptions,
+	}
+
+	b.master.Variants = append(b.master.Variants, variant)
+	b.variants = append(b.variants, bandwidth{peak, average})
+	return nil
+}
+
+// AddIFrameVariant adds an EXT-X-I-FRAME-STREAM-INF for an I-frame playlist
+func (b *MasterBuilder) AddIFrameVariant(playlist *m3u8.MediaPlaylist, info StreamInfo) error {
+	if !playlist.IFramesOnly {
+		return fmt.Errorf("playlist %q is not an I-frame playlist", info.URI)
+	}
+
+	peak, average, err := Bandwidth(playlist, b.sizes)
+	if err != nil {
+		return fmt.Errorf("computing bandwidth of %q: %w", info.URI, err)
+	}
+
+	b.master.IVariants = append(b.master.IVariants, m3u8.IVariant{
+		URI:          info.URI,
+		Bandwidth:    peak,
+		BandwidthAvg: average,
+		Codecs:       info.Codecs,
+		Resolution:   info.Resolution,
+		Video:        info.Video,
+		HDCPLevel:    info.HDCPLevel,
+	})
+
+	// 4.3.4.3 - EXT-X-I-FRAME-STREAM-INF requires version 4
+	if b.master.Version < 4 {
+		b.master.Version = 4
+	}
+	return nil
+}
+
+// AddRendition adds an EXT-X-MEDIA for the media playlist. The playlist is nil
+// for renditions without a URI, such as closed captions or audio that is
+// already part of the variants
+func (b *MasterBuilder) AddRendition(playlist *m3u8.MediaPlaylist, rend m3u8.Rendition) error {
+	if rend.Type == "" || rend.GroupID == "" || rend.Name == "" {
+		return fmt.Errorf("renditions require a TYPE, GROUP-ID and NAME")
+	}
+
+	if (playlist == nil) != (rend.URI == "") {
+		return fmt.Errorf("rendition %q needs both a playlist and a URI, or neither", rend.Name)
+	}
+
+	if rend.Type == m3u8.MediaCaptions && rend.URI != "" {
+		return fmt.Errorf("closed caption rendition %q can not have a URI", rend.Name)
+	}
+
+	var rate bandwidth
+	if playlist != nil {
+		var err error
+		if rate.peak, rate.average, err = Bandwidth(playlist, b.sizes); err != nil {
+			return fmt.Errorf("computing bandwidth of %q: %w", rend.URI, err)
+		}
+	}
+
+	b.master.Renditions = append(b.master.Renditions, rend)
+	b.renditions = append(b.renditions, rate)
+	return nil
+}
+
+// groupBandwidth returns the largest bandwidth of the renditions in a group,
+// since a variant can be played with any one of them
+func (b *MasterBuilder) groupBandwidth(typ, group string) (bandwidth, error) {
+	var largest bandwidth
+	found := false
+	for i, rend := range b.master.Renditions {
+		if rend.Type != typ || rend.GroupID != group {
+			continue
+		}
+
+		found = true
+		if rate := b.renditions[i]; rate.peak > largest.peak {
+			largest = rate
+		}
+	}
+
+	if !found {
+		return largest, fmt.Errorf("no %s renditions in group %q", typ, group)
+	}
+	return largest, nil
+}
+
+// Build returns the master playlist. BANDWIDTH is the largest sum of peak bit
+// rates of any combination of the variant and its renditions, as 4.3.4.2
+// requires, and every group a variant refers to has to have been added
+func (b *MasterBuilder) Build() (*m3u8.MasterPlaylist, error) {
+	if len(b.master.Variants) == 0 {
+		return nil, fmt.Errorf("master playlist has no variants")
+	}
+
+	master := b.master
+	master.Variants = append([]m3u8.Variant(nil), b.master.Variants...)
+	master.Renditions = append([]m3u8.Rendition(nil), b.master.Renditions...)
+	master.IVariants = append([]m3u8.IVariant(nil), b.master.IVariants...)
+
+	for i := range master.Variants {
+		variant := &master.Variants[i]
+		total := b.variants[i]
+
+		groups := []struct{ typ, group string }{
+			{m3u8.MediaAudio, variant.Audio},
+			{m3u8.MediaVideo, variant.Video},
+			{m3u8.MediaSubtitles, variant.Subtitles},
+		}
+
+		if variant.ClosedCaptions != m3u8.CCNone {
+			groups = append(groups, struct{ typ, group string }{m3u8.MediaCaptions, variant.ClosedCaptions})
+		}
+
+		for _, group := range groups {
+			if group.group == "" {
+				continue
+			}
+
+			rate, err := b.groupBandwidth(group.typ, group.group)
+			if err != nil {
+				return nil, fmt.Errorf("variant %q: %w", variant.URI, err)
+			}
+			total.peak += rate.peak
+			total.average += rate.average
+		}
+		variant.Bandwidth, variant.BandwidthAvg = total.peak, total.average
+	}
+	return &master, nil
+}
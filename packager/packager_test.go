@@ -0,0 +1,337 @@
+package packager
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	hls "github.com/turtletowerz/go-hls"
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+func TestEncrypter(t *testing.T) {
+	for _, explicit := range []bool{false, true} {
+		keys := make(map[string][]byte)
+		e := NewEncrypter(func(index int, value []byte) (string, error) {
+			uri := fmt.Sprintf("key%d.key", index)
+			keys[uri] = value
+			return uri, nil
+		})
+		e.SetKeyRotation(2)
+		e.SetExplicitIV(explicit)
+		e.SetMediaSequence(10)
+
+		ivs := make(map[string]bool)
+		for i := 0; i < 5; i++ {
+			data := []byte(fmt.Sprintf("<segment %d>", i))
+			encrypted, err := e.Encrypt(&m3u8.Segment{URI: fmt.Sprintf("%d.ts", i), Duration: 4.2}, data)
+			if err != nil {
+				t.Fatalf("encrypting segment %d: %v", i, err)
+			}
+
+			playlist := e.Playlist()
+			segment := playlist.Segments[i]
+			index := i / 2
+			if explicit {
+				// Every segment has its own EXT-X-KEY with a fresh IV
+				index = i
+			}
+
+			if segment.KeyIndex != index {
+				t.Errorf("segment %d has key index %d, expected %d", i, segment.KeyIndex, index)
+			}
+
+			key := *playlist.Keys[segment.KeyIndex]
+			if expected := fmt.Sprintf("key%d.key", i/2); key.URI != expected {
+				t.Errorf("segment %d has key %q, expected %q", i, key.URI, expected)
+			}
+			key.Value = keys[key.URI]
+			decrypted, err := hls.Decrypt(encrypted, &key, playlist.MediaSequence+int64(i))
+			if err != nil || !bytes.Equal(decrypted, data) {
+				t.Errorf("segment %d decrypted to %q: %v", i, decrypted, err)
+			}
+
+			if explicit != (key.IV != "") || (explicit && ivs[key.IV]) {
+				t.Errorf("key %d has IV %q", segment.KeyIndex, key.IV)
+			}
+			ivs[key.IV] = true
+		}
+
+		playlist := e.Playlist()
+		encoded, err := m3u8.EncodeString(playlist)
+		if err != nil {
+			t.Fatalf("encoding playlist: %v", err)
+		}
+
+		expected := 3
+		if explicit {
+			expected = 5
+		}
+
+		if count := strings.Count(encoded, "#EXT-X-KEY"); count != expected || playlist.TargetDuration != 4 {
+			t.Errorf("unexpected playlist with %d keys:\n%s", count, encoded)
+		}
+	}
+}
+
+func TestEncryptPadding(t *testing.T) {
+	// A full block of padding is added to data that is a multiple of the block size
+	key, iv := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+	encrypted, err := Encrypt(bytes.Repeat([]byte{3}, 32), key, iv)
+	if err != nil || len(encrypted) != 48 {
+		t.Fatalf("encrypted to %d bytes: %v", len(encrypted), err)
+	}
+}
+
+func TestEncryptDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input, output := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	os.MkdirAll(input, os.ModePerm)
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6,\na.ts\n#EXTINF:6,\nb.ts\n#EXT-X-ENDLIST\n"
+	ioutil.WriteFile(filepath.Join(input, "index.m3u8"), []byte(playlist), 0644)
+	ioutil.WriteFile(filepath.Join(input, "a.ts"), []byte("segment a"), 0644)
+	ioutil.WriteFile(filepath.Join(input, "b.ts"), []byte("segment b"), 0644)
+
+	e := NewEncrypter(KeyFiles(output, "https://keys.example.com/"))
+	os.MkdirAll(output, os.ModePerm)
+	encrypted, err := e.EncryptDir(filepath.Join(input, "index.m3u8"), output)
+	if err != nil {
+		t.Fatalf("encrypting directory: %v", err)
+	}
+
+	if len(encrypted.Keys) != 1 || encrypted.Keys[0].URI != "https://keys.example.com/key0.key" || !encrypted.EndList {
+		t.Errorf("unexpected playlist %+v", encrypted)
+	}
+
+	value, err := ioutil.ReadFile(filepath.Join(output, "key0.key"))
+	if err != nil {
+		t.Fatalf("reading key: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(output, "b.ts"))
+	if err != nil {
+		t.Fatalf("reading segment: %v", err)
+	}
+
+	key := *encrypted.Keys[0]
+	key.Value = value
+	if decrypted, err := hls.Decrypt(data, &key, 1); err != nil || string(decrypted) != "segment b" {
+		t.Errorf("segment decrypted to %q: %v", decrypted, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(output, "index.m3u8")); err != nil {
+		t.Errorf("playlist was not written: %v", err)
+	}
+}
+
+func TestLiveWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(0, 0)
+	w := NewLiveWriter(filepath.Join(dir, "live.m3u8"), 3)
+	w.now = func() time.Time { return now }
+	w.SetGracePeriod(time.Second)
+
+	key := &m3u8.Key{Method: m3u8.CryptAES, URI: "key.bin"}
+	for i := 0; i < 6; i++ {
+		segment := &m3u8.Segment{URI: fmt.Sprintf("seg/%d.ts", i), Duration: 2, Discontinuity: i == 1 || i == 4}
+		if i == 0 {
+			segment.Map = &m3u8.Map{URI: "init.mp4"}
+		}
+
+		if err := w.WriteSegment(segment, []byte("data")); err != nil {
+			t.Fatalf("writing segment %d: %v", i, err)
+		}
+
+		if i == 4 {
+			w.AddSegment(&m3u8.Segment{URI: "https://example.com/remote.ts", Duration: 2}, key)
+		}
+		now = now.Add(4 * time.Second)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "live.m3u8"))
+	if err != nil {
+		t.Fatalf("opening playlist: %v", err)
+	}
+	defer file.Close()
+
+	decoded, err := m3u8.DecodeReader(file)
+	if err != nil {
+		t.Fatalf("decoding playlist: %v", err)
+	}
+
+	playlist := decoded.(*m3u8.MediaPlaylist)
+	if playlist.MediaSequence != 4 || playlist.DiscontinuitySeq != 1 || playlist.TargetDuration != 2 || playlist.EndList {
+		t.Errorf("unexpected playlist %+v", playlist)
+	}
+
+	var uris []string
+	for _, segment := range playlist.Segments {
+		uris = append(uris, segment.URI)
+	}
+
+	if strings.Join(uris, " ") != "seg/4.ts https://example.com/remote.ts seg/5.ts" {
+		t.Errorf("unexpected segments %v", uris)
+	}
+
+	if first := playlist.Segments[0]; first.Map == nil || first.Map.URI != "init.mp4" || !first.Discontinuity {
+		t.Errorf("first segment is %+v", first)
+	}
+
+	if current := w.Playlist(); len(current.Keys) != 1 || current.Segments[1].KeyIndex != 0 || current.Segments[2].KeyIndex != -1 {
+		t.Errorf("unexpected keys %+v", current.Keys)
+	}
+
+	// Segments are only deleted once their grace period has passed
+	for i := 0; i < 6; i++ {
+		_, err := os.Stat(filepath.Join(dir, "seg", fmt.Sprintf("%d.ts", i)))
+		if exists := err == nil; exists != (i >= 3) {
+			t.Errorf("segment %d exists: %v", i, exists)
+		}
+	}
+
+	if err := w.End(); err != nil {
+		t.Fatalf("ending playlist: %v", err)
+	}
+
+	if err := w.AddSegment(&m3u8.Segment{URI: "late.ts", Duration: 2}, nil); err == nil {
+		t.Errorf("added a segment after the playlist ended")
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(files) != 0 {
+		t.Errorf("temporary files were left behind: %v", files)
+	}
+}
+
+// testMedia returns a playlist whose segments are named by their size in bytes
+func testMedia(duration float32, sizes ...int) *m3u8.MediaPlaylist {
+	playlist := &m3u8.MediaPlaylist{TargetDuration: int64(duration), EndList: true}
+	for _, size := range sizes {
+		playlist.Segments = append(playlist.Segments, &m3u8.Segment{URI: fmt.Sprint(size), Duration: duration, KeyIndex: -1})
+	}
+	return playlist
+}
+
+func testSizes(segment *m3u8.Segment) (int64, error) {
+	var size int64
+	_, err := fmt.Sscan(segment.URI, &size)
+	return size, err
+}
+
+func TestMasterBuilder(t *testing.T) {
+	b := NewMasterBuilder(testSizes)
+	video := testMedia(4, 1000, 3000, 2000)
+	if peak, average, err := Bandwidth(video, testSizes); peak != 6000 || average != 4000 || err != nil {
+		t.Errorf("bandwidth is %d peak, %d average: %v", peak, average, err)
+	}
+
+	if err := b.AddVariant(video, StreamInfo{URI: "video.m3u8", Codecs: "avc1.64001f,mp4a.40.2", Resolution: m3u8.Resolution{Width: 1280, Height: 720}, Audio: "aud"}); err != nil {
+		t.Fatalf("adding variant: %v", err)
+	}
+
+	// The variant can be played with either audio rendition, so the larger one counts
+	b.AddRendition(testMedia(4, 500, 500), m3u8.Rendition{Type: m3u8.MediaAudio, GroupID: "aud", Name: "English", Language: "en", URI: "en.m3u8", Default: m3u8.MediaDefaultYES})
+	b.AddRendition(testMedia(4, 1000, 1000), m3u8.Rendition{Type: m3u8.MediaAudio, GroupID: "aud", Name: "Commentary", URI: "commentary.m3u8"})
+
+	iframes := testMedia(4, 250, 250)
+	if err := b.AddIFrameVariant(iframes, StreamInfo{URI: "iframes.m3u8"}); err == nil {
+		t.Errorf("added a playlist that is not an I-frame playlist")
+	}
+
+	iframes.IFramesOnly = true
+	if err := b.AddIFrameVariant(iframes, StreamInfo{URI: "iframes.m3u8"}); err != nil {
+		t.Fatalf("adding I-frame variant: %v", err)
+	}
+
+	master, err := b.Build()
+	if err != nil {
+		t.Fatalf("building master playlist: %v", err)
+	}
+
+	if variant := master.Variants[0]; variant.Bandwidth != 8000 || variant.BandwidthAvg != 6000 {
+		t.Errorf("variant bandwidth is %d peak, %d average", variant.Bandwidth, variant.BandwidthAvg)
+	}
+
+	if iframe := master.IVariants[0]; iframe.Bandwidth != 500 || master.Version != 4 {
+		t.Errorf("I-frame variant bandwidth is %d, version %d", iframe.Bandwidth, master.Version)
+	}
+
+	encoded, err := m3u8.EncodeString(master)
+	if err != nil {
+		t.Fatalf("encoding master playlist: %v", err)
+	}
+
+	if _, err := m3u8.DecodeReader(strings.NewReader(encoded)); err != nil {
+		t.Errorf("decoding built master playlist: %v\n%s", err, encoded)
+	}
+
+	// Variants can not refer to groups that do not exist
+	b.AddVariant(video, StreamInfo{URI: "other.m3u8", Subtitles: "subs"})
+	if _, err := b.Build(); err == nil {
+		t.Errorf("built a variant with a missing subtitle group")
+	}
+}
+
+func TestEncryptDirMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input, output := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	os.MkdirAll(input, os.ModePerm)
+	playlist := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:6\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:6,\na.m4s\n#EXT-X-ENDLIST\n"
+	ioutil.WriteFile(filepath.Join(input, "index.m3u8"), []byte(playlist), 0644)
+	ioutil.WriteFile(filepath.Join(input, "init.mp4"), []byte("init"), 0644)
+	ioutil.WriteFile(filepath.Join(input, "a.m4s"), []byte("segment a"), 0644)
+
+	// Encrypted maps have no media sequence number to derive an IV from
+	if _, err := NewEncrypter(KeyFiles(output, "")).EncryptDir(filepath.Join(input, "index.m3u8"), output); err == nil {
+		t.Error("encrypting a map without explicit IVs succeeded")
+	}
+
+	e := NewEncrypter(KeyFiles(output, ""))
+	e.SetExplicitIV(true)
+	encrypted, err := e.EncryptDir(filepath.Join(input, "index.m3u8"), output)
+	if err != nil {
+		t.Fatalf("encrypting directory: %v", err)
+	}
+
+	value, err := ioutil.ReadFile(filepath.Join(output, "key0.key"))
+	if err != nil {
+		t.Fatalf("reading key: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(output, "init.mp4"))
+	if err != nil {
+		t.Fatalf("reading map: %v", err)
+	}
+
+	key := *encrypted.Keys[encrypted.Segments[0].KeyIndex]
+	key.Value = value
+	if decrypted, err := hls.Decrypt(data, &key, 0); err != nil || string(decrypted) != "init" {
+		t.Errorf("map decrypted to %q: %v", decrypted, err)
+	}
+
+	// Byte ranges share a file, which can not be encrypted once per segment
+	playlist = "#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:6\n#EXTINF:6,\n#EXT-X-BYTERANGE:4@0\na.m4s\n#EXT-X-ENDLIST\n"
+	ioutil.WriteFile(filepath.Join(input, "index.m3u8"), []byte(playlist), 0644)
+	if _, err := NewEncrypter(KeyFiles(output, "")).EncryptDir(filepath.Join(input, "index.m3u8"), output); err == nil {
+		t.Error("encrypting a byte range succeeded")
+	}
+}
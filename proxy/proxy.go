@@ -0,0 +1,461 @@
+// Package proxy serves HLS streams through a local HTTP server, so players
+// that can not sign their requests or add headers can play streams that need them
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hls "github.com/turtletowerz/go-hls"
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+const defaultCacheSize = 256 << 20
+
+// Proxy is an http.Handler that requests playlists, keys and segments from
+// upstream with a Downloader, and rewrites every URI in the playlists it
+// serves to go through itself. Request hooks, token refreshing and rate
+// limits of the Downloader apply to every upstream request. The URLs it
+// serves are signed, so it only requests the playlists given to URL and what
+// they refer to, and can not be used to request anything else
+type Proxy struct {
+	d         *hls.Downloader
+	secret    []byte
+	prefix    string
+	decrypt   bool
+	cacheSize int64
+
+	lock   sync.Mutex
+	cache  map[string]*list.Element
+	order  *list.List // least recently used at the back
+	cached int64
+}
+
+// cachedSegment is a segment response kept by the Proxy
+type cachedSegment struct {
+	key         string
+	contentType string
+	data        []byte
+}
+
+// New creates a Proxy that makes upstream requests with d
+func New(d *hls.Downloader) *Proxy {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("generating proxy secret: %v", err))
+	}
+	return &Proxy{d: d, secret: secret, prefix: "/", cacheSize: defaultCacheSize, cache: make(map[string]*list.Element), order: list.New()}
+}
+
+// SetSecret sets the key the URLs served by the Proxy are signed with. It
+// defaults to a random one, so URLs are only valid for the Proxy that created
+// them. Proxies with the same secret accept the URLs of each other
+func (p *Proxy) SetSecret(secret []byte) {
+	p.secret = secret
+}
+
+// SetPrefix sets the path the Proxy is served under, which is
+// used in the rewritten URIs of playlists. It defaults to /
+func (p *Proxy) SetPrefix(prefix string) {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	p.prefix = prefix
+}
+
+// SetDecrypt sets whether AES-128 segments are decrypted before they are
+// served. The playlists served then have no keys, so players do not need
+// to request them
+func (p *Proxy) SetDecrypt(decrypt bool) {
+	p.decrypt = decrypt
+}
+
+// SetCacheSize sets the maximum number of bytes of segments to keep in
+// memory, removing the least recently used ones first. 0 disables the cache
+func (p *Proxy) SetCacheSize(bytes int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.cacheSize = bytes
+	p.evict()
+}
+
+// URL returns the path that the playlist at upstream is served on
+func (p *Proxy) URL(upstream string) string {
+	return p.route("playlist", url.Values{"url": {upstream}})
+}
+
+// route returns the signed path that kind is served on with query
+func (p *Proxy) route(kind string, query url.Values) string {
+	query.Set("sig", p.sign(kind, query))
+	return p.prefix + kind + "?" + query.Encode()
+}
+
+// sign returns the signature of kind and every parameter of query besides sig
+func (p *Proxy) sign(kind string, query url.Values) string {
+	signed := make(url.Values, len(query))
+	for name, values := range query {
+		if name != "sig" {
+			signed[name] = values
+		}
+	}
+
+	mac := hmac.New(sha256.New, p.secret)
+	io.WriteString(mac, kind+"?"+signed.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP serves playlists, segments and keys requested with the URLs from URL
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	upstream := query.Get("url")
+	if upstream == "" {
+		http.Error(w, "missing url", http.StatusBadRequest)
+		return
+	}
+
+	// Only URLs the Proxy created are requested upstream
+	kind := strings.TrimPrefix(r.URL.Path, p.prefix)
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(p.sign(kind, query))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	var err error
+	switch kind {
+	case "playlist":
+		err = p.servePlaylist(w, r, upstream)
+	case "segment":
+		err = p.serveSegment(w, r, upstream)
+	case "key":
+		err = p.serveKey(w, r, upstream)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		code := http.StatusBadGateway
+		var status *hls.StatusError
+		if errors.As(err, &status) {
+			code = status.Code
+		}
+		http.Error(w, err.Error(), code)
+	}
+}
+
+func (p *Proxy) servePlaylist(w http.ResponseWriter, r *http.Request, upstream string) error {
+	playlist, err := p.d.Playlist(upstream)
+	if err != nil {
+		return err
+	}
+
+	switch playlist := playlist.(type) {
+	case *m3u8.MasterPlaylist:
+		return p.writePlaylist(w, p.rewriteMaster(playlist, upstream))
+	case *m3u8.MediaPlaylist:
+		return p.writePlaylist(w, p.rewriteMedia(playlist, upstream))
+	}
+	return fmt.Errorf("unknown playlist type %d", playlist.Type())
+}
+
+func (p *Proxy) writePlaylist(w http.ResponseWriter, playlist m3u8.Playlist) error {
+	data, err := m3u8.EncodeString(playlist)
+	if err != nil {
+		return fmt.Errorf("encoding playlist: %w", err)
+	}
+
+	// Live playlists change on every reload, so they are never cached
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, data)
+	return nil
+}
+
+// resolve returns uri as an absolute URL, resolved against the playlist it came from
+func resolve(playlistURL, uri string) string {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return uri
+	}
+
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return base.ResolveReference(ref).String()
+}
+
+func (p *Proxy) rewriteMaster(master *m3u8.MasterPlaylist, upstream string) *m3u8.MasterPlaylist {
+	copied := *master
+	copied.Variants = append([]m3u8.Variant(nil), master.Variants...)
+	copied.IVariants = append([]m3u8.IVariant(nil), master.IVariants...)
+	copied.Renditions = append([]m3u8.Rendition(nil), master.Renditions...)
+	copied.SessionData = append([]m3u8.SessionData(nil), master.SessionData...)
+
+	for i := range copied.Variants {
+		copied.Variants[i].URI = p.URL(resolve(upstream, copied.Variants[i].URI))
+	}
+
+	for i := range copied.IVariants {
+		copied.IVariants[i].URI = p.URL(resolve(upstream, copied.IVariants[i].URI))
+	}
+
+	for i, rend := range copied.Renditions {
+		if rend.URI != "" {
+			copied.Renditions[i].URI = p.URL(resolve(upstream, rend.URI))
+		}
+	}
+
+	for i, session := range copied.SessionData {
+		if session.URI != "" {
+			copied.SessionData[i].URI = p.route("segment", url.Values{"url": {resolve(upstream, session.URI)}})
+		}
+	}
+
+	// Keys are preloaded by players that use the session key, which is
+	// not needed when the segments they would decrypt are decrypted already
+	if key := master.SessionKey; key != nil {
+		if p.decrypt && key.Method == m3u8.CryptAES {
+			copied.SessionKey = nil
+		} else {
+			copied.SessionKey = p.rewriteKey(key, upstream)
+		}
+	}
+	return &copied
+}
+
+func (p *Proxy) rewriteKey(key *m3u8.Key, upstream string) *m3u8.Key {
+	k := *key
+	if k.URI != "" {
+		k.URI = p.route("key", url.Values{"url": {resolve(upstream, key.URI)}})
+	}
+	return &k
+}
+
+func (p *Proxy) rewriteMedia(playlist *m3u8.MediaPlaylist, upstream string) *m3u8.MediaPlaylist {
+	copied := *playlist
+	copied.Keys = make([]*m3u8.Key, len(playlist.Keys))
+	for i, key := range playlist.Keys {
+		copied.Keys[i] = p.rewriteKey(key, upstream)
+	}
+
+	// Byte ranges of decrypted segments are requested from the Proxy
+	// as whole segments, since their length changes once decrypted
+	offsets := playlist.ByteOffsets()
+	copied.Segments = make([]*m3u8.Segment, len(playlist.Segments))
+	for i, segment := range playlist.Segments {
+		s := *segment
+		query := url.Values{"url": {resolve(upstream, segment.URI)}}
+
+		var key *m3u8.Key
+		if segment.KeyIndex >= 0 && segment.KeyIndex < len(playlist.Keys) {
+			key = playlist.Keys[segment.KeyIndex]
+		}
+
+		decrypt := p.decrypt && key != nil && key.Method == m3u8.CryptAES
+		if decrypt {
+			query.Set("key", resolve(upstream, key.URI))
+			query.Set("seq", strconv.FormatInt(playlist.MediaSequence+int64(i), 10))
+			if key.IV != "" {
+				query.Set("iv", hex.EncodeToString([]byte(key.IV)))
+			}
+			s.KeyIndex = -1
+
+			if segment.ByteRange != 0 {
+				query.Set("range", fmt.Sprintf("%d@%d", segment.ByteRange, offsets[i]))
+				s.ByteRange, s.Offset = 0, 0
+			}
+		}
+
+		if segment.Map != nil {
+			init := *segment.Map
+			mapQuery := url.Values{"url": {resolve(upstream, init.URI)}}
+
+			// 4.3.2.5 - The section is encrypted with the key that applies to the
+			// EXT-X-MAP tag, which has to have an IV since it has no sequence number
+			if decrypt {
+				mapQuery.Set("key", query.Get("key"))
+				if key.IV != "" {
+					mapQuery.Set("iv", query.Get("iv"))
+				}
+
+				if init.ByteRange != "" {
+					mapQuery.Set("range", init.ByteRange)
+					init.ByteRange = ""
+				}
+			}
+			init.URI = p.route("segment", mapQuery)
+			s.Map = &init
+		}
+
+		s.URI = p.route("segment", query)
+		copied.Segments[i] = &s
+	}
+
+	if p.decrypt {
+		// Keys that were only used by decrypted segments are no longer referenced,
+		// and the encoder only writes the keys segments refer to
+		for _, segment := range copied.Segments {
+			if segment.KeyIndex >= 0 {
+				return &copied
+			}
+		}
+		copied.Keys = nil
+	}
+	return &copied
+}
+
+func (p *Proxy) serveKey(w http.ResponseWriter, r *http.Request, upstream string) error {
+	resp, err := p.d.Get(r.Context(), upstream)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	io.Copy(w, resp.Body)
+	return nil
+}
+
+// segment returns the contents of a segment request, decrypted if it has a key
+func (p *Proxy) segment(r *http.Request, upstream string) (*cachedSegment, error) {
+	// Only the byte range is requested upstream, which is the encrypted range of decrypted segments
+	query := r.URL.Query()
+	var length, offset int
+	if value := query.Get("range"); value != "" {
+		if _, err := fmt.Sscanf(value, "%d@%d", &length, &offset); err != nil {
+			offset = 0
+			if _, err := fmt.Sscanf(value, "%d", &length); err != nil {
+				return nil, fmt.Errorf("parsing byte range %q: %w", value, err)
+			}
+		}
+
+		if offset < 0 || length <= 0 {
+			return nil, fmt.Errorf("invalid byte range %q", value)
+		}
+	}
+
+	resp, err := p.d.GetRange(r.Context(), upstream, length, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading segment: %w", err)
+	}
+
+	if len(data) < length {
+		return nil, fmt.Errorf("byte range %d@%d is outside of the segment, only %d bytes were received", length, offset, len(data))
+	}
+
+	if keyURL := query.Get("key"); keyURL != "" {
+		key := &m3u8.Key{Method: m3u8.CryptAES, URI: keyURL}
+		if iv := query.Get("iv"); iv != "" {
+			value, err := hex.DecodeString(iv)
+			if err != nil {
+				return nil, fmt.Errorf("parsing iv: %w", err)
+			}
+			key.IV = string(value)
+		}
+
+		// Media initialization sections have no sequence number to use instead of an IV
+		seq := query.Get("seq")
+		if key.IV == "" && seq == "" {
+			return nil, fmt.Errorf("encrypted media initialization section has no IV")
+		}
+
+		sequence, _ := strconv.ParseInt(seq, 10, 64)
+		if key.Value, err = p.d.LoadKey(r.Context(), key, ""); err != nil {
+			return nil, fmt.Errorf("loading key: %w", err)
+		}
+
+		if data, err = hls.Decrypt(data, key, sequence); err != nil {
+			return nil, fmt.Errorf("decrypting segment: %w", err)
+		}
+	}
+	return &cachedSegment{key: r.URL.RawQuery, contentType: resp.Header.Get("Content-Type"), data: data}, nil
+}
+
+func (p *Proxy) serveSegment(w http.ResponseWriter, r *http.Request, upstream string) error {
+	segment := p.get(r.URL.RawQuery)
+	if segment == nil {
+		var err error
+		if segment, err = p.segment(r, upstream); err != nil {
+			return err
+		}
+		p.put(segment)
+	}
+
+	if segment.contentType != "" {
+		w.Header().Set("Content-Type", segment.contentType)
+	}
+
+	// Segments never change once they are in a playlist, and
+	// ServeContent handles range requests from players
+	w.Header().Set("Cache-Control", "max-age=86400")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(segment.data))
+	return nil
+}
+
+// get returns a cached segment, marking it as the most recently used
+func (p *Proxy) get(key string) *cachedSegment {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if elem, exists := p.cache[key]; exists {
+		p.order.MoveToFront(elem)
+		return elem.Value.(*cachedSegment)
+	}
+	return nil
+}
+
+// put adds a segment to the cache, removing the least recently used
+// segments until it fits. Segments larger than the cache are not kept
+func (p *Proxy) put(segment *cachedSegment) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	size := int64(len(segment.data))
+	if size > p.cacheSize {
+		return
+	}
+
+	if elem, exists := p.cache[segment.key]; exists {
+		p.order.MoveToFront(elem)
+		return
+	}
+
+	p.cache[segment.key] = p.order.PushFront(segment)
+	p.cached += size
+	p.evict()
+}
+
+func (p *Proxy) evict() {
+	for p.cached > p.cacheSize && p.order.Len() != 0 {
+		segment := p.order.Remove(p.order.Back()).(*cachedSegment)
+		delete(p.cache, segment.key)
+		p.cached -= int64(len(segment.data))
+	}
+}
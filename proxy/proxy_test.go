@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hls "github.com/turtletowerz/go-hls"
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+var (
+	testKey = []byte("0123456789abcdef")
+	testIV  = []byte("fedcba9876543210")
+)
+
+// upstream serves an encrypted stream that requires an authorization header
+type upstream struct {
+	lock     sync.Mutex
+	requests map[string]int
+	ranges   []string
+}
+
+func (u *upstream) count(path string) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.requests[path]
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.lock.Lock()
+	if u.requests == nil {
+		u.requests = make(map[string]int)
+	}
+	u.requests[r.URL.Path]++
+	u.lock.Unlock()
+
+	if r.Header.Get("Authorization") != "secret" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/master.m3u8":
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nvideo/media.m3u8\n")
+	case r.URL.Path == "/video/media.m3u8":
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:5\n#EXT-X-KEY:METHOD=AES-128,URI=\"/key.bin\"\n")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "#EXTINF:2,\nseg%d.ts\n", i)
+		}
+		fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+	case r.URL.Path == "/fmp4/media.m3u8":
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-KEY:METHOD=AES-128,URI=\"/key.bin\",IV=0x%X\n#EXT-X-MAP:URI=\"init.mp4\"\n", testIV)
+		fmt.Fprint(w, "#EXTINF:2,\nfrag0.m4s\n#EXT-X-ENDLIST\n")
+	case r.URL.Path == "/fmp4/init.mp4":
+		w.Write(encryptIV([]byte("<init>"), testIV))
+	case r.URL.Path == "/fmp4/frag0.m4s":
+		w.Write(encryptIV(segmentData(0), testIV))
+	case r.URL.Path == "/ranges/media.m3u8":
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-KEY:METHOD=AES-128,URI=\"/key.bin\"\n")
+		fmt.Fprint(w, "#EXT-X-BYTERANGE:16@0\n#EXTINF:2,\nall.ts\n#EXT-X-BYTERANGE:16\n#EXTINF:2,\nall.ts\n#EXT-X-ENDLIST\n")
+	case r.URL.Path == "/ranges/all.ts":
+		u.lock.Lock()
+		u.ranges = append(u.ranges, r.Header.Get("Range"))
+		u.lock.Unlock()
+		data := append(encrypt(segmentData(0), 0), encrypt(segmentData(1), 1)...)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	case r.URL.Path == "/key.bin":
+		w.Write(testKey)
+	case strings.HasPrefix(r.URL.Path, "/video/seg"):
+		var index int
+		fmt.Sscanf(r.URL.Path, "/video/seg%d.ts", &index)
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write(encrypt(segmentData(index), int64(5+index)))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func segmentData(i int) []byte {
+	return []byte(fmt.Sprintf("<segment %d>", i))
+}
+
+func encrypt(data []byte, sequence int64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	return encryptIV(data, iv)
+}
+
+func encryptIV(data, iv []byte) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	block, _ := aes.NewCipher(testKey)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+	return out
+}
+
+func newTestProxy(decrypt bool) (*upstream, *httptest.Server, *httptest.Server, *Proxy) {
+	origin := new(upstream)
+	originServer := httptest.NewServer(origin)
+
+	d := hls.New(originServer.Client(), "best", 1)
+	d.AddRequestHook(hls.StaticHeaders(http.Header{"Authorization": {"secret"}}))
+
+	p := New(d)
+	p.SetPrefix("/hls")
+	p.SetDecrypt(decrypt)
+	return origin, originServer, httptest.NewServer(p), p
+}
+
+func get(t *testing.T, uri string) []byte {
+	resp, err := http.Get(uri)
+	if err != nil {
+		t.Fatalf("requesting %q: %v", uri, err)
+	}
+
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("requesting %q: %s %v %s", uri, resp.Status, err, data)
+	}
+	return data
+}
+
+// mediaPlaylist requests the master playlist through the proxy,
+// then the media playlist it refers to
+func mediaPlaylist(t *testing.T, server, originServer *httptest.Server, p *Proxy) *m3u8.MediaPlaylist {
+	master, err := m3u8.DecodeReader(bytes.NewReader(get(t, server.URL+p.URL(originServer.URL+"/master.m3u8"))))
+	if err != nil {
+		t.Fatalf("decoding master playlist: %v", err)
+	}
+
+	variant := master.(*m3u8.MasterPlaylist).Variants[0].URI
+	if !strings.HasPrefix(variant, "/hls/playlist?") {
+		t.Fatalf("variant URI was not rewritten: %q", variant)
+	}
+
+	media, err := m3u8.DecodeReader(bytes.NewReader(get(t, server.URL+variant)))
+	if err != nil {
+		t.Fatalf("decoding media playlist: %v", err)
+	}
+	return media.(*m3u8.MediaPlaylist)
+}
+
+func TestProxyDecrypt(t *testing.T) {
+	origin, originServer, server, p := newTestProxy(true)
+	defer originServer.Close()
+	defer server.Close()
+
+	media := mediaPlaylist(t, server, originServer, p)
+	if len(media.Keys) != 0 {
+		t.Errorf("decrypted playlist has %d keys", len(media.Keys))
+	}
+
+	for i, segment := range media.Segments {
+		if data := get(t, server.URL+segment.URI); !bytes.Equal(data, segmentData(i)) {
+			t.Errorf("segment %d is %q", i, data)
+		}
+	}
+
+	// Segments are served from the cache the second time
+	get(t, server.URL+media.Segments[0].URI)
+	if count := origin.count("/video/seg0.ts"); count != 1 {
+		t.Errorf("segment was requested upstream %d times", count)
+	}
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	_, originServer, server, p := newTestProxy(false)
+	defer originServer.Close()
+	defer server.Close()
+
+	media := mediaPlaylist(t, server, originServer, p)
+	if len(media.Keys) != 1 || !strings.HasPrefix(media.Keys[0].URI, "/hls/key?") {
+		t.Fatalf("key was not rewritten: %+v", media.Keys)
+	}
+
+	if key := get(t, server.URL+media.Keys[0].URI); !bytes.Equal(key, testKey) {
+		t.Errorf("proxied key is %q", key)
+	}
+
+	if data := get(t, server.URL+media.Segments[1].URI); !bytes.Equal(data, encrypt(segmentData(1), 6)) {
+		t.Errorf("segment was not passed through as it was")
+	}
+}
+
+func TestProxyDecryptMap(t *testing.T) {
+	_, originServer, server, p := newTestProxy(true)
+	defer originServer.Close()
+	defer server.Close()
+
+	playlist, err := m3u8.DecodeReader(bytes.NewReader(get(t, server.URL+p.URL(originServer.URL+"/fmp4/media.m3u8"))))
+	if err != nil {
+		t.Fatalf("decoding media playlist: %v", err)
+	}
+
+	// The section is decrypted with the key and IV that apply to EXT-X-MAP
+	media := playlist.(*m3u8.MediaPlaylist)
+	if data := get(t, server.URL+media.Segments[0].Map.URI); string(data) != "<init>" {
+		t.Errorf("media initialization section is %q", data)
+	}
+
+	if data := get(t, server.URL+media.Segments[0].URI); !bytes.Equal(data, segmentData(0)) {
+		t.Errorf("segment is %q", data)
+	}
+}
+
+func TestProxyByteRange(t *testing.T) {
+	origin, originServer, server, p := newTestProxy(true)
+	defer originServer.Close()
+	defer server.Close()
+
+	playlist, err := m3u8.DecodeReader(bytes.NewReader(get(t, server.URL+p.URL(originServer.URL+"/ranges/media.m3u8"))))
+	if err != nil {
+		t.Fatalf("decoding media playlist: %v", err)
+	}
+
+	for i, segment := range playlist.(*m3u8.MediaPlaylist).Segments {
+		if data := get(t, server.URL+segment.URI); !bytes.Equal(data, segmentData(i)) {
+			t.Errorf("segment %d is %q", i, data)
+		}
+	}
+
+	// Only the encrypted range of each segment is requested upstream
+	if expected := []string{"bytes=0-15", "bytes=16-31"}; !reflect.DeepEqual(origin.ranges, expected) {
+		t.Errorf("expected Range headers %q, got %q", expected, origin.ranges)
+	}
+}
+
+func TestProxySignature(t *testing.T) {
+	origin, originServer, server, p := newTestProxy(false)
+	defer originServer.Close()
+	defer server.Close()
+
+	media := mediaPlaylist(t, server, originServer, p)
+	signed, err := url.Parse(media.Segments[0].URI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing the upstream URL or requesting it as another kind invalidates the signature
+	query := signed.Query()
+	query.Set("url", originServer.URL+"/key.bin")
+	for _, uri := range []string{
+		"/hls/segment?" + query.Encode(),
+		"/hls/key?" + signed.RawQuery,
+		"/hls/segment?url=" + url.QueryEscape(originServer.URL+"/key.bin"),
+	} {
+		resp, err := http.Get(server.URL + uri)
+		if err != nil {
+			t.Fatalf("requesting %q: %v", uri, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("requesting %q: expected 403, got %s", uri, resp.Status)
+		}
+	}
+
+	if count := origin.count("/key.bin"); count != 0 {
+		t.Errorf("key was requested upstream %d times", count)
+	}
+
+	// Another Proxy with the same secret accepts the URLs
+	other := New(p.d)
+	other.SetPrefix("/hls")
+	other.SetSecret(p.secret)
+	if other.sign("segment", signed.Query()) != signed.Query().Get("sig") {
+		t.Error("proxy with the same secret does not accept the signature")
+	}
+}
@@ -0,0 +1,161 @@
+package hls
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that limits the rate response bodies
+// are read at. A RateLimiter can be shared by multiple Downloaders
+// to limit their combined bandwidth
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	filled float64 // tokens added in total, which waiting reads count toward
+	last   time.Time
+
+	changed chan struct{} // closed by SetRate to wake waiting reads
+}
+
+// unlimitedChunk is the size of reads without a rate, since the
+// burst that normally limits them is derived from the rate
+const unlimitedChunk = 32 * 1024
+
+// NewRateLimiter creates a RateLimiter allowing bytesPerSecond bytes
+// per second, shared between every request that uses it. A rate of 0
+// or less does not limit reads at all
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	r := &RateLimiter{last: time.Now(), changed: make(chan struct{})}
+	r.SetRate(bytesPerSecond)
+	r.tokens = r.burst
+	return r
+}
+
+// SetRate changes the rate of the limiter, taking effect for
+// any reads that are already waiting. 0 or less is unlimited
+func (r *RateLimiter) SetRate(bytesPerSecond int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Tokens up to now are added at the old rate, and waiting reads
+	// are woken to work out their delay again with the new one
+	r.refill(time.Now())
+	close(r.changed)
+	r.changed = make(chan struct{})
+
+	r.rate = float64(bytesPerSecond)
+	if r.rate <= 0 {
+		r.rate, r.burst, r.tokens = 0, unlimitedChunk, 0
+		return
+	}
+
+	// The burst allows a tenth of a second of data at once, which
+	// keeps the rate smooth without making reads too small
+	r.burst = r.rate / 10
+	if r.burst < 512 {
+		r.burst = 512
+	}
+
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+}
+
+// chunk returns the largest read that should be made at once
+func (r *RateLimiter) chunk() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return int(r.burst)
+}
+
+// refill adds the tokens accumulated since the last call at the current
+// rate. The lock has to be held
+func (r *RateLimiter) refill(now time.Time) {
+	added := now.Sub(r.last).Seconds() * r.rate
+	r.tokens += added
+	r.filled += added
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+}
+
+// wait takes n tokens from the bucket, blocking until
+// they are available or the context is cancelled
+func (r *RateLimiter) wait(ctx context.Context, n int) error {
+	r.lock.Lock()
+	if r.rate == 0 {
+		r.last = time.Now()
+		r.lock.Unlock()
+		return nil
+	}
+	r.refill(time.Now())
+
+	// Tokens are taken right away even if they go negative, so
+	// concurrent readers queue up behind each other in order. A read
+	// is done once enough tokens have been added to cover its debt
+	r.tokens -= float64(n)
+	target := r.filled
+	if r.tokens < 0 {
+		target -= r.tokens
+	}
+
+	for {
+		delay := time.Duration((target - r.filled) / r.rate * float64(time.Second))
+		changed := r.changed
+		r.lock.Unlock()
+
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+			timer.Stop()
+		}
+
+		r.lock.Lock()
+		if r.rate == 0 {
+			r.lock.Unlock()
+			return nil
+		}
+		r.refill(time.Now())
+	}
+}
+
+// limitedBody wraps a response body so reading it takes tokens from a RateLimiter
+type limitedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *RateLimiter
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if chunk := l.limiter.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := l.limiter.wait(l.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// SetRateLimiter limits the bandwidth used to download segments, keys
+// and playlists. The same RateLimiter can be given to multiple Downloaders
+func (d *Downloader) SetRateLimiter(limiter *RateLimiter) {
+	d.limiter = limiter
+}
@@ -0,0 +1,261 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// RequestHook is called on every request the Downloader makes (master
+// playlists, media playlists, keys, maps and segments) before it is sent.
+// It can be used to add headers or cookies, or to sign the request URL
+type RequestHook func(*http.Request) error
+
+// StaticHeaders returns a RequestHook that sets
+// the provided headers on every request
+func StaticHeaders(header http.Header) RequestHook {
+	return func(req *http.Request) error {
+		for name, values := range header {
+			req.Header.Del(name)
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		return nil
+	}
+}
+
+// Cookies returns a RequestHook that adds
+// the provided cookies to every request
+func Cookies(cookies ...*http.Cookie) RequestHook {
+	return func(req *http.Request) error {
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return nil
+	}
+}
+
+// TokenRefresher adds signed query parameters to every request,
+// and fetches new ones when the CDN responds with 403 Forbidden
+type TokenRefresher struct {
+	lock   sync.Mutex
+	fetch  func() (url.Values, error)
+	params url.Values
+}
+
+// NewTokenRefresher creates a TokenRefresher that calls fetch to get the
+// query parameters to sign requests with. fetch is not called until the
+// first request is made
+func NewTokenRefresher(fetch func() (url.Values, error)) *TokenRefresher {
+	return &TokenRefresher{fetch: fetch}
+}
+
+// Hook is a RequestHook that sets the current
+// query parameters on the request URL
+func (t *TokenRefresher) Hook(req *http.Request) error {
+	t.lock.Lock()
+	if t.params == nil {
+		if err := t.refresh(); err != nil {
+			t.lock.Unlock()
+			return err
+		}
+	}
+	params := t.params
+	t.lock.Unlock()
+
+	query := req.URL.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	req.URL.RawQuery = query.Encode()
+	return nil
+}
+
+// Refresh fetches new query parameters
+func (t *TokenRefresher) Refresh() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.refresh()
+}
+
+func (t *TokenRefresher) refresh() error {
+	params, err := t.fetch()
+	if err != nil {
+		return fmt.Errorf("fetching token: %w", err)
+	}
+	t.params = params
+	return nil
+}
+
+// StatusError is returned when a request
+// receives an unsuccessful response status
+type StatusError struct {
+	URL    string
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %q", e.Status)
+}
+
+// AddRequestHook adds a hook that is called on every request
+// before it is sent. Hooks are called in the order they are added
+func (d *Downloader) AddRequestHook(hook RequestHook) {
+	d.hooks = append(d.hooks, hook)
+}
+
+// SetRefreshFunc sets a function that gets called when a request receives
+// a 403 Forbidden response. If it returns nil the request is sent again.
+// Requests that are forbidden at the same time share a single refresh
+func (d *Downloader) SetRefreshFunc(f func() error) {
+	d.refresh = f
+}
+
+// UseTokenRefresher signs every request with the TokenRefresher
+// and refreshes the token when a request is forbidden
+func (d *Downloader) UseTokenRefresher(t *TokenRefresher) {
+	d.AddRequestHook(t.Hook)
+	d.SetRefreshFunc(t.Refresh)
+}
+
+func (d *Downloader) do(ctx context.Context, uri, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	for _, hook := range d.hooks {
+		if err := hook(req); err != nil {
+			return nil, fmt.Errorf("request hook: %w", err)
+		}
+	}
+	return d.client.Do(req)
+}
+
+// get requests uri with the request hooks applied, and returns
+// an error if the response does not have a successful status
+func (d *Downloader) get(ctx context.Context, uri string) (*http.Response, error) {
+	return d.send(ctx, uri, "")
+}
+
+// send is get with the Range header set to byteRange, if it is not empty
+func (d *Downloader) send(ctx context.Context, uri, byteRange string) (*http.Response, error) {
+	d.refreshLock.Lock()
+	refreshes := d.refreshes
+	d.refreshLock.Unlock()
+
+	resp, err := d.do(ctx, uri, byteRange)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusForbidden && d.refresh != nil {
+		resp.Body.Close()
+		if err := d.refreshAfter(uri, refreshes); err != nil {
+			return nil, fmt.Errorf("refreshing after forbidden response: %w", err)
+		}
+
+		if resp, err = d.do(ctx, uri, byteRange); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &StatusError{URL: uri, Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	if d.limiter != nil {
+		resp.Body = &limitedBody{ReadCloser: resp.Body, ctx: ctx, limiter: d.limiter}
+	}
+	return resp, nil
+}
+
+// refreshAfter calls the refresh function for a request that was forbidden
+// after the given number of refreshes. If another request refreshed since
+// then, it waits for that refresh instead of starting another one
+func (d *Downloader) refreshAfter(uri string, refreshes int) error {
+	d.refreshLock.Lock()
+	defer d.refreshLock.Unlock()
+
+	if d.refreshes != refreshes {
+		return nil
+	}
+
+	d.log(LevelInfo, "refreshing after forbidden response", Field{"uri", uri})
+	if err := d.refresh(); err != nil {
+		return err
+	}
+	d.refreshes++
+	return nil
+}
+
+// Get requests uri using the client, request hooks and rate limiter of the
+// Downloader. It returns a *StatusError if the response is not successful
+func (d *Downloader) Get(ctx context.Context, uri string) (*http.Response, error) {
+	return d.get(ctx, uri)
+}
+
+// GetRange requests length bytes of uri starting at offset, like the byte
+// range of EXT-X-BYTERANGE, by sending a Range header. If the server ignores
+// it and sends the whole resource, the body is cut down to the range as it
+// is read, so the body is always only the range. A length of 0 requests
+// the whole resource, like Get
+func (d *Downloader) GetRange(ctx context.Context, uri string, length, offset int) (*http.Response, error) {
+	if length == 0 {
+		return d.get(ctx, uri)
+	}
+
+	resp, err := d.send(ctx, uri, fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, int64(offset)); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("skipping to byte range %d@%d: %w", length, offset, err)
+		}
+	}
+	resp.Body = rangeBody{Reader: io.LimitReader(resp.Body, int64(length)), Closer: resp.Body}
+	return resp, nil
+}
+
+// rangeBody is a response body limited to a byte range
+type rangeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Playlist requests and decodes the playlist at uri using
+// the client, request hooks and rate limiter of the Downloader
+func (d *Downloader) Playlist(uri string) (m3u8.Playlist, error) {
+	return d.decodeURL(context.Background(), uri)
+}
+
+// decodeURL requests and decodes the playlist at uri
+func (d *Downloader) decodeURL(ctx context.Context, uri string) (m3u8.Playlist, error) {
+	resp, err := d.get(ctx, uri)
+	if err != nil {
+		return nil, fmt.Errorf("getting m3u8 url %q: %w", uri, err)
+	}
+
+	defer resp.Body.Close()
+	playlist, err := m3u8.DecodeReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding from reader: %w", err)
+	}
+	return playlist, nil
+}
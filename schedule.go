@@ -0,0 +1,380 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+const (
+	// defaultRetries is the number of times a segment is
+	// attempted before the whole download is abandoned
+	defaultRetries = 3
+
+	// defaultRetryDelay is multiplied by the attempt
+	// number to get the delay before a segment is retried
+	defaultRetryDelay = 500 * time.Millisecond
+
+	// defaultBufferBytes is the default limit on the bytes of
+	// downloaded segments waiting to be passed on in order
+	defaultBufferBytes = 64 << 20
+)
+
+type segmentResult struct {
+	index  int
+	output *groupOutput
+	data   []byte
+	err    error
+}
+
+// SetBufferSize sets the maximum number of segments that can be downloaded
+// ahead of the segment currently being written. It defaults to twice the
+// number of threads
+func (d *Downloader) SetBufferSize(segments int) {
+	d.buffer = segments
+}
+
+// SetBufferBytes sets the limit on the bytes of downloaded segments waiting
+// for an earlier segment to finish. No new segments are started while the
+// limit is reached. It defaults to 64 MiB, and a negative value disables it
+func (d *Downloader) SetBufferBytes(bytes int64) {
+	d.bufferBytes = bytes
+}
+
+// SetRetries sets the number of times a segment is attempted before the
+// download fails, and the delay before the first retry. The delay grows
+// with every attempt. It defaults to 3 attempts and 500 milliseconds
+func (d *Downloader) SetRetries(attempts int, delay time.Duration) {
+	d.retries = attempts
+	d.retryDelay = delay
+}
+
+// attempts returns the number of times a segment is attempted
+func (d *Downloader) attempts() int {
+	if d.retries < 1 {
+		return defaultRetries
+	}
+	return d.retries
+}
+
+// window limits how far the workers can get ahead of
+// the segment that is next to be passed on in order
+type window struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	ahead    int
+	buffered int64
+	segments int
+	bytes    int64
+}
+
+// reserve blocks until another segment can be started, returning
+// false if the context was cancelled while waiting
+func (w *window) reserve(ctx context.Context) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for ctx.Err() == nil && (w.ahead >= w.segments || (w.bytes > 0 && w.buffered >= w.bytes)) {
+		w.cond.Wait()
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+	w.ahead++
+	return true
+}
+
+// hold records the bytes of a finished segment waiting to be passed on
+func (w *window) hold(n int) {
+	w.lock.Lock()
+	w.buffered += int64(n)
+	w.lock.Unlock()
+}
+
+// release frees the space of a segment that has been passed on
+func (w *window) release(n int) {
+	w.lock.Lock()
+	w.ahead--
+	w.buffered -= int64(n)
+	w.cond.Broadcast()
+	w.lock.Unlock()
+}
+
+// wake wakes reserve so it can see that the context was cancelled
+func (w *window) wake() {
+	w.lock.Lock()
+	w.cond.Broadcast()
+	w.lock.Unlock()
+}
+
+// job is a segment queued for download
+type job struct {
+	index       int
+	segment     *m3u8.Segment
+	key         *m3u8.Key
+	playlistURL string
+	sequence    int64
+	offset      int          // where the byte range of the segment starts, if it has one
+	total       int          // the number of segments known to exist when the job was queued
+	raw         bool         // the segment is returned as it was received, without decrypting
+	output      *groupOutput // the DownloadAll playlist the segment is part of, if it is one
+
+	// The media initialization section in effect and the key it is encrypted
+	// with. It is only written before segments that have a Map
+	init    *m3u8.Map
+	initKey *m3u8.Key
+}
+
+// sameMap returns whether a and b are the same media initialization section
+func sameMap(a, b *m3u8.Map) bool {
+	return a != nil && b != nil && a.URI == b.URI && a.ByteRange == b.ByteRange
+}
+
+// setInit sets the media initialization section of the job, which is the Map
+// of its segment if it has one and otherwise the one of the job before it
+func (j *job) setInit(prev job) {
+	if j.segment.Map != nil {
+		j.init, j.initKey = j.segment.Map, j.key
+	} else {
+		j.init, j.initKey = prev.init, prev.initKey
+	}
+}
+
+// producer queues the segments to download. queue returns
+// false if the download was cancelled and no more should be queued
+type producer func(ctx context.Context, queue func(job) bool) error
+
+// playlistJobs returns a producer for every segment of a playlist
+func (d *Downloader) playlistJobs(playlist *m3u8.MediaPlaylist, playlistURL string) producer {
+	return func(ctx context.Context, queue func(job) bool) error {
+		if err := d.loadKeys(ctx, playlist, playlistURL); err != nil {
+			return err
+		}
+
+		var prev job
+		offsets := playlist.ByteOffsets()
+		for i, segment := range playlist.Segments {
+			j := job{index: i, segment: segment, playlistURL: playlistURL, sequence: playlist.MediaSequence + int64(i), offset: offsets[i], total: len(playlist.Segments)}
+			if segment.KeyIndex != -1 {
+				j.key = playlist.Keys[segment.KeyIndex]
+			}
+			j.setInit(prev)
+			prev = j
+
+			if !queue(j) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// fetchWithRetries downloads a segment, retrying with a growing
+// delay until it succeeds, the attempts run out or ctx is cancelled
+func (d *Downloader) fetchWithRetries(ctx context.Context, limit *limiter, j job) ([]byte, error) {
+	retries, delay := d.attempts(), d.retryDelay
+	if d.retries < 1 {
+		delay = defaultRetryDelay
+	}
+
+	var err error
+	for attempt := 1; attempt <= retries; attempt++ {
+		if limit != nil && !limit.acquire(ctx) {
+			return nil, ctx.Err()
+		}
+
+		start := time.Now()
+		var data []byte
+		if j.raw {
+			data, err = j.output.fetch(ctx, d, resource{uri: d.resolve(j.playlistURL, j.segment.URI)})
+		} else {
+			data, err = d.fetchSegment(ctx, j)
+		}
+		if limit != nil {
+			limit.release(len(data), time.Since(start), err)
+		}
+
+		if err == nil {
+			d.log(LevelDebug, "downloaded segment", Field{"segment", j.index}, Field{"uri", j.segment.URI}, Field{"attempt", attempt}, Field{"bytes", len(data)}, Field{"duration", time.Since(start)})
+			return data, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		d.log(LevelWarn, "error downloading segment", Field{"segment", j.index}, Field{"uri", j.segment.URI}, Field{"attempt", attempt}, Field{"error", err})
+		if attempt < retries {
+			select {
+			case <-time.After(delay * time.Duration(attempt)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return nil, err
+}
+
+// workers returns the number of segments that can be downloaded at once
+func (d *Downloader) workers() int {
+	threads := d.threads
+	if d.adaptiveMax > 0 {
+		threads = d.adaptiveMax
+	}
+
+	if threads < 1 {
+		return 1
+	}
+	return threads
+}
+
+// fetchAll downloads the segments queued by produce with a pool of workers
+// and passes their contents to sink in the order they were queued. The
+// first segment to fail once its retries are used up cancels the remaining
+// downloads, and its error is returned
+func (d *Downloader) fetchAll(produce producer, sink func(index int, data []byte) error) error {
+	threads := d.workers()
+	var limit *limiter
+	if d.adaptiveMax > 0 {
+		limit = newLimiter(d.adaptiveMin, d.adaptiveMax, d.log)
+	}
+
+	win := &window{segments: d.buffer, bytes: d.bufferBytes}
+	win.cond = sync.NewCond(&win.lock)
+	if win.segments < 1 {
+		win.segments = threads * 2
+	}
+
+	if win.bytes == 0 {
+		win.bytes = defaultBufferBytes
+	}
+
+	var (
+		wg          sync.WaitGroup
+		ctx, cancel = context.WithCancel(context.Background())
+		jobs        = make(chan job)
+		results     = make(chan segmentResult)
+		produced    = make(chan error, 1)
+		queued      int64
+		expected    int64
+	)
+
+	// Cancel and wait for every goroutine before returning, so
+	// nothing is left running or blocked once fetchAll returns
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		win.wake()
+		if limit != nil {
+			limit.wake()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		produced <- produce(ctx, func(j job) bool {
+			if !win.reserve(ctx) {
+				return false
+			}
+
+			select {
+			case jobs <- j:
+				atomic.StoreInt64(&expected, int64(j.total))
+				atomic.AddInt64(&queued, 1)
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if !j.output.acquire(ctx) {
+					return
+				}
+
+				data, err := d.fetchWithRetries(ctx, limit, j)
+				j.output.release()
+				select {
+				case results <- segmentResult{index: j.index, output: j.output, data: data, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	var (
+		next     int
+		finished bool
+		pending  = make(map[int][]byte)
+		output   *groupOutput
+	)
+
+	// Until the producer is finished the total is only the number of segments queued so far
+	for !finished || next < int(atomic.LoadInt64(&queued)) {
+		var result segmentResult
+		select {
+		case err := <-produced:
+			if err != nil {
+				return err
+			}
+			finished = true
+			continue
+		case result = <-results:
+		}
+
+		if result.err != nil {
+			return fmt.Errorf("downloading segment %d: %w", result.index, result.err)
+		}
+		win.hold(len(result.data))
+		pending[result.index] = result.data
+		output = result.output
+
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			if err := sink(next, data); err != nil {
+				return err
+			}
+
+			delete(pending, next)
+			next++
+			win.release(len(data))
+
+			if d.progress != nil || output != nil {
+				total := atomic.LoadInt64(&expected)
+				if count := atomic.LoadInt64(&queued); count > total {
+					total = count
+				}
+
+				// The playlists of DownloadAll report their progress together
+				var err error
+				if output != nil {
+					err = output.report(next, int(total))
+				} else {
+					err = d.progress(next, int(total))
+				}
+
+				if err != nil {
+					return fmt.Errorf("progress func error: %w", err)
+				}
+			}
+		}
+	}
+	return nil
+}
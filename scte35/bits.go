@@ -0,0 +1,73 @@
+package scte35
+
+import "fmt"
+
+// bitReader reads big-endian fields of any number of bits. Reading past the
+// end sets err, after which every read returns zero
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+func (r *bitReader) remaining() int {
+	return len(r.data) - (r.pos+7)/8
+}
+
+func (r *bitReader) check(bits int) bool {
+	if r.err == nil && r.pos+bits > len(r.data)*8 {
+		r.err = fmt.Errorf("data ends %d bits early", r.pos+bits-len(r.data)*8)
+	}
+	return r.err == nil
+}
+
+func (r *bitReader) bits(n int) uint64 {
+	if !r.check(n) {
+		return 0
+	}
+
+	var value uint64
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		value = value<<1 | uint64(bit)
+		r.pos++
+	}
+	return value
+}
+
+func (r *bitReader) flag() bool {
+	return r.bits(1) == 1
+}
+
+func (r *bitReader) skip(n int) {
+	if r.check(n) {
+		r.pos += n
+	}
+}
+
+// bytes returns the next n bytes, which have to start on a byte boundary
+func (r *bitReader) bytes(n int) []byte {
+	if !r.check(n * 8) {
+		return nil
+	}
+
+	start := r.pos / 8
+	r.pos += n * 8
+	return r.data[start : start+n]
+}
+
+// crc32 computes the MPEG-2 CRC, which is 0 for data that ends with its own CRC
+func crc32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
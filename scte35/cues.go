@@ -0,0 +1,106 @@
+package scte35
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// Where a cue was found in the playlist
+const (
+	SourceDateRangeCmd = "SCTE35-CMD"
+	SourceDateRangeOut = "SCTE35-OUT"
+	SourceDateRangeIn  = "SCTE35-IN"
+	SourceOATCLS       = "EXT-OATCLS-SCTE35"
+)
+
+// oatclsTag is the tag some packagers write base64 splice information in
+const oatclsTag = "EXT-OATCLS-SCTE35"
+
+// Cue is splice information placed on the timeline of a media playlist
+type Cue struct {
+	Segment   int             `json:"segment"` // index of the segment the cue appears before
+	Offset    time.Duration   `json:"offset"`  // from the start of the playlist to the start of the segment
+	Source    string          `json:"source"`
+	DateRange *m3u8.DateRange `json:"date_range,omitempty"` // for cues from EXT-X-DATERANGE
+	Info      *SpliceInfo     `json:"info"`
+}
+
+// Out returns whether the cue starts a break. Cues from SCTE35-OUT and
+// SCTE35-IN are out and in by definition, and the rest depend on their command
+func (c *Cue) Out() bool {
+	switch c.Source {
+	case SourceDateRangeOut:
+		return true
+	case SourceDateRangeIn:
+		return false
+	}
+	return c.Info.Out()
+}
+
+// In returns whether the cue ends a break
+func (c *Cue) In() bool {
+	switch c.Source {
+	case SourceDateRangeOut:
+		return false
+	case SourceDateRangeIn:
+		return true
+	}
+	return c.Info.In()
+}
+
+// Cues decodes the splice information in the EXT-X-DATERANGE tags and
+// EXT-OATCLS-SCTE35 tags of a playlist, in the order they appear
+func Cues(playlist *m3u8.MediaPlaylist) ([]Cue, error) {
+	var cues []Cue
+	var offset time.Duration
+	for i, segment := range playlist.Segments {
+		for j := range segment.DateRanges {
+			dateRange := &segment.DateRanges[j]
+			attributes := []struct{ source, value string }{
+				{SourceDateRangeCmd, dateRange.SCTE35Cmd},
+				{SourceDateRangeOut, dateRange.SCTE35Out},
+				{SourceDateRangeIn, dateRange.SCTE35In},
+			}
+
+			for _, attribute := range attributes {
+				if attribute.value == "" {
+					continue
+				}
+
+				info, err := DecodeHex(attribute.value)
+				if err != nil {
+					return nil, fmt.Errorf("date range %q %s: %w", dateRange.ID, attribute.source, err)
+				}
+				cues = append(cues, Cue{Segment: i, Offset: offset, Source: attribute.source, DateRange: dateRange, Info: info})
+			}
+		}
+
+		for _, tag := range segment.Tags {
+			if tag.Name != oatclsTag {
+				continue
+			}
+
+			info, ok := tag.Data.(*SpliceInfo)
+			if !ok {
+				var err error
+				if info, err = DecodeBase64(tag.Value); err != nil {
+					return nil, fmt.Errorf("segment %d %s: %w", i, tag.Name, err)
+				}
+			}
+			cues = append(cues, Cue{Segment: i, Offset: offset, Source: SourceOATCLS, Info: info})
+		}
+		offset += m3u8.Seconds(segment.Duration)
+	}
+	return cues, nil
+}
+
+// RegisterTag registers EXT-OATCLS-SCTE35 with the m3u8 package, so its
+// splice information is decoded into the Data of the tag while decoding the
+// playlist, and invalid cues stop decoding
+func RegisterTag() {
+	m3u8.RegisterTag(oatclsTag, func(value string) (interface{}, error) {
+		return DecodeBase64(value)
+	})
+}
@@ -0,0 +1,412 @@
+// Package scte35 decodes SCTE-35 splice information, which marks ad breaks
+// and other program boundaries, from the cues found in HLS playlists
+package scte35
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	tableID = 0xFC
+
+	// clockRate is the frequency of PTS values
+	clockRate = 90000
+
+	// identifierCUEI is the identifier of the descriptors defined by SCTE-35
+	identifierCUEI = 0x43554549
+)
+
+// Splice command types, from SCTE-35 table 7
+const (
+	CommandSpliceNull           = 0x00
+	CommandSpliceSchedule       = 0x04
+	CommandSpliceInsert         = 0x05
+	CommandTimeSignal           = 0x06
+	CommandBandwidthReservation = 0x07
+	CommandPrivate              = 0xFF
+)
+
+// Splice descriptor tags, from SCTE-35 table 16
+const (
+	DescriptorAvail        = 0x00
+	DescriptorDTMF         = 0x01
+	DescriptorSegmentation = 0x02
+	DescriptorTime         = 0x03
+	DescriptorAudio        = 0x04
+)
+
+// Ticks converts a PTS or duration in 90kHz ticks to a time.Duration
+func Ticks(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / clockRate
+}
+
+// SpliceTime is the time of a splice. PTS is only meaningful if Specified
+// is set, otherwise the splice happens immediately
+type SpliceTime struct {
+	Specified bool   `json:"specified"`
+	PTS       uint64 `json:"pts,omitempty"` // in 90kHz ticks, before the PTS adjustment
+}
+
+// BreakDuration is the length of an ad break
+type BreakDuration struct {
+	AutoReturn bool          `json:"auto_return"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Component is the splice time of a single elementary stream, for splices
+// that do not apply to the whole program
+type Component struct {
+	Tag  uint8      `json:"tag"`
+	Time SpliceTime `json:"time"`
+}
+
+// SpliceInsert signals a splice out of the network for a break, or back into it
+type SpliceInsert struct {
+	EventID         uint32         `json:"event_id"`
+	Cancel          bool           `json:"cancel,omitempty"`
+	OutOfNetwork    bool           `json:"out_of_network"`
+	ProgramSplice   bool           `json:"program_splice"`
+	Immediate       bool           `json:"immediate,omitempty"`
+	Time            SpliceTime     `json:"time"` // when ProgramSplice is set
+	Components      []Component    `json:"components,omitempty"`
+	BreakDuration   *BreakDuration `json:"break_duration,omitempty"`
+	UniqueProgramID uint16         `json:"unique_program_id"`
+	AvailNum        uint8          `json:"avail_num"`
+	AvailsExpected  uint8          `json:"avails_expected"`
+}
+
+// TimeSignal marks a point in time, which its segmentation descriptors give the meaning of
+type TimeSignal struct {
+	Time SpliceTime `json:"time"`
+}
+
+// SegmentationComponent is the offset of a single elementary stream from the splice time
+type SegmentationComponent struct {
+	Tag       uint8  `json:"tag"`
+	PTSOffset uint64 `json:"pts_offset"`
+}
+
+// SegmentationDescriptor describes the segment of the program that starts or ends at a splice
+type SegmentationDescriptor struct {
+	EventID             uint32                  `json:"event_id"`
+	Cancel              bool                    `json:"cancel,omitempty"`
+	ProgramSegmentation bool                    `json:"program_segmentation"`
+	DeliveryRestricted  bool                    `json:"delivery_restricted,omitempty"`
+	WebDeliveryAllowed  bool                    `json:"web_delivery_allowed,omitempty"`
+	NoRegionalBlackout  bool                    `json:"no_regional_blackout,omitempty"`
+	ArchiveAllowed      bool                    `json:"archive_allowed,omitempty"`
+	DeviceRestrictions  uint8                   `json:"device_restrictions,omitempty"`
+	Components          []SegmentationComponent `json:"components,omitempty"`
+	Duration            *time.Duration          `json:"duration,omitempty"`
+	UPIDType            uint8                   `json:"upid_type"`
+	UPID                []byte                  `json:"upid,omitempty"`
+	TypeID              uint8                   `json:"type_id"`
+	SegmentNum          uint8                   `json:"segment_num"`
+	SegmentsExpected    uint8                   `json:"segments_expected"`
+	SubSegmentNum       uint8                   `json:"sub_segment_num,omitempty"`
+	SubSegmentsExpected uint8                   `json:"sub_segments_expected,omitempty"`
+}
+
+// Segmentation type IDs that start a break, from SCTE-35 table 22. The type
+// that ends each of them is one more than it
+var breakStarts = map[uint8]bool{
+	0x22: true, // Break Start
+	0x30: true, // Provider Advertisement Start
+	0x32: true, // Distributor Advertisement Start
+	0x34: true, // Provider Placement Opportunity Start
+	0x36: true, // Distributor Placement Opportunity Start
+	0x38: true, // Provider Overlay Placement Opportunity Start
+	0x3A: true, // Distributor Overlay Placement Opportunity Start
+	0x44: true, // Provider Ad Block Start
+	0x46: true, // Distributor Ad Block Start
+}
+
+// BreakStart returns whether the descriptor starts an ad break or placement opportunity
+func (s *SegmentationDescriptor) BreakStart() bool {
+	return breakStarts[s.TypeID]
+}
+
+// BreakEnd returns whether the descriptor ends an ad break or placement opportunity
+func (s *SegmentationDescriptor) BreakEnd() bool {
+	return s.TypeID > 0 && breakStarts[s.TypeID-1]
+}
+
+// Descriptor is a splice descriptor that is not a segmentation descriptor
+type Descriptor struct {
+	Tag        uint8  `json:"tag"`
+	Identifier uint32 `json:"identifier"`
+	Data       []byte `json:"data,omitempty"`
+}
+
+// SpliceInfo is a decoded splice_info_section. Only the command matching
+// CommandType is set, and commands other than splice_insert and time_signal
+// are kept in Command undecoded
+type SpliceInfo struct {
+	SAPType       uint8                    `json:"sap_type"`
+	PTSAdjustment uint64                   `json:"pts_adjustment,omitempty"`
+	Tier          uint16                   `json:"tier"`
+	CommandType   uint8                    `json:"command_type"`
+	SpliceInsert  *SpliceInsert            `json:"splice_insert,omitempty"`
+	TimeSignal    *TimeSignal              `json:"time_signal,omitempty"`
+	Command       []byte                   `json:"command,omitempty"`
+	Segmentations []SegmentationDescriptor `json:"segmentation_descriptors,omitempty"`
+	Descriptors   []Descriptor             `json:"descriptors,omitempty"`
+}
+
+// Out returns whether the splice leaves the network for a break, either with
+// a splice_insert or a segmentation descriptor that starts one
+func (s *SpliceInfo) Out() bool {
+	if s.SpliceInsert != nil {
+		return !s.SpliceInsert.Cancel && s.SpliceInsert.OutOfNetwork
+	}
+
+	for _, segmentation := range s.Segmentations {
+		if !segmentation.Cancel && segmentation.BreakStart() {
+			return true
+		}
+	}
+	return false
+}
+
+// In returns whether the splice returns to the network at the end of a break
+func (s *SpliceInfo) In() bool {
+	if s.SpliceInsert != nil {
+		return !s.SpliceInsert.Cancel && !s.SpliceInsert.OutOfNetwork
+	}
+
+	for _, segmentation := range s.Segmentations {
+		if !segmentation.Cancel && segmentation.BreakEnd() {
+			return true
+		}
+	}
+	return false
+}
+
+// BreakDuration returns the duration of the break the splice starts, if it has one
+func (s *SpliceInfo) BreakDuration() (time.Duration, bool) {
+	if s.SpliceInsert != nil && s.SpliceInsert.BreakDuration != nil {
+		return s.SpliceInsert.BreakDuration.Duration, true
+	}
+
+	for _, segmentation := range s.Segmentations {
+		if segmentation.BreakStart() && segmentation.Duration != nil {
+			return *segmentation.Duration, true
+		}
+	}
+	return 0, false
+}
+
+// DecodeHex decodes a splice_info_section written as a hexadecimal-sequence,
+// as in the SCTE35-CMD, SCTE35-OUT and SCTE35-IN attributes of EXT-X-DATERANGE
+func DecodeHex(value string) (*SpliceInfo, error) {
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		value = value[2:]
+	}
+
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding hex: %w", err)
+	}
+	return Decode(data)
+}
+
+// DecodeBase64 decodes a splice_info_section written in base64, as in EXT-OATCLS-SCTE35
+func DecodeBase64(value string) (*SpliceInfo, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding base64: %w", err)
+	}
+	return Decode(data)
+}
+
+// Decode decodes a binary splice_info_section, checking its CRC
+func Decode(data []byte) (*SpliceInfo, error) {
+	if len(data) < 3 || data[0] != tableID {
+		return nil, fmt.Errorf("data is not a splice_info_section")
+	}
+
+	length := 3 + (int(data[1]&0x0f)<<8 | int(data[2]))
+	if length > len(data) || length < 4 {
+		return nil, fmt.Errorf("section is %d bytes, but only %d were given", length, len(data))
+	}
+
+	data = data[:length]
+	if crc32(data) != 0 {
+		return nil, fmt.Errorf("section has an invalid CRC")
+	}
+
+	r := &bitReader{data: data[:length-4]}
+	info := new(SpliceInfo)
+	r.skip(8 + 2) // table_id, section_syntax_indicator and private_indicator
+	info.SAPType = uint8(r.bits(2))
+	r.skip(12 + 8) // section_length and protocol_version
+
+	if r.flag() {
+		return nil, fmt.Errorf("encrypted splice information is not supported")
+	}
+
+	r.skip(6) // encryption_algorithm
+	info.PTSAdjustment = r.bits(33)
+	r.skip(8) // cw_index
+	info.Tier = uint16(r.bits(12))
+	commandLength := int(r.bits(12))
+	info.CommandType = uint8(r.bits(8))
+
+	// A length of 0xFFF is allowed by older versions for splice_insert when it is unknown
+	var command *bitReader
+	if commandLength == 0xFFF {
+		command = &bitReader{data: r.data[r.pos/8:]}
+	} else {
+		command = &bitReader{data: r.bytes(commandLength)}
+	}
+
+	switch info.CommandType {
+	case CommandSpliceInsert:
+		info.SpliceInsert = decodeSpliceInsert(command)
+	case CommandTimeSignal:
+		info.TimeSignal = &TimeSignal{Time: decodeSpliceTime(command)}
+	default:
+		info.Command = command.data
+	}
+
+	if command.err != nil {
+		return nil, fmt.Errorf("decoding splice command %#x: %w", info.CommandType, command.err)
+	}
+
+	if commandLength == 0xFFF {
+		r.pos += command.pos
+	}
+
+	descriptors := &bitReader{data: r.bytes(int(r.bits(16)))}
+	if r.err != nil {
+		return nil, fmt.Errorf("decoding section: %w", r.err)
+	}
+
+	for descriptors.remaining() > 0 {
+		tag := uint8(descriptors.bits(8))
+		body := &bitReader{data: descriptors.bytes(int(descriptors.bits(8)))}
+		if descriptors.err != nil {
+			return nil, fmt.Errorf("decoding descriptor %#x: %w", tag, descriptors.err)
+		}
+
+		identifier := uint32(body.bits(32))
+		if tag == DescriptorSegmentation && identifier == identifierCUEI {
+			segmentation := decodeSegmentation(body)
+			if body.err != nil {
+				return nil, fmt.Errorf("decoding segmentation descriptor: %w", body.err)
+			}
+			info.Segmentations = append(info.Segmentations, segmentation)
+			continue
+		}
+
+		if body.err != nil {
+			return nil, fmt.Errorf("decoding descriptor %#x: %w", tag, body.err)
+		}
+		info.Descriptors = append(info.Descriptors, Descriptor{Tag: tag, Identifier: identifier, Data: body.data[4:]})
+	}
+	return info, nil
+}
+
+func decodeSpliceTime(r *bitReader) SpliceTime {
+	var t SpliceTime
+	if t.Specified = r.flag(); t.Specified {
+		r.skip(6)
+		t.PTS = r.bits(33)
+	} else {
+		r.skip(7)
+	}
+	return t
+}
+
+func decodeSpliceInsert(r *bitReader) *SpliceInsert {
+	insert := &SpliceInsert{EventID: uint32(r.bits(32))}
+	insert.Cancel = r.flag()
+	r.skip(7)
+	if insert.Cancel {
+		return insert
+	}
+
+	insert.OutOfNetwork = r.flag()
+	insert.ProgramSplice = r.flag()
+	hasDuration := r.flag()
+	insert.Immediate = r.flag()
+	r.skip(4)
+
+	if insert.ProgramSplice && !insert.Immediate {
+		insert.Time = decodeSpliceTime(r)
+	}
+
+	if !insert.ProgramSplice {
+		count := int(r.bits(8))
+		for i := 0; i < count && r.err == nil; i++ {
+			component := Component{Tag: uint8(r.bits(8))}
+			if !insert.Immediate {
+				component.Time = decodeSpliceTime(r)
+			}
+			insert.Components = append(insert.Components, component)
+		}
+	}
+
+	if hasDuration {
+		insert.BreakDuration = &BreakDuration{AutoReturn: r.flag()}
+		r.skip(6)
+		insert.BreakDuration.Duration = Ticks(r.bits(33))
+	}
+
+	insert.UniqueProgramID = uint16(r.bits(16))
+	insert.AvailNum = uint8(r.bits(8))
+	insert.AvailsExpected = uint8(r.bits(8))
+	return insert
+}
+
+func decodeSegmentation(r *bitReader) SegmentationDescriptor {
+	s := SegmentationDescriptor{EventID: uint32(r.bits(32))}
+	s.Cancel = r.flag()
+	r.skip(7)
+	if s.Cancel {
+		return s
+	}
+
+	s.ProgramSegmentation = r.flag()
+	hasDuration := r.flag()
+	if s.DeliveryRestricted = !r.flag(); s.DeliveryRestricted {
+		s.WebDeliveryAllowed = r.flag()
+		s.NoRegionalBlackout = r.flag()
+		s.ArchiveAllowed = r.flag()
+		s.DeviceRestrictions = uint8(r.bits(2))
+	} else {
+		r.skip(5)
+	}
+
+	if !s.ProgramSegmentation {
+		count := int(r.bits(8))
+		for i := 0; i < count && r.err == nil; i++ {
+			component := SegmentationComponent{Tag: uint8(r.bits(8))}
+			r.skip(7)
+			component.PTSOffset = r.bits(33)
+			s.Components = append(s.Components, component)
+		}
+	}
+
+	if hasDuration {
+		duration := Ticks(r.bits(40))
+		s.Duration = &duration
+	}
+
+	s.UPIDType = uint8(r.bits(8))
+	s.UPID = r.bytes(int(r.bits(8)))
+	s.TypeID = uint8(r.bits(8))
+	s.SegmentNum = uint8(r.bits(8))
+	s.SegmentsExpected = uint8(r.bits(8))
+
+	// Sub-segments were added in a later version, so older descriptors end before them
+	if (s.TypeID == 0x34 || s.TypeID == 0x36 || s.TypeID == 0x38 || s.TypeID == 0x3A) && r.remaining() >= 2 {
+		s.SubSegmentNum = uint8(r.bits(8))
+		s.SubSegmentsExpected = uint8(r.bits(8))
+	}
+	return s
+}
@@ -0,0 +1,119 @@
+package scte35
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// Examples from SCTE-35 section 14
+const (
+	timeSignalBase64   = "/DA0AAAAAAAA///wBQb+cr0AUAAeAhxDVUVJSAAAjn/PAAGlmbAICAAAAAAsoKGKNAIAmsnRfg=="
+	spliceInsertBase64 = "/DAvAAAAAAAA///wFAVIAACPf+/+c2nALv4AUsz1AAAAAAAKAAhDVUVJAAABNWLbowo="
+)
+
+func TestDecodeTimeSignal(t *testing.T) {
+	info, err := DecodeBase64(timeSignalBase64)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+
+	if info.CommandType != CommandTimeSignal || info.TimeSignal == nil || info.TimeSignal.Time.PTS != 0x072BD0050 {
+		t.Fatalf("unexpected command %+v", info)
+	}
+
+	if len(info.Segmentations) != 1 {
+		t.Fatalf("expected 1 segmentation descriptor, got %d", len(info.Segmentations))
+	}
+
+	segmentation := info.Segmentations[0]
+	if segmentation.EventID != 0x4800008E || segmentation.TypeID != 0x34 || segmentation.SegmentNum != 2 {
+		t.Errorf("unexpected segmentation descriptor %+v", segmentation)
+	}
+
+	if segmentation.Duration == nil || *segmentation.Duration != Ticks(0x0001A599B0) {
+		t.Errorf("unexpected segmentation duration %v", segmentation.Duration)
+	}
+
+	if segmentation.UPIDType != 0x08 || hex.EncodeToString(segmentation.UPID) != "000000002ca0a18a" {
+		t.Errorf("unexpected UPID %d %x", segmentation.UPIDType, segmentation.UPID)
+	}
+
+	if !info.Out() || info.In() {
+		t.Errorf("placement opportunity start is not out")
+	}
+}
+
+func TestDecodeSpliceInsert(t *testing.T) {
+	info, err := DecodeBase64(spliceInsertBase64)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+
+	insert := info.SpliceInsert
+	if insert == nil || insert.EventID != 0x4800008F || !insert.OutOfNetwork || !insert.ProgramSplice || insert.Time.PTS != 0x07369C02E {
+		t.Fatalf("unexpected splice insert %+v", insert)
+	}
+
+	if duration, ok := info.BreakDuration(); !ok || duration != Ticks(0x00052CCF5) || !insert.BreakDuration.AutoReturn {
+		t.Errorf("unexpected break duration %v", duration)
+	}
+
+	if len(info.Descriptors) != 1 || info.Descriptors[0].Tag != DescriptorAvail || hex.EncodeToString(info.Descriptors[0].Data) != "00000135" {
+		t.Errorf("unexpected descriptors %+v", info.Descriptors)
+	}
+
+	// Changing any byte invalidates the CRC
+	data, _ := base64.StdEncoding.DecodeString(spliceInsertBase64)
+	data[20] ^= 1
+	if _, err := Decode(data); err == nil {
+		t.Errorf("section with an invalid CRC was decoded")
+	}
+
+	if _, err := Decode(data[:10]); err == nil {
+		t.Errorf("truncated section was decoded")
+	}
+}
+
+func TestCues(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString(timeSignalBase64)
+	cmd := "0x" + strings.ToUpper(hex.EncodeToString(data))
+
+	playlist, err := m3u8.DecodeReader(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-PROGRAM-DATE-TIME:2020-01-01T00:00:00Z
+#EXTINF:10,
+a.ts
+#EXT-X-DATERANGE:ID="1",START-DATE="2020-01-01T00:00:10Z",SCTE35-CMD=` + cmd + `
+#EXTINF:6,
+b.ts
+#EXT-OATCLS-SCTE35:` + spliceInsertBase64 + `
+#EXTINF:10,
+c.ts
+`))
+
+	if err != nil {
+		t.Fatalf("decoding playlist: %v", err)
+	}
+
+	cues, err := Cues(playlist.(*m3u8.MediaPlaylist))
+	if err != nil {
+		t.Fatalf("getting cues: %v", err)
+	}
+
+	if len(cues) != 2 {
+		t.Fatalf("expected 2 cues, got %d", len(cues))
+	}
+
+	if cues[0].Segment != 1 || cues[0].Offset != 10*time.Second || cues[0].Source != SourceDateRangeCmd || cues[0].DateRange.ID != "1" || !cues[0].Out() {
+		t.Errorf("unexpected first cue %+v", cues[0])
+	}
+
+	if cues[1].Segment != 2 || cues[1].Offset != 16*time.Second || cues[1].Source != SourceOATCLS || cues[1].Info.SpliceInsert == nil {
+		t.Errorf("unexpected second cue %+v", cues[1])
+	}
+}
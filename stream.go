@@ -0,0 +1,39 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+func (d *Downloader) streamMediaPlaylist(playlist *m3u8.MediaPlaylist, playlistURL string, w io.Writer) error {
+	return d.fetchAll(d.jobs(playlist, playlistURL), func(index int, data []byte) error {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("writing segment %d: %w", index, err)
+		}
+		return nil
+	})
+}
+
+// DownloadTo downloads the supplied stream url and writes the
+// decrypted segments to w in order, without using temporary files
+// or remuxing. Segments are downloaded concurrently and reordered
+// in memory, within the limits set by SetBufferSize and SetBufferBytes
+func (d *Downloader) DownloadTo(w io.Writer, stream string) error {
+	media, mediaURL, err := d.mediaPlaylist(stream)
+	if err != nil {
+		return err
+	}
+
+	if d.clip != nil {
+		if media, _, err = d.clip.apply(media); err != nil {
+			return fmt.Errorf("clipping media playlist: %w", err)
+		}
+	}
+
+	if err := d.streamMediaPlaylist(media, mediaURL, w); err != nil {
+		return fmt.Errorf("streaming media playlist: %w", err)
+	}
+	return nil
+}
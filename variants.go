@@ -0,0 +1,508 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/turtletowerz/go-hls/m3u8"
+)
+
+// segmentCache shares the segments and media initialization sections used
+// more than once when downloading several playlists together, so they are
+// only requested once. Shared responses are kept on disk until every use
+// of them has been read
+type segmentCache struct {
+	dir     string
+	lock    sync.Mutex
+	refs    map[resource]int
+	entries map[resource]*cachedFetch
+}
+
+// cachedFetch is a shared response, which is ready once done is closed
+type cachedFetch struct {
+	done      chan struct{}
+	file      string
+	err       error
+	remaining int
+}
+
+func newSegmentCache(dir string) *segmentCache {
+	return &segmentCache{dir: dir, refs: make(map[resource]int), entries: make(map[resource]*cachedFetch)}
+}
+
+// count records a use of a resource, which must be done before any downloads start
+func (c *segmentCache) count(res resource) {
+	c.refs[res]++
+}
+
+// fetch returns the body of a resource, only requesting it once if it is used more
+// than once. It can be called on a nil segmentCache, which requests it every time
+func (c *segmentCache) fetch(ctx context.Context, d *Downloader, res resource) ([]byte, error) {
+	if c == nil {
+		return d.fetchResource(ctx, res)
+	}
+
+	c.lock.Lock()
+	if c.refs[res] < 2 {
+		c.lock.Unlock()
+		return d.fetchResource(ctx, res)
+	}
+
+	entry, exists := c.entries[res]
+	if !exists {
+		entry = &cachedFetch{done: make(chan struct{}), remaining: c.refs[res]}
+		c.entries[res] = entry
+	}
+	c.lock.Unlock()
+
+	if exists {
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if entry.err != nil {
+			return nil, entry.err
+		}
+
+		data, err := ioutil.ReadFile(entry.file)
+		c.release(res, entry)
+		return data, err
+	}
+
+	data, err := d.fetchResource(ctx, res)
+	if err == nil {
+		entry.file, err = c.store(data)
+	}
+
+	if err != nil {
+		// The entry is removed so the next attempt requests it again
+		c.lock.Lock()
+		delete(c.entries, res)
+		c.lock.Unlock()
+		entry.err = err
+		close(entry.done)
+		return nil, err
+	}
+
+	close(entry.done)
+	c.release(res, entry)
+	return data, nil
+}
+
+func (c *segmentCache) store(data []byte) (string, error) {
+	file, err := ioutil.TempFile(c.dir, "*.seg")
+	if err != nil {
+		return "", fmt.Errorf("creating shared segment file: %w", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", fmt.Errorf("writing shared segment file: %w", err)
+	}
+	return file.Name(), file.Close()
+}
+
+// release marks one use of a shared response as done, removing it after the last
+func (c *segmentCache) release(res resource, entry *cachedFetch) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry.remaining--; entry.remaining <= 0 {
+		delete(c.entries, res)
+		os.Remove(entry.file)
+	}
+}
+
+// forget gives up a use of a resource that was counted but will not be made, removing
+// the shared response if it was the last use still waiting for it
+func (c *segmentCache) forget(res resource) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.refs[res]--
+	entry, ok := c.entries[res]
+	if !ok {
+		return
+	}
+
+	// A response that is still being requested is removed by the request if it was the last use
+	entry.remaining--
+	select {
+	case <-entry.done:
+		if entry.remaining <= 0 {
+			delete(c.entries, res)
+			os.Remove(entry.file)
+		}
+	default:
+	}
+}
+
+// downloadGroup is shared by the playlists downloaded together by DownloadAll.
+// Their segments are downloaded with one set of threads, and their progress
+// is reported together
+type downloadGroup struct {
+	cache    *segmentCache
+	slots    chan struct{}
+	progress ProgressFunc
+
+	lock   sync.Mutex
+	done   []int
+	totals []int
+}
+
+func (d *Downloader) newDownloadGroup(cache *segmentCache) *downloadGroup {
+	return &downloadGroup{cache: cache, slots: make(chan struct{}, d.workers()), progress: d.progress}
+}
+
+// add adds a playlist of total segments to the group
+func (g *downloadGroup) add(total int) *groupOutput {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.done = append(g.done, 0)
+	g.totals = append(g.totals, total)
+	return &groupOutput{group: g, index: len(g.totals) - 1, pending: make(map[resource]int)}
+}
+
+// groupOutput is one of the playlists of a downloadGroup
+type groupOutput struct {
+	group *downloadGroup
+	index int
+
+	lock    sync.Mutex
+	pending map[resource]int // uses counted in the cache that have not been made yet
+}
+
+// count records a use of a resource by the playlist in the cache
+func (o *groupOutput) count(res resource) {
+	o.group.cache.count(res)
+	o.pending[res]++
+}
+
+// fetch returns the body of a resource through the cache of the group.
+// It can be called on a nil groupOutput, which requests it every time
+func (o *groupOutput) fetch(ctx context.Context, d *Downloader, res resource) ([]byte, error) {
+	if o == nil {
+		return d.fetchResource(ctx, res)
+	}
+
+	data, err := o.group.cache.fetch(ctx, d, res)
+	if err == nil {
+		o.lock.Lock()
+		if o.pending[res] > 0 {
+			o.pending[res]--
+		}
+		o.lock.Unlock()
+	}
+	return data, err
+}
+
+// close gives up the uses of the playlist that were not made, because it
+// failed or some of its segments were skipped, so they are not kept on disk
+func (o *groupOutput) close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for res, count := range o.pending {
+		for ; count > 0; count-- {
+			o.group.cache.forget(res)
+		}
+		delete(o.pending, res)
+	}
+}
+
+// acquire blocks until one of the threads of the group is free, returning
+// false if ctx was cancelled first. It always succeeds on a nil groupOutput
+func (o *groupOutput) acquire(ctx context.Context) bool {
+	if o == nil {
+		return true
+	}
+
+	select {
+	case o.group.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (o *groupOutput) release() {
+	if o != nil {
+		<-o.group.slots
+	}
+}
+
+// report updates the progress of the playlist, and calls the ProgressFunc
+// with the segments of every playlist in the group combined
+func (o *groupOutput) report(done, total int) error {
+	g := o.group
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.done[o.index], g.totals[o.index] = done, total
+	if g.progress == nil {
+		return nil
+	}
+
+	var allDone, allTotal int
+	for i := range g.done {
+		allDone += g.done[i]
+		allTotal += g.totals[i]
+	}
+	return g.progress(allDone, allTotal)
+}
+
+// groupJobs sets the output of every job queued by produce
+func groupJobs(produce producer, output *groupOutput) producer {
+	return func(ctx context.Context, queue func(job) bool) error {
+		return produce(ctx, func(j job) bool {
+			j.output = output
+			return queue(j)
+		})
+	}
+}
+
+// outputName replaces anything that should not be in a file name with an underscore
+func outputName(parts ...string) string {
+	var b strings.Builder
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		if b.Len() != 0 {
+			b.WriteByte('_')
+		}
+
+		for _, r := range part {
+			if r == '-' || r == '.' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+				b.WriteRune(r)
+			} else {
+				b.WriteByte('_')
+			}
+		}
+	}
+	return b.String()
+}
+
+func variantName(prefix string, variant *m3u8.IVariant) string {
+	var resolution string
+	if variant.Resolution.Width != 0 && variant.Resolution.Height != 0 {
+		resolution = fmt.Sprintf("%dx%d", variant.Resolution.Width, variant.Resolution.Height)
+	}
+	return outputName(prefix, resolution, strconv.FormatInt(variant.Bandwidth/1000, 10)+"k")
+}
+
+// allOutput is a media playlist of a master playlist and the file it is downloaded to
+type allOutput struct {
+	kind     string
+	name     string
+	uri      string
+	playlist *m3u8.MediaPlaylist
+	trim     []string // ffmpeg arguments trimming the playlist to the clip, if it was clipped
+	group    *groupOutput
+}
+
+// downloadVTT writes the WebVTT segments of a subtitle playlist to output, removing the
+// header of every segment after the first so the result is a single WebVTT file
+func (d *Downloader) downloadVTT(produce producer, output string) error {
+	file, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("creating subtitle file: %w", err)
+	}
+
+	err = d.fetchAll(produce, func(index int, data []byte) error {
+		if index > 0 {
+			trimmed := bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+			if bytes.HasPrefix(trimmed, []byte("WEBVTT")) {
+				data = nil
+				if end := bytes.Index(trimmed, []byte("\n\n")); end != -1 {
+					data = trimmed[end+1:]
+				}
+			}
+		}
+
+		if _, err := file.Write(data); err != nil {
+			return fmt.Errorf("writing segment %d to file: %w", index, err)
+		}
+		return nil
+	})
+
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("closing subtitle file: %w", closeErr)
+	}
+	return err
+}
+
+// DownloadAll downloads every variant, I-frame variant and rendition of the
+// master playlist at stream into dir, and returns the paths of the files it
+// wrote. Files are named by the type of media along with the resolution and
+// bandwidth of variants, or the language and name of renditions. Video is
+// remuxed into .mp4 files, audio into .m4a files and subtitles are merged
+// into .vtt files. Every playlist is downloaded at the same time, sharing the
+// number of threads given to the Downloader, and segments, keys and media
+// initialization sections that are shared between them are only requested
+// once. Each playlist buffers its own segments, so up to the SetBufferSize
+// and SetBufferBytes limits can be held for every playlist. The ProgressFunc
+// is given the segments of every playlist combined
+func (d *Downloader) DownloadAll(dir, stream string) ([]string, error) {
+	if err := os.MkdirAll(tempStorage, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating temporary directory: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating output directory: %w", err)
+	}
+
+	playlist, err := d.decodeURL(context.Background(), stream)
+	if err != nil {
+		return nil, fmt.Errorf("decoding m3u8 playlist to url: %w", err)
+	}
+
+	master, ok := playlist.(*m3u8.MasterPlaylist)
+	if !ok {
+		return nil, fmt.Errorf("stream is a media playlist, use Download instead")
+	}
+
+	var outputs []*allOutput
+	for i := range master.Variants {
+		variant := &master.Variants[i]
+		outputs = append(outputs, &allOutput{kind: m3u8.MediaVideo, name: variantName("video", &variant.IVariant) + ".mp4", uri: variant.URI})
+	}
+
+	for i := range master.IVariants {
+		variant := &master.IVariants[i]
+		outputs = append(outputs, &allOutput{kind: m3u8.MediaVideo, name: variantName("iframes", variant) + ".mp4", uri: variant.URI})
+	}
+
+	for _, rend := range master.Renditions {
+		// Renditions without a URI are part of the variants, like closed captions
+		if rend.URI == "" {
+			continue
+		}
+
+		ext := ".mp4"
+		switch rend.Type {
+		case m3u8.MediaAudio:
+			ext = ".m4a"
+		case m3u8.MediaSubtitles:
+			ext = ".vtt"
+		}
+		outputs = append(outputs, &allOutput{kind: rend.Type, name: outputName(strings.ToLower(rend.Type), rend.Language, rend.Name) + ext, uri: rend.URI})
+	}
+
+	shared, err := ioutil.TempDir(tempStorage, "shared")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(shared)
+
+	// Every playlist is loaded before any segments are downloaded, so the
+	// cache knows which segments are shared. The same playlist is only
+	// downloaded once, and outputs with the same name are numbered
+	var (
+		group   = d.newDownloadGroup(newSegmentCache(shared))
+		loaded  = make(map[string]bool)
+		names   = make(map[string]bool)
+		pending []*allOutput
+	)
+
+	for _, output := range outputs {
+		output.uri = d.resolve(stream, output.uri)
+		if loaded[output.uri] {
+			continue
+		}
+		loaded[output.uri] = true
+
+		ext := filepath.Ext(output.name)
+		base := strings.TrimSuffix(output.name, ext)
+		for i := 1; names[output.name]; i++ {
+			output.name = base + "-" + strconv.Itoa(i) + ext
+		}
+		names[output.name] = true
+
+		media, err := d.decodeURL(context.Background(), output.uri)
+		if err != nil {
+			return nil, fmt.Errorf("getting media playlist from master: %w", err)
+		}
+
+		if output.playlist, ok = media.(*m3u8.MediaPlaylist); !ok {
+			return nil, fmt.Errorf("got master playlist from master playlist url (?)")
+		}
+
+		// Playlists are clipped first so the segments outside the clip are not counted
+		if d.clip != nil {
+			if output.playlist, output.trim, err = d.clip.apply(output.playlist); err != nil {
+				return nil, fmt.Errorf("clipping media playlist %s: %w", output.uri, err)
+			}
+		}
+
+		// Byte ranges are counted separately, since only the range is requested
+		output.group = group.add(len(output.playlist.Segments))
+		offsets := output.playlist.ByteOffsets()
+		for i, segment := range output.playlist.Segments {
+			output.group.count(resource{uri: d.resolve(output.uri, segment.URI), length: segment.ByteRange, offset: offsets[i]})
+			if segment.Map != nil {
+				if res, err := d.mapResource(output.uri, segment.Map); err == nil {
+					output.group.count(res)
+				}
+			}
+		}
+		pending = append(pending, output)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+		paths    []string
+	)
+
+	for _, output := range pending {
+		path := filepath.Join(dir, output.name)
+		paths = append(paths, path)
+
+		wg.Add(1)
+		go func(output *allOutput, path string) {
+			defer wg.Done()
+
+			err := d.downloadOutput(output, path)
+			if err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("downloading %s: %w", output.name, err)
+				}
+				errLock.Unlock()
+			}
+		}(output, path)
+	}
+
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return paths, nil
+}
+
+func (d *Downloader) downloadOutput(output *allOutput, path string) error {
+	// Whatever was not downloaded, because of an error or skipped
+	// segments, no longer has to be kept for this playlist
+	defer output.group.close()
+
+	d.log(LevelInfo, "downloading media playlist", Field{"uri", output.uri}, Field{"output", path})
+	produce := groupJobs(d.jobs(output.playlist, output.uri), output.group)
+	if output.kind == m3u8.MediaSubtitles {
+		return d.downloadVTT(produce, path)
+	}
+	return d.downloadMediaPlaylist(produce, path, "", "", output.trim)
+}